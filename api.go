@@ -1,21 +1,30 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/textproto"
+	"strings"
 
 	"github.com/gorilla/mux"
-
-	git "github.com/libgit2/git2go"
 )
 
-func postNote(w http.ResponseWriter, r *http.Request) {
+// reviewError replies with err and status, or 400 Bad Request if err is about an invalid
+// review parameter.
+func reviewError(w http.ResponseWriter, err error, status int) {
+	if _, ok := err.(*invalidReviewError); ok {
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func (g *gitContext) postNote(w http.ResponseWriter, r *http.Request) {
 	commit := mux.Vars(r)["commit"]
 	// mux guarantees this is set, but not that it is valid
 	// TODO: move lexical check to mux, validate its a commit here?
-	if _, err := git.NewOid(commit); err != nil {
+	if _, err := NewOid(commit); err != nil {
 		http.Error(w, fmt.Sprintf("commit is not a valid oid: %v", err), http.StatusBadRequest)
 		return
 	}
@@ -27,7 +36,7 @@ func postNote(w http.ResponseWriter, r *http.Request) {
 	if *verbose {
 		log.Println(r.Form)
 	}
-	id, err := git.NewOid(commit)
+	id, err := NewOid(commit)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -39,16 +48,298 @@ func postNote(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for k, v := range r.Form {
-		if k == "text" || k == "commit" {
+		if k == "text" || k == "commit" || k == "review" || k == "draft" {
 			continue
 		}
+		if len(v) == 1 && v[0] == "" {
+			continue // eg. no vote selected
+		}
 		msg.Header[textproto.CanonicalMIMEHeaderKey(k)] = v
 	}
+	if err := validateClient(msg.Header); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if sup := msg.Header.Get("Supersedes"); sup != "" {
+		orig, err := g.gitFindMessage(r.Form.Get("review"), commit, sup)
+		if err == nil && orig == nil && r.Form.Get("draft") == "true" {
+			orig, err = g.gitFindDraft(r.Form.Get("review"), commit, sup)
+		}
+		if err != nil {
+			reviewError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if orig == nil {
+			http.Error(w, fmt.Sprintf("no message %s on commit %s", sup, commit), http.StatusNotFound)
+			return
+		}
+		author, err := g.gitAuthor()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if orig.Header.Get("Author") != author {
+			http.Error(w, "only the author can edit or retract a message", http.StatusForbidden)
+			return
+		}
+	}
+
+	if r.Form.Get("draft") == "true" {
+		err = g.gitDraftAppend(r.Form.Get("review"), id, &msg)
+	} else {
+		err = g.gitNoteAppend(r.Form.Get("review"), id, &msg)
+	}
+	if err != nil {
+		reviewError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postPublish publishes the drafts of the review in the form, with the text and vote in it,
+// if any, as a comment on the head, and returns the number of drafts published.
+func (g *gitContext) postPublish(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var summary *Message
+	if text, vote := r.Form.Get("text"), r.Form.Get("vote"); text != "" || vote != "" {
+		summary = &Message{Header: textproto.MIMEHeader{}, Body: text}
+		if vote != "" {
+			summary.Header.Set("Vote", vote)
+		}
+		if err := validateClient(summary.Header); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	n, err := g.gitPublishDrafts(r.Form.Get("review"), summary)
+	if err != nil {
+		reviewError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n)
+}
 
-	if err := gitNoteAppend(id, &msg); err != nil {
+// postDiscard removes the drafts of the review in the form.
+func (g *gitContext) postDiscard(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := g.gitDiscardDrafts(r.Form.Get("review")); err != nil {
+		reviewError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *gitContext) getReviews(w http.ResponseWriter, r *http.Request) {
+	ids, err := g.gitReviewIds()
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	var reviews []*Review
+	for _, id := range ids {
+		rev, err := g.gitReview(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		reviews = append(reviews, rev)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reviews)
+}
+
+func (g *gitContext) getReview(w http.ResponseWriter, r *http.Request) {
+	rev, err := g.gitReview(mux.Vars(r)["review"])
+	if err != nil {
+		reviewError(w, err, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rev)
+}
+
+// A FileDiff is a file that changes in a review, as getDiffs returns them.
+type FileDiff struct {
+	Status     string
+	Path       string
+	OldPath    string // the same as Path unless renamed or copied
+	Similarity uint16
+	Binary     bool
+	Patch      string
+}
 
+// getDiffs returns the files that change in the review in the form, with their patches,
+// compared with the diff options of the repository or those in the form.
+func (g *gitContext) getDiffs(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := g.gitFormDiffOptions(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review := r.Form.Get("review")
+	deltas, err := g.gitDiffs(review, opts)
+	if err != nil {
+		reviewError(w, err, http.StatusNotFound)
+		return
+	}
+	patches, err := g.gitReviewPatches(review, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	diffs := []*FileDiff{}
+	for i, d := range deltas {
+		diffs = append(diffs, &FileDiff{
+			Status:     gitDeltaString(d.Status),
+			Path:       d.NewFile.Path,
+			OldPath:    d.OldFile.Path,
+			Similarity: d.Similarity,
+			Binary:     d.Flags&DiffFlagBinary != 0,
+			Patch:      patches[i],
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diffs)
+}
+
+// postReview creates a review, or updates the one in the path with the fields present in the form.
+func (g *gitContext) postReview(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		rev *Review
+		err error
+	)
+	if id, ok := mux.Vars(r)["review"]; ok {
+		if rev, err = g.gitReview(id); err != nil {
+			reviewError(w, err, http.StatusNotFound)
+			return
+		}
+		for k, p := range map[string]*string{"title": &rev.Title, "description": &rev.Description, "base": &rev.Base, "head": &rev.Head} {
+			if _, ok := r.Form[k]; ok {
+				*p = r.Form.Get(k)
+			}
+		}
+		if v, ok := r.Form["branch"]; ok {
+			rev.Branches = v
+		}
+		if v, ok := r.Form["participant"]; ok {
+			rev.Participants = v
+		}
+		if r.Form["base"] != nil || r.Form["head"] != nil {
+			if err := g.checkReviewRefs(rev); err != nil {
+				reviewError(w, err, http.StatusBadRequest)
+				return
+			}
+		}
+		err = g.gitSaveReview(rev)
+	} else {
+		rev, err = g.gitNewReview(r.Form.Get("title"), r.Form.Get("base"), r.Form.Get("head"))
+	}
+	if err != nil {
+		reviewError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rev)
+}
+
+// postChecks starts the checks named in the form, or all, on the head of the review.
+func (g *gitContext) postChecks(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := g.startChecks(r.Form.Get("review"), r.Form["name"]); err != nil {
+		reviewError(w, err, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// postSubmodule makes or updates the review of what the review in the form changes
+// in the submodule at path, see gitSubmoduleReview.
+func (g *gitContext) postSubmodule(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rev, err := g.gitSubmoduleReview(r.Form.Get("review"), r.Form.Get("path"))
+	if err != nil {
+		reviewError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rev)
+}
+
+// postViewed marks the file at path in the review in the form as viewed, or, with viewed=false, not.
+func (g *gitContext) postViewed(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := g.gitSetViewed(r.Form.Get("review"), r.Form.Get("path"), r.Form.Get("viewed") != "false"); err != nil {
+		reviewError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postPending adds a comment on the file and line in the form to the pending work in scope.
+func (g *gitContext) postPending(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg := &Message{Header: textproto.MIMEHeader{}, Body: r.Form.Get("text")}
+	for _, k := range []string{"File", "Line"} {
+		if v := r.Form.Get(strings.ToLower(k)); v != "" {
+			msg.Header.Set(k, v)
+		}
+	}
+	if err := validateClient(msg.Header); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if scope := r.Form.Get("scope"); scope != scopeIndex && scope != scopeWorkdir {
+		http.Error(w, fmt.Sprintf("unknown scope %q, want %s or %s", scope, scopeIndex, scopeWorkdir), http.StatusBadRequest)
+		return
+	}
+	if err := g.gitPendingAppend(r.Form.Get("review"), r.Form.Get("scope"), msg); err != nil {
+		reviewError(w, err, http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// postAnchor moves the pending comments of the review in the form, see gitAnchorPending.
+func (g *gitContext) postAnchor(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := g.gitAnchorPending(r.Form.Get("review"))
+	if err != nil {
+		reviewError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n)
+}
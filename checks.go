@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// checkConfig is the file in the root of the working directory that lists the checks, and
+// sets the diff options of gitDiffOptions, in git config syntax, eg.
+//
+//	[check "test"]
+//		command = go test ./...
+//		timeout = 10m
+const checkConfig = ".scrutinize"
+
+const (
+	checkTimeout  = 10 * time.Minute
+	checkLogLines = 40
+)
+
+type checkSpec struct {
+	Name    string
+	Command string
+	Timeout time.Duration
+}
+
+// A CheckStatus is the outcome of the latest run of a check on the head of a review.
+type CheckStatus struct {
+	Name    string
+	Command string
+	Result  string   // pass or fail, or "" if it hasn't run
+	Running bool     // a run has been started and hasn't finished
+	Message *Message // the Check: message, with the log excerpt
+}
+
+// readChecks reads the checks in fname, sorted by name.
+func (g *gitContext) readChecks(fname string) ([]*checkSpec, error) {
+	if _, err := os.Stat(fname); os.IsNotExist(err) {
+		return nil, nil
+	}
+	entries, err := g.ReadConfig(fname)
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]*checkSpec{}
+	var r []*checkSpec
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name, "check.") {
+			continue
+		}
+		i := strings.LastIndex(e.Name, ".")
+		name, key := e.Name[len("check."):i], e.Name[i+1:]
+		c := byName[name]
+		if c == nil {
+			c = &checkSpec{Name: name, Timeout: checkTimeout}
+			byName[name] = c
+			r = append(r, c)
+		}
+		switch key {
+		case "command":
+			c.Command = e.Value
+		case "timeout":
+			if c.Timeout, err = time.ParseDuration(e.Value); err != nil {
+				return nil, fmt.Errorf("%s: check %s: %v", fname, name, err)
+			}
+		}
+	}
+	for _, c := range r {
+		if c.Command == "" {
+			return nil, fmt.Errorf("%s: check %s has no command", fname, c.Name)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r, nil
+}
+
+// repoChecks reads the checks of g's working directory.  Bare repositories have none.
+func (g *gitContext) repoChecks() ([]*checkSpec, error) {
+	if g.Workdir() == "" {
+		return nil, nil
+	}
+	return g.readChecks(filepath.Join(g.Workdir(), checkConfig))
+}
+
+// runCheck runs the command of c with sh in dir, and returns whether it succeeded
+// and its output.  On timeout, the command and everything it started are killed.
+func runCheck(dir string, c *checkSpec) (bool, []byte) {
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", c.Command)
+	cmd.Dir = dir
+	cmd.Stdout, cmd.Stderr = &out, &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return false, []byte(err.Error())
+	}
+	var killed int32
+	timer := time.AfterFunc(c.Timeout, func() {
+		atomic.StoreInt32(&killed, 1)
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err := cmd.Wait()
+	timer.Stop()
+	if atomic.LoadInt32(&killed) != 0 {
+		fmt.Fprintf(&out, "\nkilled after %v\n", c.Timeout)
+	} else if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		fmt.Fprintf(&out, "\n%v\n", err)
+	}
+	return err == nil, out.Bytes()
+}
+
+// logExcerpt returns the last n lines of out.
+func logExcerpt(out []byte, n int) string {
+	lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	if len(lines) <= n {
+		return strings.Join(lines, "\n")
+	}
+	return fmt.Sprintf("... %d lines skipped\n", len(lines)-n) + strings.Join(lines[len(lines)-n:], "\n")
+}
+
+func checkMessage(c *checkSpec, ok bool, out []byte, took time.Duration) *Message {
+	msg := &Message{Header: textproto.MIMEHeader{}}
+	msg.Header.Set("Author", "check <bot@scrutinize>")
+	msg.Header.Set("Date", time.Now().UTC().Format(time.RFC3339))
+	msg.Header.Set("Check", c.Name)
+	result := "fail"
+	if ok {
+		result = "pass"
+	}
+	msg.Header.Set("Result", result)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "`%s`: %s in %v\n", c.Command, result, took.Round(time.Second))
+	if len(bytes.TrimSpace(out)) > 0 {
+		fmt.Fprintf(&b, "\n```\n%s\n```\n", strings.Replace(logExcerpt(out, checkLogLines), "```", "` ` `", -1))
+	}
+	msg.Body = b.String()
+	return msg
+}
+
+// gitRunChecks runs the named checks, or all if there are no names, on a checkout of
+// the head of review in a temporary directory, and adds their outcome as Check: messages
+// to the head.
+func (g *gitContext) gitRunChecks(review string, names []string, log io.Writer) error {
+	specs, err := g.repoChecks()
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		byName := map[string]*checkSpec{}
+		for _, c := range specs {
+			byName[c.Name] = c
+		}
+		specs = specs[:0]
+		for _, n := range names {
+			if byName[n] == nil {
+				return fmt.Errorf("no check %q in %s", n, checkConfig)
+			}
+			specs = append(specs, byName[n])
+		}
+	}
+	if len(specs) == 0 {
+		return fmt.Errorf("no checks in %s", checkConfig)
+	}
+
+	head, err := g.gitHead(review)
+	if err != nil {
+		return err
+	}
+	tree, err := g.gitCommitTree(head)
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "scrutinize-check")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := g.Checkout(tree, dir); err != nil {
+		return err
+	}
+
+	for _, c := range specs {
+		fmt.Fprintf(log, "%s: %s\n", c.Name, c.Command)
+		start := time.Now()
+		ok, out := runCheck(dir, c)
+		msg := checkMessage(c, ok, out, time.Since(start))
+		fmt.Fprintf(log, "%s: %s\n", c.Name, msg.Header.Get("Result"))
+		if err := g.gitNoteWrite(review, head, msg, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// running holds the checks started from the UI that haven't finished,
+// by repository, review and check name.
+var running = struct {
+	sync.Mutex
+	m map[[3]string]bool
+}{m: map[[3]string]bool{}}
+
+// startChecks runs gitRunChecks in the background, unless one of the checks is running already.
+func (g *gitContext) startChecks(review string, names []string) error {
+	if len(names) == 0 {
+		specs, err := g.repoChecks()
+		if err != nil {
+			return err
+		}
+		for _, c := range specs {
+			names = append(names, c.Name)
+		}
+	}
+	running.Lock()
+	defer running.Unlock()
+	for _, n := range names {
+		if running.m[[3]string{g.Path(), review, n}] {
+			return fmt.Errorf("check %s is running already", n)
+		}
+	}
+	for _, n := range names {
+		running.m[[3]string{g.Path(), review, n}] = true
+	}
+	go func() {
+		var b bytes.Buffer
+		if err := g.gitRunChecks(review, names, &b); err != nil {
+			log.Printf("checks on %s: %v", review, err)
+		}
+		if *verbose {
+			log.Print(b.String())
+		}
+		running.Lock()
+		for _, n := range names {
+			delete(running.m, [3]string{g.Path(), review, n})
+		}
+		running.Unlock()
+	}()
+	return nil
+}
+
+// latestChecks returns the newest Check: message per check name in msgs.
+func latestChecks(msgs []*Message) map[string]*Message {
+	r := map[string]*Message{}
+	for _, msg := range msgs {
+		n := msg.Header.Get("Check")
+		if n == "" {
+			continue
+		}
+		if prev := r[n]; prev == nil || !messageTime(msg).Before(messageTime(prev)) {
+			r[n] = msg
+		}
+	}
+	return r
+}
+
+// gitChecks returns the status of the configured checks on the head of review.
+func (g *gitContext) gitChecks(review string) ([]*CheckStatus, error) {
+	specs, err := g.repoChecks()
+	if err != nil || len(specs) == 0 {
+		return nil, err
+	}
+	head, err := g.gitHead(review)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := g.gitNotes(review)
+	if err != nil {
+		return nil, err
+	}
+	latest := latestChecks(notes[head.String()])
+	running.Lock()
+	defer running.Unlock()
+	var r []*CheckStatus
+	for _, c := range specs {
+		st := &CheckStatus{Name: c.Name, Command: c.Command, Running: running.m[[3]string{g.Path(), review, c.Name}], Message: latest[c.Name]}
+		if st.Message != nil {
+			st.Result = st.Message.Header.Get("Result")
+		}
+		r = append(r, st)
+	}
+	return r, nil
+}
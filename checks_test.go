@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCheck(t *testing.T) {
+	for _, tc := range []struct {
+		command string
+		timeout time.Duration
+		ok      bool
+		out     string
+	}{
+		{"echo ok; ls", time.Minute, true, "ok\nx.go\n"},
+		{"echo broken >&2; exit 1", time.Minute, false, "broken\n"},
+		{"sleep 5", 100 * time.Millisecond, false, "killed after 100ms"},
+	} {
+		dir, err := ioutil.TempDir("", "scrutinize-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err := ioutil.WriteFile(filepath.Join(dir, "x.go"), []byte("package x\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ok, out := runCheck(dir, &checkSpec{Name: "t", Command: tc.command, Timeout: tc.timeout})
+		if ok != tc.ok || !strings.Contains(string(out), tc.out) {
+			t.Errorf("%s: got %v %q, expected %v %q", tc.command, ok, out, tc.ok, tc.out)
+		}
+	}
+}
+
+func TestCheckMessage(t *testing.T) {
+	var out strings.Builder
+	for i := 1; i <= 100; i++ {
+		fmt.Fprintf(&out, "line %d\n", i)
+	}
+	msg := checkMessage(&checkSpec{Name: "test", Command: "go test ./..."}, false, []byte(out.String()), 3*time.Second)
+	msg.Header.Set("Message-Id", "0123456789abcdef")
+	msg.Header.Set("Scrutinize-Version", messageVersion)
+	if err := msg.Validate(); err != nil {
+		t.Error(err)
+	}
+	if msg.Header.Get("Result") != "fail" {
+		t.Errorf("result %q", msg.Header.Get("Result"))
+	}
+	if !strings.Contains(msg.Body, "... 60 lines skipped\nline 61\n") || !strings.HasSuffix(msg.Body, "line 100\n```\n") {
+		t.Errorf("log excerpt:\n%s", msg.Body)
+	}
+}
+
+func TestLatestChecks(t *testing.T) {
+	check := func(name, result, date string) *Message {
+		msg := &Message{Header: textproto.MIMEHeader{}}
+		msg.Header.Set("Check", name)
+		msg.Header.Set("Result", result)
+		msg.Header.Set("Date", date)
+		return msg
+	}
+	msgs := []*Message{
+		check("test", "fail", "2017-01-02T10:00:00Z"),
+		check("vet", "pass", "2017-01-02T10:00:00Z"),
+		check("test", "pass", "2017-01-02T11:00:00Z"),
+		{Header: textproto.MIMEHeader{"Date": {"2017-01-02T12:00:00Z"}}, Body: "a comment"},
+	}
+	latest := latestChecks(msgs)
+	if len(latest) != 2 || latest["test"].Header.Get("Result") != "pass" || latest["vet"].Header.Get("Result") != "pass" {
+		t.Errorf("got %v", latest)
+	}
+}
+
+// bareRepo is a Repo without a working directory.
+type bareRepo struct{ Repo }
+
+func (bareRepo) Workdir() string { return "" }
+
+func TestGitChecksBare(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+
+	// a bare repository mustn't pick up the .scrutinize of the server's working directory
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(f.Workdir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(checkConfig, []byte("[check \"test\"]\n\tcommand = true\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if checks, err := f.repoChecks(); err != nil || len(checks) != 1 {
+		t.Fatalf("repoChecks: got %v, %v", checks, err)
+	}
+	bare := &gitContext{Repo: bareRepo{f.Repo}, Name: "bare"}
+	if checks, err := bare.repoChecks(); err != nil || len(checks) != 0 {
+		t.Errorf("repoChecks of a bare repository: got %v, %v", checks, err)
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// A command is run instead of the web UI when its name is the first argument.
+type command struct {
+	args  string // synopsis
+	short string
+	run   func(g *gitContext, args []string) error
+}
+
+var commands = map[string]*command{
+	"review":       {"list | show [-history] [review] | new [options] [branch] | edit [options] review | attach review [branch]", "list, show, create and edit reviews", (*gitContext).cmdReview},
+	"check":        {"[-review review] [name...]", "run the checks in .scrutinize on the head of a review and add their results", (*gitContext).cmdCheck},
+	"comment":      {"list [-history] | edit message-id text | retract message-id  [-review review]", "list, edit and retract comments", (*gitContext).cmdComment},
+	"draft":        {"list | publish [-vote approve|reject] [summary] | discard  [-review review]", "list your draft comments, or publish or discard them all", (*gitContext).cmdDraft},
+	"export":       {"[-format md|html|json|github|gerrit] [-o file] [review]", "write a report of a review, or the payload to post it to GitHub or Gerrit", (*gitContext).cmdExport},
+	"import":       {"[-format github|gitlab] [-authors file] [-review review] file...", "import review comments exported from GitHub or GitLab", (*gitContext).cmdImport},
+	"import-sarif": {"[-tool name] [-review review] file...", "add the findings in SARIF logs or file:line: text output of linters as comments", (*gitContext).cmdImportSARIF},
+	"mail":         {"export [-o file] [review] | import [-review review] mbox...", "write a review as a patch series with the comments as replies, or import the comments in replies", (*gitContext).cmdMail},
+	"migrate":      {"[-n]", "rewrite the notes of all reviews in the current message format", (*gitContext).cmdMigrate},
+	"pending":      {"show | comment [-file path [-line n]] text | anchor  [-review review] [-scope index|workdir]", "review uncommitted work, and move the comments on it to the commit made of it", (*gitContext).cmdPending},
+}
+
+func (g *gitContext) cmdReview(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subcommand, want list, show, new, edit or attach")
+	}
+
+	fs := flag.NewFlagSet("review "+args[0], flag.ExitOnError)
+	title := fs.String("title", "", "Title of the review.")
+	descr := fs.String("description", "", "Description of the review.")
+	base := fs.String("base", "", "Branch or ref to compare to, default -baseline.")
+	head := fs.String("head", "", "Branch or commit under review.")
+	branches := fs.String("branches", "", "Comma separated names of the branches pointing to the review.")
+	participants := fs.String("participants", "", "Comma separated participants of the review.")
+	history := fs.Bool("history", false, "With show, list all versions of the description.")
+	fs.Parse(args[1:])
+
+	switch args[0] {
+	case "list":
+		reviews, err := g.gitReviews()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+		fmt.Fprintln(tw, "ID\tTITLE\tHEAD\tAHEAD\tOPEN\tAPPROVAL\tLAST ACTIVITY")
+		for _, r := range reviews {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n", r.Id, r.Title, r.Head, r.Ahead, r.OpenThreads, r.Approval, r.LastActivity.Format("2006-01-02 15:04"))
+		}
+		return tw.Flush()
+
+	case "show":
+		rs, err := g.gitReviewSummary(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Review:       %s\n", rs.Id)
+		fmt.Printf("Title:        %s\n", rs.Title)
+		fmt.Printf("Range:        %s..%s (%d ahead, %d behind)\n", rs.Base, rs.Head, rs.Ahead, rs.Behind)
+		fmt.Printf("Branches:     %s\n", strings.Join(rs.Branches, ", "))
+		fmt.Printf("Participants: %s\n", strings.Join(append(append([]string(nil), rs.Participants...), rs.Authors...), ", "))
+		fmt.Printf("Messages:     %d, %d open threads\n", rs.Messages, rs.OpenThreads)
+		if rs.Approval != "" {
+			fmt.Printf("Approval:     %s\n", rs.Approval)
+		}
+		if !*history {
+			if rs.Description != "" {
+				fmt.Printf("\n%s", rs.Description)
+			}
+			return nil
+		}
+		descr, err := g.gitDescriptions(rs.Id)
+		if err != nil {
+			return err
+		}
+		for i, msg := range descr {
+			fmt.Printf("\n--- Version %d by %s on %s\n%s", i+1, msg.Header.Get("Author"), msg.Header.Get("Date"), msg.Body)
+		}
+		return nil
+
+	case "new":
+		if *head == "" {
+			*head = fs.Arg(0)
+		}
+		r, err := g.gitNewReview(*title, *base, *head)
+		if err != nil {
+			return err
+		}
+		if *descr != "" || *participants != "" {
+			r.Description = *descr
+			r.Participants = splitList(*participants)
+			if err := g.gitSaveReview(r); err != nil {
+				return err
+			}
+		}
+		fmt.Println(r.Id)
+		return nil
+
+	case "edit":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("edit needs exactly one review")
+		}
+		r, err := g.gitReview(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "title":
+				r.Title = *title
+			case "description":
+				r.Description = *descr
+			case "base":
+				r.Base = *base
+			case "head":
+				r.Head = *head
+			case "branches":
+				r.Branches = splitList(*branches)
+			case "participants":
+				r.Participants = splitList(*participants)
+			}
+		})
+		return g.gitSaveReview(r)
+
+	case "attach":
+		if fs.NArg() < 1 || fs.NArg() > 2 {
+			return fmt.Errorf("attach needs a review and optionally a branch")
+		}
+		r, err := g.gitReview(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		branch := fs.Arg(1)
+		if branch == "" {
+			if branch, err = g.gitCheckoutName(); err != nil {
+				return err
+			}
+		}
+		return g.gitAttachReview(branch, r.Id)
+	}
+	return fmt.Errorf("unknown subcommand %q", args[0])
+}
+
+func splitList(s string) []string {
+	var r []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
+func (g *gitContext) cmdComment(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subcommand, want list, edit or retract")
+	}
+
+	fs := flag.NewFlagSet("comment "+args[0], flag.ExitOnError)
+	review := fs.String("review", "", "Review, default the one of the current checkout.")
+	history := fs.Bool("history", false, "With list, show earlier versions of edited messages.")
+	fs.Parse(args[1:])
+
+	notes, err := g.gitNotes(*review)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		var all []*Message
+		for _, msgs := range notes {
+			all = append(all, msgs...)
+		}
+		sort.SliceStable(all, func(i, j int) bool { return messageTime(all[i]).Before(messageTime(all[j])) })
+		for _, msg := range all {
+			printComment(msg, "")
+			if *history {
+				for _, h := range msg.History {
+					printComment(h, "    was: ")
+				}
+			}
+		}
+		return nil
+
+	case "edit", "retract":
+		if args[0] == "edit" && fs.NArg() < 2 || args[0] == "retract" && fs.NArg() != 1 {
+			return fmt.Errorf("%s: wrong number of arguments", args[0])
+		}
+		var orig *Message
+		for _, msgs := range notes {
+			for _, msg := range msgs {
+				if msg.Header.Get("Message-Id") == fs.Arg(0) {
+					orig = msg
+				}
+			}
+		}
+		if orig == nil {
+			return fmt.Errorf("no message %s", fs.Arg(0))
+		}
+		author, err := g.gitAuthor()
+		if err != nil {
+			return err
+		}
+		if orig.Header.Get("Author") != author {
+			return fmt.Errorf("only the author, %s, can %s message %s", orig.Header.Get("Author"), args[0], fs.Arg(0))
+		}
+		id, err := NewOid(orig.Header.Get("Commit"))
+		if err != nil {
+			return err
+		}
+		msg := &Message{Header: textproto.MIMEHeader{}}
+		msg.Header.Set("Supersedes", fs.Arg(0))
+		if args[0] == "edit" {
+			msg.Body = strings.Join(fs.Args()[1:], " ")
+		} else {
+			msg.Header.Set("Retracted", "true")
+		}
+		return g.gitNoteAppend(*review, id, msg)
+	}
+	return fmt.Errorf("unknown subcommand %q", args[0])
+}
+
+func (g *gitContext) cmdDraft(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subcommand, want list, publish or discard")
+	}
+	fs := flag.NewFlagSet("draft "+args[0], flag.ExitOnError)
+	review := fs.String("review", "", "Review, default that of the current checkout.")
+	vote := fs.String("vote", "", "With publish, approve or reject the head of the review.")
+	fs.Parse(args[1:])
+
+	switch args[0] {
+	case "list":
+		drafts, err := g.gitDrafts(*review)
+		if err != nil {
+			return err
+		}
+		var all []*Message
+		for _, msgs := range drafts {
+			all = append(all, msgs...)
+		}
+		sort.SliceStable(all, func(i, j int) bool { return messageTime(all[i]).Before(messageTime(all[j])) })
+		for _, msg := range all {
+			printComment(msg, "")
+		}
+		return nil
+
+	case "publish":
+		var summary *Message
+		if fs.NArg() > 0 || *vote != "" {
+			summary = &Message{Header: textproto.MIMEHeader{}, Body: strings.Join(fs.Args(), " ")}
+			if *vote != "" {
+				summary.Header.Set("Vote", *vote)
+			}
+		}
+		n, err := g.gitPublishDrafts(*review, summary)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("published %d drafts\n", n)
+		return nil
+
+	case "discard":
+		return g.gitDiscardDrafts(*review)
+	}
+	return fmt.Errorf("unknown subcommand %q", args[0])
+}
+
+func (g *gitContext) cmdExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "md", "Format of the report: md, html or json, or github or gerrit for the JSON to post to their review APIs.")
+	out := fs.String("o", "", "File to write the report to, default standard output.")
+	fs.Parse(args)
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return g.writeReport(w, fs.Arg(0), *format)
+}
+
+func (g *gitContext) cmdCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	review := fs.String("review", "", "Review to check the head of, default that of the current checkout.")
+	fs.Parse(args)
+	return g.gitRunChecks(*review, fs.Args(), os.Stdout)
+}
+
+func (g *gitContext) cmdPending(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subcommand, want show, comment or anchor")
+	}
+	fs := flag.NewFlagSet("pending "+args[0], flag.ExitOnError)
+	review := fs.String("review", "", "Review, default the one of the current checkout, which is the only one that can have pending work.")
+	scope := fs.String("scope", scopeWorkdir, "With show and comment, the work to review: index, or workdir for the tracked files in the working tree.")
+	file := fs.String("file", "", "With comment, the file the comment is about.")
+	line := fs.Int("line", 0, "With comment, the line in -file the comment is about.")
+	fs.Parse(args[1:])
+
+	switch args[0] {
+	case "show":
+		p, err := g.gitPending(*review, *scope)
+		if err != nil {
+			return err
+		}
+		for _, d := range p.Deltas {
+			fmt.Printf("%s %s\n", gitDeltaString(d.Status), d.NewFile.Path)
+		}
+		for _, msg := range p.Messages {
+			printComment(msg, "")
+		}
+		if p.Stale > 0 {
+			fmt.Printf("%d comments on work that has been committed since, see pending anchor\n", p.Stale)
+		}
+		return nil
+
+	case "comment":
+		if fs.NArg() == 0 {
+			return fmt.Errorf("comment: missing text")
+		}
+		msg := &Message{Header: textproto.MIMEHeader{}, Body: strings.Join(fs.Args(), " ")}
+		if *file != "" {
+			msg.Header.Set("File", *file)
+			if *line > 0 {
+				msg.Header.Set("Line", strconv.Itoa(*line))
+			}
+		}
+		return g.gitPendingAppend(*review, *scope, msg)
+
+	case "anchor":
+		n, err := g.gitAnchorPending(*review)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("anchored %d comments\n", n)
+		return nil
+	}
+	return fmt.Errorf("unknown subcommand %q", args[0])
+}
+
+func (g *gitContext) cmdImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "", "Format of the files, github (pull request comments) or gitlab (merge request discussions), default by their contents.")
+	authorsFile := fs.String("authors", "", "File with lines of login = Name <email> to map forge users to git authors.")
+	review := fs.String("review", "", "Review to import the comments into, default that of the current checkout.")
+	fs.Parse(args)
+
+	authors := map[string]string{}
+	if *authorsFile != "" {
+		f, err := os.Open(*authorsFile)
+		if err != nil {
+			return err
+		}
+		authors, err = readAuthors(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	for _, fname := range fs.Args() {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		comments, err := parseForge(data, *format, authors)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fname, err)
+		}
+		n, err := g.gitImport(*review, forgeMessages(comments), os.Stderr)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fname, err)
+		}
+		fmt.Printf("%s: imported %d of %d comments\n", fname, n, len(comments))
+	}
+	return nil
+}
+
+func (g *gitContext) cmdImportSARIF(args []string) error {
+	fs := flag.NewFlagSet("import-sarif", flag.ExitOnError)
+	tool := fs.String("tool", "lint", "Name of the tool, for files that are not SARIF logs.")
+	review := fs.String("review", "", "Review to add the findings to, default that of the current checkout.")
+	fs.Parse(args)
+
+	var findings []*finding
+	for _, fname := range fs.Args() {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		var fnd []*finding
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+			fnd, err = parseSARIF(data, g.Workdir())
+		} else {
+			fnd, err = parseFindings(bytes.NewReader(data), *tool, g.Workdir())
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", fname, err)
+		}
+		findings = append(findings, fnd...)
+	}
+	added, outdated, err := g.gitImportFindings(*review, findings, os.Stderr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d findings, %d new, %d outdated\n", len(findings), added, outdated)
+	return nil
+}
+
+func (g *gitContext) cmdMail(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subcommand, want export or import")
+	}
+	fs := flag.NewFlagSet("mail "+args[0], flag.ExitOnError)
+	out := fs.String("o", "", "With export, the mbox file to write, default standard output.")
+	review := fs.String("review", "", "With import, the review to add the comments to, default that of the current checkout.")
+	fs.Parse(args[1:])
+
+	switch args[0] {
+	case "export":
+		w := os.Stdout
+		if *out != "" {
+			f, err := os.Create(*out)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return g.gitMailExport(fs.Arg(0), w)
+
+	case "import":
+		for _, fname := range fs.Args() {
+			f, err := os.Open(fname)
+			if err != nil {
+				return err
+			}
+			mails, err := readMbox(f)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %v", fname, err)
+			}
+			n, total, err := g.gitMailImport(*review, mails, os.Stderr)
+			if err != nil {
+				return fmt.Errorf("%s: %v", fname, err)
+			}
+			fmt.Printf("%s: imported %d of %d comments\n", fname, n, total)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown subcommand %q", args[0])
+}
+
+func (g *gitContext) cmdMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("n", false, "Dry run: only report what would change.")
+	fs.Parse(args)
+	return g.gitMigrate(*dryRun, os.Stdout)
+}
+
+func printComment(msg *Message, pfx string) {
+	where := msg.Header.Get("Commit")
+	if len(where) > 7 {
+		where = where[:7]
+	}
+	if f := msg.Header.Get("File"); f != "" {
+		where += " " + f
+		if l := msg.Header.Get("Line"); l != "" {
+			where += ":" + l
+		}
+	}
+	var flags []string
+	for _, k := range []string{"Status", "Vote"} {
+		if v := msg.Header.Get(k); v != "" {
+			flags = append(flags, v)
+		}
+	}
+	if st := msg.Header.Get("Signature-Status"); st != "" && st != sigUnverified {
+		flags = append(flags, st)
+	}
+	if msg.Header.Get("Retracted") == "true" {
+		flags = append(flags, "retracted")
+	} else if msg.Header.Get("Edited") != "" {
+		flags = append(flags, "edited")
+	}
+	fmt.Printf("%s%s %s %s %s [%s]\n", pfx, msg.Header.Get("Message-Id"), where, msg.Header.Get("Author"), msg.Header.Get("Date"), strings.Join(flags, ","))
+	for _, l := range strings.Split(strings.TrimRight(msg.Body, "\n"), "\n") {
+		if l != "" {
+			fmt.Printf("%s\t%s\n", pfx, l)
+		}
+	}
+}
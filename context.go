@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A gitContext is a repository the UI serves, or the command line works on.
+// Its pages are under /r/<Name>/, and its reviews are in its own notes refs.
+// Everything that reads or writes reviews is a method on it.
+type gitContext struct {
+	Repo
+	Name       string
+	review     string                 // the review of the current checkout, from -review, see gitReviewId
+	submodules map[string]*gitContext // the checked out ones, by path, see openSubmodules
+}
+
+// root returns the path g's pages are under, or "" for a nil g.
+// Names need no escaping, see repoName.
+func (g *gitContext) root() string {
+	if g == nil {
+		return ""
+	}
+	return "/r/" + g.Name
+}
+
+// openContexts opens the repositories at paths, and those directly in the directory scan
+// if it isn't "". They are named after their directory, made unique with a -2, -3...
+// Each is followed by its checked out submodules.
+func openContexts(paths []string, scan string) ([]*gitContext, error) {
+	if scan != "" {
+		fis, err := ioutil.ReadDir(scan)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if p := filepath.Join(scan, fi.Name()); fi.IsDir() && isRepoDir(p) {
+				paths = append(paths, p)
+			}
+		}
+	}
+	var r []*gitContext
+	seen := map[string]bool{}
+	for _, p := range paths {
+		repo, err := openRepository(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+		if seen[repo.Path()] {
+			continue
+		}
+		seen[repo.Path()] = true
+		base := repoName(repo)
+		name := base
+		for i := 2; seen[" "+name]; i++ {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+		seen[" "+name] = true // no path starts with a space
+		g := &gitContext{Repo: repo, Name: name}
+		subs, err := g.openSubmodules()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+		r = append(r, g)
+		for _, sub := range subs {
+			if !seen[sub.Path()] {
+				seen[sub.Path()] = true
+				r = append(r, sub)
+			}
+		}
+	}
+	return r, nil
+}
+
+// isRepoDir reports whether dir is the top of a repository: it has a .git, or is a bare one.
+// Opening a repository looks in the parent directories as well, which a scan shouldn't.
+func isRepoDir(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return true
+	}
+	for _, f := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+var unsafeNameRe = regexp.MustCompile(`[^\w./-]+`)
+
+// repoName returns the name of the directory of r, without the .git of bare repositories,
+// with a - for anything that would need escaping in a url. Only submodules have a / in
+// their name, see openSubmodules.
+func repoName(r Repo) string {
+	dir := r.Workdir()
+	if dir == "" {
+		dir = r.Path()
+	}
+	name := strings.TrimSuffix(filepath.Base(strings.TrimSuffix(dir, "/")), ".git")
+	return unsafeNameRe.ReplaceAllString(name, "-")
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A ReviewSummary is the state of one review as shown on the dashboard.
+type ReviewSummary struct {
+	*Review
+	NotesRef     string // the ref the review messages are stored on
+	HeadId       *Oid   `json:"-"` // nil if the head is gone but the notes are not
+	Ahead        int    // commits on the head not on the base
+	Behind       int    // commits on the base not on the head
+	Messages     int
+	OpenThreads  int
+	Approval     string   // "approved", "rejected" or "" if nobody voted
+	Authors      []string // of the messages, in addition to the Participants
+	LastActivity time.Time
+}
+
+// gitReviews lists every review that has notes and every local branch that
+// points to none, except the baseline itself.
+func (g *gitContext) gitReviews() ([]*ReviewSummary, error) {
+	ids, err := g.gitReviewIds()
+	if err != nil {
+		return nil, err
+	}
+	names, err := g.gitRefNames()
+	if err != nil {
+		return nil, err
+	}
+
+	reviews := map[string]bool{}
+	for _, id := range ids {
+		reviews[id] = true
+	}
+	for _, n := range names {
+		if !strings.HasPrefix(n, "refs/heads/") || n == *baseline {
+			continue
+		}
+		id, err := g.gitReviewId(strings.TrimPrefix(n, "refs/heads/"))
+		if err != nil {
+			return nil, err
+		}
+		reviews[id] = true
+	}
+
+	var r []*ReviewSummary
+	for id := range reviews {
+		rs, err := g.gitReviewSummary(id)
+		if err != nil {
+			return r, err
+		}
+		r = append(r, rs)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].LastActivity.After(r[j].LastActivity) })
+	return r, nil
+}
+
+func (g *gitContext) gitReviewSummary(review string) (*ReviewSummary, error) {
+	rev, err := g.gitReview(review)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := g.gitNotesRef(rev.Id)
+	if err != nil {
+		return nil, err
+	}
+	rs := &ReviewSummary{Review: rev, NotesRef: ref}
+
+	if head, err := g.gitHead(rev.Id); err == nil {
+		rs.HeadId = head
+		if c, err := g.Commit(head); err == nil {
+			rs.LastActivity = c.Committer().When
+		}
+		if base, err := g.gitBase(rev.Id); err == nil {
+			rs.Ahead, rs.Behind, err = g.AheadBehind(head, base)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	notes, err := g.gitNotes(rev.Id)
+	if err != nil {
+		return nil, err
+	}
+	authors := map[string]bool{}
+	for _, msgs := range notes {
+		rs.Messages += len(msgs)
+		for _, msg := range msgs {
+			if t := messageTime(msg); t.After(rs.LastActivity) {
+				rs.LastActivity = t
+			}
+			if a := msg.Header.Get("Author"); a != "" && !authors[a] {
+				authors[a] = true
+				rs.Authors = append(rs.Authors, a)
+			}
+		}
+	}
+	sort.Strings(rs.Authors)
+	rs.OpenThreads = openThreads(notes)
+	rs.Approval = approval(notes)
+	return rs, nil
+}
+
+// messageTime returns the parsed Date header, or the zero time if it has none.
+func messageTime(msg *Message) time.Time {
+	t, _ := time.Parse(time.RFC3339, msg.Header.Get("Date"))
+	return t
+}
+
+// A Thread is the sequence of messages on the same commit, file and line.
+// It is open unless the latest one has Status: resolved.
+type Thread struct {
+	Commit   string
+	File     string
+	Line     string
+	Messages []*Message // oldest first
+	Resolved bool
+}
+
+// threads groups the messages in notes, except votes on a commit as a whole and retracted
+// messages, ordered by commit, file and line.
+func threads(notes map[string][]*Message) []*Thread {
+	byKey := map[string]*Thread{}
+	var r []*Thread
+	for commit, msgs := range notes {
+		for _, msg := range msgs {
+			if msg.Header.Get("Vote") != "" && msg.Header.Get("File") == "" {
+				continue // votes are not discussions
+			}
+			if msg.Header.Get("Check") != "" {
+				continue // nor are check results
+			}
+			if msg.Header.Get("Retracted") == "true" {
+				continue
+			}
+			key := strings.Join([]string{commit, msg.Header.Get("File"), msg.Header.Get("Line")}, ":")
+			t := byKey[key]
+			if t == nil {
+				t = &Thread{Commit: commit, File: msg.Header.Get("File"), Line: msg.Header.Get("Line")}
+				byKey[key] = t
+				r = append(r, t)
+			}
+			t.Messages = append(t.Messages, msg)
+		}
+	}
+	for _, t := range r {
+		sort.SliceStable(t.Messages, func(i, j int) bool { return messageTime(t.Messages[i]).Before(messageTime(t.Messages[j])) })
+		t.Resolved = t.Messages[len(t.Messages)-1].Header.Get("Status") == "resolved" ||
+			t.Messages[0].Header.Get("Outdated") == "true" // a finding no longer reported
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Commit != r[j].Commit {
+			return r[i].Commit < r[j].Commit
+		}
+		if r[i].File != r[j].File {
+			return r[i].File < r[j].File
+		}
+		li, _ := strconv.Atoi(r[i].Line)
+		lj, _ := strconv.Atoi(r[j].Line)
+		return li < lj
+	})
+	return r
+}
+
+func openThreads(notes map[string][]*Message) int {
+	n := 0
+	for _, t := range threads(notes) {
+		if !t.Resolved {
+			n++
+		}
+	}
+	return n
+}
+
+// votes returns the latest Vote: approve|reject of each Author, ordered by author.
+func votes(notes map[string][]*Message) []*Message {
+	latest := map[string]*Message{}
+	for _, msgs := range notes {
+		for _, msg := range msgs {
+			if msg.Header.Get("Vote") == "" || msg.Header.Get("Retracted") == "true" {
+				continue
+			}
+			if msg.Header.Get("Signature-Status") == sigInvalid {
+				continue // forged
+			}
+			a := msg.Header.Get("Author")
+			if v := latest[a]; v == nil || !messageTime(msg).Before(messageTime(v)) {
+				latest[a] = msg
+			}
+		}
+	}
+	var r []*Message
+	for _, msg := range latest {
+		r = append(r, msg)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Header.Get("Author") < r[j].Header.Get("Author") })
+	return r
+}
+
+// approval returns "rejected" if anyone's latest vote rejects, "approved" if anyone's
+// approves and "" if nobody voted.
+func approval(notes map[string][]*Message) string {
+	r := ""
+	for _, msg := range votes(notes) {
+		switch msg.Header.Get("Vote") {
+		case "reject":
+			return "rejected"
+		case "approve":
+			r = "approved"
+		}
+	}
+	return r
+}
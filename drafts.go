@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+)
+
+// Comments can be saved as drafts first, on <ref>-drafts/<review id>, which isn't under
+// the prefix that is pushed and fetched, so nobody sees them until gitPublishDrafts moves
+// them to the notes of the review, all at once.
+
+func draftsRef(id string) string { return path.Join(*refpfx+"-drafts", id) }
+
+// gitDrafts returns the drafts of review by commit, as gitNotes does, with a Draft header.
+func (g *gitContext) gitDrafts(review string) (map[string][]*Message, error) {
+	id, err := g.gitReviewId(review)
+	if err != nil {
+		return nil, err
+	}
+	drafts, err := g.gitReadNotes(draftsRef(id), id)
+	if err != nil {
+		return nil, err
+	}
+	for _, msgs := range drafts {
+		for _, msg := range msgs {
+			msg.Header.Set("Draft", "true")
+		}
+	}
+	return drafts, nil
+}
+
+// gitFindDraft is gitFindMessage for the drafts of review.
+func (g *gitContext) gitFindDraft(review, commit, id string) (*Message, error) {
+	drafts, err := g.gitDrafts(review)
+	if err != nil {
+		return nil, err
+	}
+	return findMessage(drafts[commit], id), nil
+}
+
+// gitDraftAppend saves msg, by the current user, as a draft on commit id in review.
+// It is signed when it is published.
+func (g *gitContext) gitDraftAppend(review string, id *Oid, msg *Message) error {
+	rid, err := g.gitReviewId(review)
+	if err != nil {
+		return err
+	}
+	sig, err := g.DefaultSignature()
+	if err != nil {
+		return err
+	}
+	msg.Header.Set("Author", fmt.Sprintf("%s <%s>", sig.Name, sig.Email))
+	msg.Header.Set("Date", sig.When.Format(time.RFC3339))
+	return g.gitNoteWriteRef(draftsRef(rid), id, msg, false)
+}
+
+// gitPublishDrafts adds the drafts of review, dated and signed now, and summary, if not nil,
+// on the head of the review, to the notes of the review in one notes commit, and removes
+// the drafts. It returns the number of drafts published.
+func (g *gitContext) gitPublishDrafts(review string, summary *Message) (int, error) {
+	id, err := g.gitReviewId(review)
+	if err != nil {
+		return 0, err
+	}
+	ref := path.Join(*refpfx, id)
+	drafts, err := g.Notes(draftsRef(id))
+	if err != nil && err != errNotFound {
+		return 0, err
+	}
+	sig, err := g.DefaultSignature()
+	if err != nil {
+		return 0, err
+	}
+
+	texts := map[string]string{} // the notes as they will be, by commit
+	add := func(commit *Oid, msg *Message) error {
+		k := commit.String()
+		if _, ok := texts[k]; !ok {
+			note, err := g.Note(ref, commit)
+			if err != nil && err != errNotFound {
+				return err
+			}
+			texts[k] = note
+		}
+		msg.Header.Set("Author", fmt.Sprintf("%s <%s>", sig.Name, sig.Email))
+		msg.Header.Set("Date", sig.When.Format(time.RFC3339))
+		text, err := g.gitEncodeMessage(msg, commit, id, *signMsgs)
+		if err != nil {
+			return err
+		}
+		texts[k] += text
+		return nil
+	}
+
+	n := 0
+	for _, note := range drafts {
+		msgs, err := readMessages(note.Message)
+		if err != nil {
+			return 0, fmt.Errorf("Reading draft on %s: %v", note.Id, err)
+		}
+		for _, msg := range msgs {
+			if err := add(note.Id, msg); err != nil {
+				return 0, err
+			}
+			n++
+		}
+	}
+	if summary != nil {
+		head, err := g.gitHead(review)
+		if err != nil {
+			return 0, err
+		}
+		if err := add(head, summary); err != nil {
+			return 0, err
+		}
+	}
+	if len(texts) == 0 {
+		return 0, &invalidReviewError{id, "it has no drafts to publish"}
+	}
+
+	var notes []*Note
+	for k, text := range texts {
+		oid, _ := NewOid(k)
+		notes = append(notes, &Note{Id: oid, Message: text})
+	}
+	sort.Slice(notes, func(i, j int) bool { return notes[i].Id.String() < notes[j].Id.String() })
+	if err := g.SetNotes(ref, notes, sig); err != nil {
+		return 0, err
+	}
+	if drafts == nil {
+		return 0, nil
+	}
+	return n, g.DeleteRef(draftsRef(id))
+}
+
+// gitDiscardDrafts removes the drafts of review.
+func (g *gitContext) gitDiscardDrafts(review string) error {
+	id, err := g.gitReviewId(review)
+	if err != nil {
+		return err
+	}
+	if err := g.DeleteRef(draftsRef(id)); err != errNotFound {
+		return err
+	}
+	return nil
+}
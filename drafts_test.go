@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestGitDrafts(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+	f.comment("", f.c1, "Alice <alice@example.com>", "published")
+
+	for _, d := range []struct {
+		commit *Oid
+		file   string
+	}{{f.c1, "a"}, {f.c2, "dir/c"}} {
+		msg := &Message{Header: textproto.MIMEHeader{}, Body: "draft on " + d.file}
+		msg.Header.Set("File", d.file)
+		if err := f.gitDraftAppend("", d.commit, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	drafts, err := f.gitDrafts("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs := drafts[f.c1.String()]; len(msgs) != 1 || msgs[0].Header.Get("Draft") != "true" || msgs[0].Body != "draft on a\n" {
+		t.Errorf("gitDrafts: got %v", drafts)
+	}
+	if notes, err := f.gitNotes(""); err != nil || len(notes[f.c1.String()]) != 1 || len(notes[f.c2.String()]) != 0 {
+		t.Errorf("drafts are published already: %v, %v", notes, err)
+	}
+	if notes, err := f.gitNotesForFile("", "", "a"); err != nil || len(notes["FILE"]) != 1 {
+		t.Errorf("gitNotesForFile doesn't show drafts: %v, %v", notes, err)
+	}
+
+	ref, err := f.gitNotesRef("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := f.Log(mustRef(t, f, ref), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := &Message{Header: textproto.MIMEHeader{}, Body: "lgtm"}
+	summary.Header.Set("Vote", "approve")
+	if n, err := f.gitPublishDrafts("", summary); err != nil || n != 2 {
+		t.Fatalf("gitPublishDrafts: got %d, %v", n, err)
+	}
+	if after, err := f.Log(mustRef(t, f, ref), nil); err != nil || len(after) != len(before)+1 {
+		t.Errorf("gitPublishDrafts: got %d notes commits, %v, want one more than %d", len(after), err, len(before))
+	}
+	notes, err := f.gitNotes("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs := notes[f.c1.String()]; len(msgs) != 2 || msgs[1].Body != "draft on a\n" || msgs[1].Header.Get("Draft") != "" {
+		t.Errorf("gitNotes after publishing, on c1: got %v", msgs)
+	}
+	if msgs := notes[f.c2.String()]; len(msgs) != 2 || msgs[1].Header.Get("Vote") != "approve" {
+		t.Errorf("gitNotes after publishing, on the head: got %v", msgs)
+	}
+	if drafts, err := f.gitDrafts(""); err != nil || len(drafts) != 0 {
+		t.Errorf("gitDrafts after publishing: got %v, %v", drafts, err)
+	}
+	if _, err := f.gitPublishDrafts("", nil); err == nil {
+		t.Errorf("gitPublishDrafts without drafts succeeded")
+	}
+
+	msg := &Message{Header: textproto.MIMEHeader{}, Body: "never mind"}
+	if err := f.gitDraftAppend("", f.c2, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.gitDiscardDrafts(""); err != nil {
+		t.Fatal(err)
+	}
+	if drafts, err := f.gitDrafts(""); err != nil || len(drafts) != 0 {
+		t.Errorf("gitDrafts after discarding: got %v, %v", drafts, err)
+	}
+	if err := f.gitDiscardDrafts(""); err != nil {
+		t.Errorf("gitDiscardDrafts without drafts: %v", err)
+	}
+	id, _ := f.gitReviewId("")
+	if ids, err := f.gitReviewIds(); err != nil || len(ids) != 1 || ids[0] != id {
+		t.Errorf("drafts show up as a review: %v, %v", ids, err)
+	}
+	if !strings.HasPrefix(draftsRef(id), path.Dir(ref)+"-") {
+		t.Errorf("draftsRef %s is under the pushed prefix of %s", draftsRef(id), ref)
+	}
+}
+
+func TestServeDrafts(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+	ts, stop := newTestServer(t, nil, f.gitContext)
+	defer stop()
+
+	if status, body := ts.do("GET", "/r/test/commits", nil); status != http.StatusOK || strings.Contains(body, "Publish review") {
+		t.Fatalf("GET /r/test/commits: got %d\n%s", status, body)
+	}
+	form := url.Values{"review": {""}, "text": {"not sure yet"}, "draft": {"true"}}
+	if status, body := ts.do("POST", "/r/test/api/v1/commits/"+f.c2.String()+"/notes", form); status != http.StatusNoContent {
+		t.Fatalf("POST a draft: got %d %q", status, body)
+	}
+	if notes, err := f.gitNotes(""); err != nil || len(notes) != 0 {
+		t.Errorf("the draft is published: %v, %v", notes, err)
+	}
+	drafts, err := f.gitDrafts("")
+	if err != nil || len(drafts[f.c2.String()]) != 1 {
+		t.Fatalf("gitDrafts: got %v, %v", drafts, err)
+	}
+	form = url.Values{"review": {""}, "text": {"not sure yet, edited"}, "draft": {"true"}, "supersedes": {drafts[f.c2.String()][0].Header.Get("Message-Id")}}
+	if status, body := ts.do("POST", "/r/test/api/v1/commits/"+f.c2.String()+"/notes", form); status != http.StatusNoContent {
+		t.Fatalf("POST an edit of a draft: got %d %q", status, body)
+	}
+	if drafts, err := f.gitDrafts(""); err != nil || len(drafts[f.c2.String()]) != 1 || drafts[f.c2.String()][0].Body != "not sure yet, edited\n" {
+		t.Errorf("gitDrafts after an edit: got %v, %v", drafts, err)
+	}
+	if status, body := ts.do("GET", "/r/test/commits", nil); status != http.StatusOK || !strings.Contains(body, "not sure yet") || !strings.Contains(body, "Publish review") {
+		t.Errorf("GET /r/test/commits with a draft: got %d\n%s", status, body)
+	}
+	form = url.Values{"review": {""}, "text": {"done"}, "vote": {"reject"}}
+	if status, body := ts.do("POST", "/r/test/api/v1/drafts/publish", form); status != http.StatusOK || strings.TrimSpace(body) != "2" { // the draft and its edit
+		t.Errorf("POST /r/test/api/v1/drafts/publish: got %d %q", status, body)
+	}
+	if notes, err := f.gitNotes(""); err != nil || len(notes[f.c2.String()]) != 2 {
+		t.Errorf("gitNotes after publishing: got %v, %v", notes, err)
+	}
+	if status, body := ts.do("GET", "/r/test/commits", nil); status != http.StatusOK || strings.Contains(body, "Publish review") {
+		t.Errorf("GET /r/test/commits after publishing: got %d\n%s", status, body)
+	}
+	if status, body := ts.do("POST", "/r/test/api/v1/drafts/publish", url.Values{"review": {""}}); status != http.StatusBadRequest {
+		t.Errorf("POST /r/test/api/v1/drafts/publish without drafts: got %d %q", status, body)
+	}
+	if status, _ := ts.do("POST", "/r/test/api/v1/drafts/discard", url.Values{"review": {""}}); status != http.StatusNoContent {
+		t.Errorf("POST /r/test/api/v1/drafts/discard: got %d", status)
+	}
+}
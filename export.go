@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// A Report is everything there is to know about a review, for keeping it outside of git,
+// eg. with a release audit.  It is built from the same data as the UI pages.
+type Report struct {
+	*ReviewSummary
+	BaseCommit string
+	HeadCommit string
+	Commits    []*ReportCommit
+	Files      []*ReportFile
+	Votes      []*Message // the latest of each author, see approval
+	Outdated   []*Thread  // on commits that are no longer part of the review
+	Generated  time.Time
+}
+
+type ReportCommit struct {
+	Id      string
+	Author  string
+	Date    time.Time
+	Message string
+	Threads []*Thread // on the commit as a whole
+}
+
+// A ReportFile is a file changed between base and head, or one that has comments.
+type ReportFile struct {
+	Path    string
+	Status  string // gitDeltaString, "" if it is not in the diff
+	Patch   string
+	Threads []*Thread
+	head    string // the commit Patch is to, the only one whose line numbers are those in it
+}
+
+// An AnnotatedPatch has the threads of a file after the lines of the patch they are on,
+// see (*ReportFile).Annotated.
+type AnnotatedPatch struct {
+	Lines []*ReportLine
+	Rest  []*Thread // on the file as a whole, or on lines not in the patch
+}
+
+type ReportLine struct {
+	Text    string
+	Threads []*Thread
+}
+
+func (g *gitContext) gitReport(review string) (*Report, error) {
+	rs, err := g.gitReviewSummary(review)
+	if err != nil {
+		return nil, err
+	}
+	base, err := g.gitBase(rs.Id)
+	if err != nil {
+		return nil, err
+	}
+	head, err := g.gitHead(rs.Id)
+	if err != nil {
+		return nil, err
+	}
+	rep := &Report{ReviewSummary: rs, BaseCommit: base.String(), HeadCommit: head.String(), Generated: time.Now()}
+
+	notes, err := g.gitNotes(rs.Id)
+	if err != nil {
+		return nil, err
+	}
+	rep.Votes = votes(notes)
+
+	commits, err := g.gitLog(rs.Id)
+	if err != nil {
+		return nil, err
+	}
+	byCommit := map[string]*ReportCommit{}
+	for _, c := range commits {
+		rc := &ReportCommit{Id: c.Id().String(), Author: c.Author().Name, Date: c.Author().When, Message: c.Message()}
+		rep.Commits = append(rep.Commits, rc)
+		byCommit[rc.Id] = rc
+	}
+
+	opts, err := g.gitCompleteDiffOptions()
+	if err != nil {
+		return nil, err
+	}
+	deltas, err := g.gitDiffs(rs.Id, opts)
+	if err != nil {
+		return nil, err
+	}
+	patches, err := g.gitPatches(base, head, opts)
+	if err != nil {
+		return nil, err
+	}
+	byFile := map[string]*ReportFile{}
+	for i, d := range deltas {
+		f := &ReportFile{Path: d.NewFile.Path, Status: gitDeltaString(d.Status), head: rep.HeadCommit}
+		if i < len(patches) {
+			f.Patch = patches[i]
+		}
+		rep.Files = append(rep.Files, f)
+		byFile[f.Path] = f
+	}
+	for i, d := range deltas {
+		if d.Status == DeltaRenamed && byFile[d.OldFile.Path] == nil {
+			byFile[d.OldFile.Path] = rep.Files[i] // threads on the old path follow the file
+		}
+	}
+
+	for _, t := range threads(notes) {
+		if t.File == "" {
+			if c := byCommit[t.Commit]; c != nil {
+				c.Threads = append(c.Threads, t)
+			} else {
+				rep.Outdated = append(rep.Outdated, t)
+			}
+			continue
+		}
+		f := byFile[t.File]
+		if f == nil {
+			f = &ReportFile{Path: t.File, head: rep.HeadCommit}
+			rep.Files = append(rep.Files, f)
+			byFile[t.File] = f
+		}
+		f.Threads = append(f.Threads, t)
+	}
+	return rep, nil
+}
+
+var hunkRe = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,\d+)? @@`)
+
+// Annotated returns the lines of the patch of f, each with the threads on its line
+// in the new version of the file.  Threads on other commits than the head are on lines
+// of other versions, they stay with the rest.
+func (f *ReportFile) Annotated() *AnnotatedPatch {
+	byLine := map[int][]*Thread{}
+	for _, t := range f.Threads {
+		if t.Commit != f.head {
+			continue
+		}
+		if n, err := strconv.Atoi(t.Line); err == nil {
+			byLine[n] = append(byLine[n], t)
+		}
+	}
+	ap := &AnnotatedPatch{}
+	if f.Patch == "" {
+		ap.Rest = f.Threads
+		return ap
+	}
+	placed := map[*Thread]bool{}
+	ln := 0 // of the next line in the new file, 0 before the first hunk
+	for _, l := range strings.Split(strings.TrimSuffix(f.Patch, "\n"), "\n") {
+		rl := &ReportLine{Text: l}
+		ap.Lines = append(ap.Lines, rl)
+		if m := hunkRe.FindStringSubmatch(l); m != nil {
+			ln, _ = strconv.Atoi(m[1])
+			continue
+		}
+		if ln == 0 || strings.HasPrefix(l, "-") || strings.HasPrefix(l, `\`) {
+			continue
+		}
+		rl.Threads = byLine[ln]
+		for _, t := range rl.Threads {
+			placed[t] = true
+		}
+		ln++
+	}
+	for _, t := range f.Threads {
+		if !placed[t] {
+			ap.Rest = append(ap.Rest, t)
+		}
+	}
+	return ap
+}
+
+var exportFormats = map[string]struct {
+	contentType string
+	write       func(g *gitContext, w io.Writer, rep *Report) error
+}{
+	"md":   {"text/markdown; charset=utf-8", func(g *gitContext, w io.Writer, rep *Report) error { return mdReport.Execute(w, rep) }},
+	"html": {"text/html; charset=utf-8", func(g *gitContext, w io.Writer, rep *Report) error { return htmlReport.Execute(w, rep) }},
+	"json": {"application/json", func(g *gitContext, w io.Writer, rep *Report) error { return writeJSON(w, rep) }},
+
+	// the payloads of the hosted review APIs, as the current user, see forge.go
+	"github": {"application/json", func(g *gitContext, w io.Writer, rep *Report) error {
+		me, err := g.gitAuthor()
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, githubPayload(rep, me))
+	}},
+	"gerrit": {"application/json", func(g *gitContext, w io.Writer, rep *Report) error {
+		me, err := g.gitAuthor()
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, gerritPayload(rep, me))
+	}},
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// writeReport writes the report of review to w in format md, html, json, github or gerrit.
+func (g *gitContext) writeReport(w io.Writer, review, format string) error {
+	f, ok := exportFormats[format]
+	if !ok {
+		return fmt.Errorf("unknown format %q, want md, html, json, github or gerrit", format)
+	}
+	rep, err := g.gitReport(review)
+	if err != nil {
+		return err
+	}
+	return f.write(g, w, rep)
+}
+
+var reportFuncs = map[string]interface{}{
+	"timestamp": tmplFuncs["timestamp"],
+	"join":      tmplFuncs["join"],
+	"markdown":  tmplFuncs["markdown"],
+	"lines":     func(s string) []string { return strings.Split(strings.TrimRight(s, "\n"), "\n") },
+	"status": func(t *Thread) string {
+		if t.Resolved {
+			return "resolved"
+		}
+		return "open"
+	},
+}
+
+var mdReport = template.Must(template.New("md").Funcs(reportFuncs).Parse(`# Review: {{or .Title .Id}}
+
+| | |
+|---|---|
+| Review | {{.Id}} |
+| Range | {{.Base}}..{{.Head}} ({{.BaseCommit}}..{{.HeadCommit}}) |
+| Commits | {{.Ahead}} ahead, {{.Behind}} behind |
+{{- with .Branches}}
+| Branches | {{join ", " .}} |
+{{- end}}
+{{- with .Participants}}
+| Participants | {{join ", " .}} |
+{{- end}}
+| Approval | {{or .Approval "none"}} |
+| Open threads | {{.OpenThreads}} |
+| Generated | {{timestamp .Generated}} |
+{{with .Description}}
+{{.}}
+{{end}}
+## Votes
+{{range .Votes}}
+- {{.Header.Get "Vote"}} by {{.Header.Get "Author"}} on {{.Header.Get "Date"}} ({{.Header.Get "Signature-Status"}})
+{{- else}}
+None.
+{{- end}}
+
+## Commits
+{{range .Commits}}
+### {{.Id}}
+
+{{.Author}}, {{timestamp .Date}}
+
+{{range lines .Message}}    {{.}}
+{{end}}{{range .Threads}}{{template "thread" .}}{{end}}{{end}}
+## Files
+{{range .Files}}{{$ap := .Annotated}}
+### {{with .Status}}{{.}} {{end}}{{.Path}}
+{{with $ap.Lines}}
+~~~diff
+{{range .}}{{.Text}}
+{{if .Threads}}~~~
+{{range .Threads}}{{template "thread" .}}{{end}}
+~~~diff
+{{end}}{{end}}~~~
+{{end}}{{range $ap.Rest}}{{template "thread" .}}{{end}}{{end}}
+{{- with .Outdated}}
+## Comments on commits no longer in the review
+{{range .}}{{template "thread" .}}{{end}}{{end}}
+{{- define "thread"}}
+> **{{status .}}**{{with .File}} {{.}}{{end}}{{with .Line}}:{{.}}{{end}} on {{.Commit}}
+{{range .Messages}}>
+> **{{.Header.Get "Author"}}**, {{.Header.Get "Date"}}{{with .Header.Get "Vote"}}, votes {{.}}{{end}}{{with .Header.Get "Edited"}}, edited {{.}}{{end}} ({{.Header.Get "Signature-Status"}}):
+{{range lines .Body}}> {{.}}
+{{end}}{{end}}
+{{end}}`))
+
+var htmlReport = htmltemplate.Must(htmltemplate.New("html").Funcs(reportFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Review: {{or .Title .Id}}</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: auto; }
+table.scope td { padding: 0 1em 0 0; }
+pre.diff { background: #f6f8fa; padding: .5em; overflow-x: auto; }
+pre.diff .add { background: #e6ffed; }
+pre.diff .del { background: #ffeef0; }
+.thread { border-left: 3px solid #f0ad4e; margin: .5em 0; padding: 0 1em; font-family: sans-serif; white-space: normal; }
+.thread.resolved { border-color: #5cb85c; }
+.message .meta { color: #666; font-size: small; }
+</style>
+</head>
+<body>
+<h1>Review: {{or .Title .Id}}</h1>
+<table class="scope">
+<tr><td>Review</td><td>{{.Id}}</td></tr>
+<tr><td>Range</td><td>{{.Base}}..{{.Head}} ({{.BaseCommit}}..{{.HeadCommit}})</td></tr>
+<tr><td>Commits</td><td>{{.Ahead}} ahead, {{.Behind}} behind</td></tr>
+{{with .Branches}}<tr><td>Branches</td><td>{{join ", " .}}</td></tr>{{end}}
+{{with .Participants}}<tr><td>Participants</td><td>{{join ", " .}}</td></tr>{{end}}
+<tr><td>Approval</td><td>{{or .Approval "none"}}</td></tr>
+<tr><td>Open threads</td><td>{{.OpenThreads}}</td></tr>
+<tr><td>Generated</td><td>{{timestamp .Generated}}</td></tr>
+</table>
+{{with .Description}}<div class="description">{{markdown "" .}}</div>{{end}}
+
+<h2>Votes</h2>
+<ul>
+{{range .Votes}}<li>{{.Header.Get "Vote"}} by {{.Header.Get "Author"}} on {{.Header.Get "Date"}} ({{.Header.Get "Signature-Status"}})</li>
+{{else}}<li>None.</li>{{end}}
+</ul>
+
+<h2>Commits</h2>
+{{range .Commits}}
+<h3 id="{{.Id}}">{{.Id}}</h3>
+<p>{{.Author}}, {{timestamp .Date}}</p>
+<pre>{{.Message}}</pre>
+{{range .Threads}}{{template "thread" .}}{{end}}
+{{end}}
+
+<h2>Files</h2>
+{{range .Files}}{{$ap := .Annotated}}
+<h3>{{with .Status}}{{.}} {{end}}{{.Path}}</h3>
+{{with $ap.Lines}}<pre class="diff">{{range .}}<span{{if eq (printf "%.1s" .Text) "+"}} class="add"{{else if eq (printf "%.1s" .Text) "-"}} class="del"{{end}}>{{.Text}}</span>
+{{range .Threads}}{{template "thread" .}}{{end}}{{end}}</pre>{{end}}
+{{range $ap.Rest}}{{template "thread" .}}{{end}}
+{{end}}
+
+{{with .Outdated}}
+<h2>Comments on commits no longer in the review</h2>
+{{range .}}{{template "thread" .}}{{end}}
+{{end}}
+</body>
+</html>
+{{define "thread"}}<div class="thread {{status .}}">
+<p><b>{{status .}}</b>{{with .File}} {{.}}{{end}}{{with .Line}}:{{.}}{{end}} on {{.Commit}}</p>
+{{range .Messages}}<div class="message">
+<p class="meta">{{.Header.Get "Author"}}, {{.Header.Get "Date"}}{{with .Header.Get "Vote"}}, votes {{.}}{{end}}{{with .Header.Get "Edited"}}, edited {{.}}{{end}} ({{.Header.Get "Signature-Status"}})</p>
+{{markdown "" .Body}}
+</div>{{end}}
+</div>{{end}}
+`))
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPatch = `diff --git a/a.go b/a.go
+--- a/a.go
++++ b/a.go
+@@ -1,3 +1,4 @@
+ package main
+-var x = 1
++var x = 2
++var y = 3
+ func main() {}
+`
+
+func testThread(file, line, body string, resolved bool) *Thread {
+	msg := &Message{Header: textproto.MIMEHeader{"Author": {"A U Thor <author@example.com>"}, "Date": {"2016-05-04T12:00:00Z"}}, Body: body}
+	return &Thread{Commit: "c0ffee", File: file, Line: line, Messages: []*Message{msg}, Resolved: resolved}
+}
+
+func TestAnnotated(t *testing.T) {
+	on3 := testThread("a.go", "3", "why 3?", false)
+	on9 := testThread("a.go", "9", "not in the patch", false)
+	whole := testThread("a.go", "", "about the file", true)
+	earlier := testThread("a.go", "3", "on an earlier version", false)
+	earlier.Commit = "decade"
+	f := &ReportFile{Path: "a.go", Patch: testPatch, Threads: []*Thread{on3, on9, whole, earlier}, head: "c0ffee"}
+
+	ap := f.Annotated()
+	var after string
+	for _, l := range ap.Lines {
+		for _, th := range l.Threads {
+			if th == on3 {
+				after = l.Text
+			}
+		}
+	}
+	if after != "+var y = 3" {
+		t.Errorf("thread on line 3 is after %q, expected it after %q", after, "+var y = 3")
+	}
+	if len(ap.Rest) != 3 || ap.Rest[0] != on9 || ap.Rest[1] != whole || ap.Rest[2] != earlier {
+		t.Errorf("got %d other threads, expected the ones on line 9, the whole file and an earlier commit", len(ap.Rest))
+	}
+}
+
+func TestReportFormats(t *testing.T) {
+	rep := &Report{
+		ReviewSummary: &ReviewSummary{Review: &Review{Id: "r1", Title: "Frobnicate", Base: "master", Head: "feature"}, OpenThreads: 1},
+		BaseCommit:    "b0b0",
+		HeadCommit:    "c0ffee",
+		Commits:       []*ReportCommit{{Id: "c0ffee", Author: "A U Thor", Date: time.Unix(0, 0), Message: "Frobnicate\n\nbecause.\n", Threads: []*Thread{testThread("", "", "nice commit", false)}}},
+		Files:         []*ReportFile{{Path: "a.go", Status: "Modified", Patch: testPatch, Threads: []*Thread{testThread("a.go", "3", "why *3*? see a.go:1", true)}, head: "c0ffee"}},
+		Generated:     time.Unix(0, 0),
+	}
+	for format, want := range map[string][]string{
+		"md":   {"# Review: Frobnicate", "nice commit", "+var y = 3\n~~~\n", "> **resolved** a.go:3", "> why *3*?"},
+		"html": {"<h1>Review: Frobnicate</h1>", "nice commit", `<div class="thread resolved">`, "why <em>3</em>? see a.go:1<"},
+		"json": {`"Title": "Frobnicate"`, `"Resolved": true`, `"Body": "nice commit"`},
+	} {
+		var buf bytes.Buffer
+		if err := exportFormats[format].write(nil, &buf, rep); err != nil {
+			t.Errorf("%s: %v", format, err)
+			continue
+		}
+		for _, w := range want {
+			if !strings.Contains(buf.String(), w) {
+				t.Errorf("%s report doesn't contain %q:\n%s", format, w, buf.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A finding is something a linter or other analysis tool reports on a line.
+// They become messages by a Bot: <tool> on the head of the review, with the
+// Rule: that was violated and a Fingerprint: to recognize them in later runs.
+type finding struct {
+	tool  string
+	rule  string
+	level string // error, warning or note, or "" if the tool doesn't say
+	file  string
+	line  int
+	text  string
+}
+
+type sarifLog struct {
+	Runs []struct {
+		Tool struct {
+			Driver struct {
+				Name string `json:"name"`
+			} `json:"driver"`
+		} `json:"tool"`
+		Results []struct {
+			RuleId  string `json:"ruleId"`
+			Level   string `json:"level"`
+			Message struct {
+				Text string `json:"text"`
+			} `json:"message"`
+			Locations []struct {
+				PhysicalLocation struct {
+					ArtifactLocation struct {
+						URI string `json:"uri"`
+					} `json:"artifactLocation"`
+					Region struct {
+						StartLine int `json:"startLine"`
+					} `json:"region"`
+				} `json:"physicalLocation"`
+			} `json:"locations"`
+		} `json:"results"`
+	} `json:"runs"`
+}
+
+// relPath turns the file names tools report into paths relative to the root of the
+// repository in workdir.
+func relPath(workdir, p string) string {
+	if u, err := url.Parse(p); err == nil && u.Scheme == "file" {
+		p = u.Path
+	}
+	if workdir != "" && strings.HasPrefix(p, workdir) {
+		p = p[len(workdir):]
+	}
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// parseSARIF reads the results in a SARIF 2.1 log.  Results without a line are left out.
+func parseSARIF(data []byte, workdir string) ([]*finding, error) {
+	var sl sarifLog
+	if err := json.Unmarshal(data, &sl); err != nil {
+		return nil, err
+	}
+	var r []*finding
+	for _, run := range sl.Runs {
+		for _, res := range run.Results {
+			for _, loc := range res.Locations {
+				pl := loc.PhysicalLocation
+				if pl.Region.StartLine == 0 {
+					continue
+				}
+				r = append(r, &finding{
+					tool:  run.Tool.Driver.Name,
+					rule:  res.RuleId,
+					level: res.Level,
+					file:  relPath(workdir, pl.ArtifactLocation.URI),
+					line:  pl.Region.StartLine,
+					text:  res.Message.Text,
+				})
+				break // the first location is where the result is
+			}
+		}
+	}
+	return r, nil
+}
+
+var (
+	findingLineRe = regexp.MustCompile(`^([^\s:][^:]*):(\d+)(?::\d+)?:\s*(.*)$`)
+	findingRuleRe = regexp.MustCompile(`^(.*?)\s+\(([\w-]+)\)$`)
+)
+
+// parseFindings reads findings in the file:line[:column]: text format of go vet, staticcheck
+// and most compilers.  A trailing (name), like golangci-lint's, is taken as the rule.
+func parseFindings(r io.Reader, tool, workdir string) ([]*finding, error) {
+	var fs []*finding
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		m := findingLineRe.FindStringSubmatch(s.Text())
+		if m == nil {
+			continue
+		}
+		line, _ := strconv.Atoi(m[2])
+		f := &finding{tool: tool, file: relPath(workdir, m[1]), line: line, text: m[3]}
+		if rm := findingRuleRe.FindStringSubmatch(f.text); rm != nil {
+			f.text, f.rule = rm[1], rm[2]
+		}
+		fs = append(fs, f)
+	}
+	return fs, s.Err()
+}
+
+// fingerprint identifies a finding across runs: by what it says about which code, but not
+// by the line number, which changes when code above it does.
+func (f *finding) fingerprint(code string) string {
+	h := sha1.New()
+	for _, v := range []string{f.tool, f.rule, f.file, f.text, strings.TrimSpace(code)} {
+		io.WriteString(h, v)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:12])
+}
+
+func (f *finding) message(fp string, date time.Time) *Message {
+	msg := &Message{Header: textproto.MIMEHeader{}, Body: f.text}
+	if f.level != "" {
+		msg.Body = f.level + ": " + f.text
+	}
+	msg.Header.Set("Author", fmt.Sprintf("%s <bot@scrutinize>", f.tool))
+	msg.Header.Set("Date", date.UTC().Format(time.RFC3339))
+	msg.Header.Set("Bot", f.tool)
+	if f.rule != "" {
+		msg.Header.Set("Rule", f.rule)
+	}
+	msg.Header.Set("Fingerprint", fp)
+	msg.Header.Set("File", f.file)
+	msg.Header.Set("Line", strconv.Itoa(f.line))
+	return msg
+}
+
+// gitImportFindings adds the findings on files changed in review to its head, skipping the ones
+// that are there already, and marks the earlier findings of the same tools that are no longer
+// reported as Outdated.
+func (g *gitContext) gitImportFindings(review string, fs []*finding, log io.Writer) (added, outdated int, err error) {
+	opts, err := g.gitCompleteDiffOptions()
+	if err != nil {
+		return 0, 0, err
+	}
+	deltas, err := g.gitDiffs(review, opts)
+	if err != nil {
+		return 0, 0, err
+	}
+	touched := map[string]bool{}
+	for _, d := range deltas {
+		touched[d.NewFile.Path] = true
+	}
+	head, err := g.gitHead(review)
+	if err != nil {
+		return 0, 0, err
+	}
+	notes, err := g.gitNotes(review)
+	if err != nil {
+		return 0, 0, err
+	}
+	existing := map[string]*Message{}
+	for _, msgs := range notes {
+		for _, msg := range msgs {
+			if msg.Header.Get("Bot") != "" && msg.Header.Get("Outdated") != "true" {
+				existing[msg.Header.Get("Fingerprint")] = msg
+			}
+		}
+	}
+
+	files := map[string][]string{}
+	code := func(file string, line int) (string, error) {
+		lines, ok := files[file]
+		if !ok {
+			id, err := g.gitBlobId(review, file)
+			if err != nil {
+				return "", err
+			}
+			blob, err := g.Blob(id)
+			if err != nil {
+				return "", err
+			}
+			lines = strings.Split(string(blob), "\n")
+			files[file] = lines
+		}
+		if line < 1 || line > len(lines) {
+			return "", fmt.Errorf("%s has no line %d", file, line)
+		}
+		return lines[line-1], nil
+	}
+
+	now := time.Now()
+	tools := map[string]bool{}
+	seen := map[string]bool{}
+	for _, f := range fs {
+		tools[f.tool] = true
+		if !touched[f.file] {
+			continue
+		}
+		c, err := code(f.file, f.line)
+		if err != nil {
+			fmt.Fprintf(log, "skipping %s:%d: %v\n", f.file, f.line, err)
+			continue
+		}
+		fp := f.fingerprint(c)
+		if seen[fp] {
+			continue
+		}
+		seen[fp] = true
+		if existing[fp] != nil {
+			continue
+		}
+		if err := g.gitNoteWrite(review, head, f.message(fp, now), false); err != nil {
+			return added, outdated, err
+		}
+		added++
+	}
+
+	for fp, msg := range existing {
+		if !tools[msg.Header.Get("Bot")] || seen[fp] {
+			continue
+		}
+		id, err := NewOid(msg.Header.Get("Commit"))
+		if err != nil {
+			return added, outdated, err
+		}
+		edit := &Message{Header: textproto.MIMEHeader{}, Body: msg.Body}
+		edit.Header.Set("Author", msg.Header.Get("Author"))
+		edit.Header.Set("Date", now.UTC().Format(time.RFC3339))
+		edit.Header.Set("Bot", msg.Header.Get("Bot"))
+		edit.Header.Set("Supersedes", msg.Header.Get("Message-Id"))
+		edit.Header.Set("Outdated", "true")
+		if err := g.gitNoteWrite(review, id, edit, false); err != nil {
+			return added, outdated, err
+		}
+		outdated++
+	}
+	return added, outdated, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSARIF(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/findings.sarif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := parseSARIF(data, "/src/project/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 2 {
+		t.Fatalf("got %d findings, expected 2, without the one that has no line", len(fs))
+	}
+	if f := fs[0]; f.tool != "staticcheck" || f.rule != "SA4006" || f.file != "cmd/main.go" || f.line != 12 || f.level != "error" {
+		t.Errorf("got %+v", f)
+	}
+	if f := fs[1]; f.file != "util.go" || f.line != 3 {
+		t.Errorf("got %+v", f)
+	}
+}
+
+func TestParseFindings(t *testing.T) {
+	out := `# example.com/project/cmd
+./cmd/main.go:12:2: result of fmt.Sprintf call not used
+/src/project/util.go:3: should omit comparison to bool constant (gosimple)
+vet: exit status 1
+`
+	fs, err := parseFindings(strings.NewReader(out), "vet", "/src/project/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 2 {
+		t.Fatalf("got %d findings, expected 2", len(fs))
+	}
+	if f := fs[0]; f.tool != "vet" || f.rule != "" || f.file != "cmd/main.go" || f.line != 12 || f.text != "result of fmt.Sprintf call not used" {
+		t.Errorf("got %+v", f)
+	}
+	if f := fs[1]; f.rule != "gosimple" || f.file != "util.go" || f.text != "should omit comparison to bool constant" {
+		t.Errorf("got %+v", f)
+	}
+}
+
+func TestFindingFingerprint(t *testing.T) {
+	f := &finding{tool: "vet", file: "x.go", line: 3, text: "unreachable code"}
+	moved := *f
+	moved.line = 7
+	if f.fingerprint("\treturn") != moved.fingerprint("return ") {
+		t.Error("fingerprint changes with the line number or indentation")
+	}
+	if f.fingerprint("return") == f.fingerprint("return nil") {
+		t.Error("fingerprint doesn't change with the code")
+	}
+
+	msg := f.message(f.fingerprint("return"), time.Now())
+	msg.Header.Set("Message-Id", "0123456789abcdef")
+	msg.Header.Set("Scrutinize-Version", messageVersion)
+	if err := msg.Validate(); err != nil {
+		t.Error(err)
+	}
+}
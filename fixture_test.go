@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A fixture is a throwaway repository, named test, that tests script branches, commits
+// and notes into. HEAD is on master, which is also the baseline.
+type fixture struct {
+	t *testing.T
+	*gitContext
+	when  time.Time
+	files map[string]map[string]string // the files on each branch, by path
+}
+
+func newFixture(t *testing.T) (*fixture, func()) {
+	r, done := testRepo(t)
+	oldBaseline, oldSign := *baseline, *signMsgs
+	*baseline, *signMsgs = "refs/heads/master", false
+	f := &fixture{t: t, gitContext: &gitContext{Repo: r, Name: "test"}, when: testSig.When, files: map[string]map[string]string{}}
+	f.checkout("master")
+	return f, func() {
+		*baseline, *signMsgs = oldBaseline, oldSign
+		done()
+	}
+}
+
+// tick returns a time a minute later than the last one, so that commits and messages are ordered.
+func (f *fixture) tick() time.Time {
+	f.when = f.when.Add(time.Minute)
+	return f.when
+}
+
+// checkout points HEAD at branch, which need not exist yet. Only HEAD changes, there is no worktree.
+func (f *fixture) checkout(branch string) {
+	if err := ioutil.WriteFile(filepath.Join(f.Repo.Path(), "HEAD"), []byte("ref: refs/heads/"+branch+"\n"), 0666); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// branch creates branch at the tip of from.
+func (f *fixture) branch(branch, from string) *Oid {
+	id, err := f.Repo.Ref("refs/heads/" + from)
+	if err != nil {
+		f.t.Fatalf("branch %s from %s: %v", branch, from, err)
+	}
+	// the Repo interface only moves refs with commits, write a loose ref like git update-ref would
+	fname := filepath.Join(f.Repo.Path(), "refs", "heads", filepath.FromSlash(branch))
+	if err := os.MkdirAll(filepath.Dir(fname), 0777); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fname, []byte(id.String()+"\n"), 0666); err != nil {
+		f.t.Fatal(err)
+	}
+	f.files[branch] = map[string]string{}
+	for k, v := range f.files[from] {
+		f.files[branch][k] = v
+	}
+	return id
+}
+
+// commit commits the files, contents by slash separated path, on top of branch, which is
+// created if it doesn't exist. The other files on the branch stay as they are, "" removes one.
+func (f *fixture) commit(branch, msg string, files map[string]string) *Oid {
+	if f.files[branch] == nil {
+		f.files[branch] = map[string]string{}
+	}
+	for k, v := range files {
+		if v == "" {
+			delete(f.files[branch], k)
+		} else {
+			f.files[branch][k] = v
+		}
+	}
+	var parents []*Oid
+	if id, err := f.Repo.Ref("refs/heads/" + branch); err == nil {
+		parents = append(parents, id)
+	}
+	sig := *testSig
+	sig.When = f.tick()
+	id, err := f.Repo.CreateCommit("refs/heads/"+branch, &sig, msg+"\n", testTree(f.t, f.Repo, f.files[branch]), parents...)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return id
+}
+
+// comment writes a message by author on commit in review, with the headers in kv as key, value pairs.
+func (f *fixture) comment(review string, commit *Oid, author, text string, kv ...string) *Message {
+	msg := &Message{Header: textproto.MIMEHeader{}, Body: text}
+	msg.Header.Set("Author", author)
+	msg.Header.Set("Date", f.tick().Format(time.RFC3339))
+	for i := 0; i+1 < len(kv); i += 2 {
+		msg.Header.Add(kv[i], kv[i+1])
+	}
+	if err := f.gitNoteWrite(review, commit, msg, false); err != nil {
+		f.t.Fatal(err)
+	}
+	return msg
+}
+
+// A typical review: master has a and b, topic changes a, removes b and adds dir/c.
+type topicFixture struct {
+	*fixture
+	base, c1, c2 *Oid
+}
+
+func newTopicFixture(t *testing.T) (*topicFixture, func()) {
+	f, done := newFixture(t)
+	tf := &topicFixture{fixture: f}
+	tf.base = f.commit("master", "Initial", map[string]string{"a": "one\ntwo\nthree\n", "b": "bee\n"})
+	f.branch("topic", "master")
+	tf.c1 = f.commit("topic", "Change a", map[string]string{"a": "one\n2\nthree\n"})
+	tf.c2 = f.commit("topic", "Replace b with dir/c", map[string]string{"b": "", "dir/c": strings.Repeat("sea\n", 3)})
+	f.checkout("topic")
+	return tf, done
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A forgeComment is a review comment as exported from the API of a hosted forge.
+type forgeComment struct {
+	origin   string // forge:id, unique per forge
+	replyTo  string // origin of the comment this replies to
+	author   string // Name <email>
+	date     time.Time
+	commit   string // "" for comments on the pull request as a whole
+	file     string
+	line     int
+	body     string
+	resolved bool   // the thread is resolved after this comment
+	vote     string // approve or reject, if the comment is one
+}
+
+// A forgeMessage is a forgeComment turned into a Message on a commit.
+type forgeMessage struct {
+	commit string // "" for the head of the review
+	msg    *Message
+}
+
+// readAuthors reads a git-svn style authors file: lines of login = Name <email>.
+func readAuthors(r io.Reader) (map[string]string, error) {
+	authors := map[string]string{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		i := strings.Index(l, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("authors: %q is not login = Name <email>", l)
+		}
+		authors[strings.TrimSpace(l[:i])] = strings.TrimSpace(l[i+1:])
+	}
+	return authors, s.Err()
+}
+
+type githubComment struct {
+	Id               int64  `json:"id"`
+	InReplyTo        int64  `json:"in_reply_to_id"`
+	Path             string `json:"path"`
+	Line             int    `json:"line"`
+	OriginalLine     int    `json:"original_line"`
+	CommitId         string `json:"commit_id"`
+	OriginalCommitId string `json:"original_commit_id"`
+	Body             string `json:"body"`
+	CreatedAt        string `json:"created_at"`
+	User             struct {
+		Login string `json:"login"`
+	} `json:"user"`
+}
+
+// parseGitHub reads the pull request review comments as returned by
+// GET /repos/{owner}/{repo}/pulls/{number}/comments.
+// Comments that are outdated by later pushes are put on the commit and line they were made on.
+func parseGitHub(data []byte, authors map[string]string) ([]*forgeComment, error) {
+	var gcs []githubComment
+	if err := json.Unmarshal(data, &gcs); err != nil {
+		return nil, err
+	}
+	var r []*forgeComment
+	for _, gc := range gcs {
+		date, err := time.Parse(time.RFC3339, gc.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("comment %d: %v", gc.Id, err)
+		}
+		c := &forgeComment{
+			origin: fmt.Sprintf("github:%d", gc.Id),
+			author: authors[gc.User.Login],
+			date:   date,
+			commit: gc.CommitId,
+			file:   gc.Path,
+			line:   gc.Line,
+			body:   gc.Body,
+		}
+		if c.author == "" {
+			c.author = fmt.Sprintf("%s <%s@users.noreply.github.com>", gc.User.Login, gc.User.Login)
+		}
+		if gc.Line == 0 && gc.OriginalLine != 0 {
+			c.commit, c.line = gc.OriginalCommitId, gc.OriginalLine
+		}
+		if gc.InReplyTo != 0 {
+			c.replyTo = fmt.Sprintf("github:%d", gc.InReplyTo)
+		}
+		r = append(r, c)
+	}
+	return r, nil
+}
+
+type gitlabDiscussion struct {
+	Id    string `json:"id"`
+	Notes []struct {
+		Id        int64  `json:"id"`
+		Body      string `json:"body"`
+		System    bool   `json:"system"`
+		CreatedAt string `json:"created_at"`
+		Resolved  bool   `json:"resolved"`
+		Author    struct {
+			Username string `json:"username"`
+			Name     string `json:"name"`
+		} `json:"author"`
+		Position *struct {
+			HeadSha string `json:"head_sha"`
+			NewPath string `json:"new_path"`
+			OldPath string `json:"old_path"`
+			NewLine int    `json:"new_line"`
+			OldLine int    `json:"old_line"`
+		} `json:"position"`
+	} `json:"notes"`
+}
+
+// parseGitLab reads the merge request discussions as returned by
+// GET /projects/{id}/merge_requests/{iid}/discussions.
+// System notes, like "added 1 commit", are left out.
+func parseGitLab(data []byte, authors map[string]string) ([]*forgeComment, error) {
+	var gds []gitlabDiscussion
+	if err := json.Unmarshal(data, &gds); err != nil {
+		return nil, err
+	}
+	var r []*forgeComment
+	for _, gd := range gds {
+		var first *forgeComment
+		for _, n := range gd.Notes {
+			if n.System {
+				continue
+			}
+			date, err := time.Parse(time.RFC3339, n.CreatedAt)
+			if err != nil {
+				return nil, fmt.Errorf("note %d: %v", n.Id, err)
+			}
+			c := &forgeComment{
+				origin:   fmt.Sprintf("gitlab:%d", n.Id),
+				author:   authors[n.Author.Username],
+				date:     date,
+				body:     n.Body,
+				resolved: n.Resolved,
+			}
+			if c.author == "" {
+				c.author = fmt.Sprintf("%s <%s@users.noreply.gitlab.com>", n.Author.Name, n.Author.Username)
+			}
+			if p := n.Position; p != nil {
+				c.commit, c.file, c.line = p.HeadSha, p.NewPath, p.NewLine
+				if p.NewLine == 0 {
+					c.file, c.line = p.OldPath, p.OldLine
+				}
+			}
+			if first == nil {
+				first = c
+			} else {
+				c.replyTo = first.origin
+			}
+			r = append(r, c)
+		}
+	}
+	return r, nil
+}
+
+// parseForge reads comments in format github or gitlab, or, if format is "",
+// whichever of the two data looks like.
+func parseForge(data []byte, format string, authors map[string]string) ([]*forgeComment, error) {
+	if format == "" {
+		var probe []map[string]json.RawMessage
+		if err := json.Unmarshal(data, &probe); err != nil {
+			return nil, err
+		}
+		format = "github"
+		if len(probe) > 0 && probe[0]["notes"] != nil {
+			format = "gitlab"
+		}
+	}
+	switch format {
+	case "github":
+		return parseGitHub(data, authors)
+	case "gitlab":
+		return parseGitLab(data, authors)
+	}
+	return nil, fmt.Errorf("unknown format %q, want github or gitlab", format)
+}
+
+// forgeMessageId is the Message-Id of the message imported from origin,
+// the same every time so that importing again doesn't duplicate anything.
+func forgeMessageId(origin string) string {
+	h := sha1.Sum([]byte(origin))
+	return hex.EncodeToString(h[:12])
+}
+
+// forgeMessages turns comments into messages, oldest first.  Replies are put on the
+// commit, file and line of the comment that started the thread, so they stay in it.
+func forgeMessages(comments []*forgeComment) []*forgeMessage {
+	byOrigin := map[string]*forgeComment{}
+	for _, c := range comments {
+		byOrigin[c.origin] = c
+	}
+	root := func(c *forgeComment) *forgeComment {
+		for seen := 0; c.replyTo != "" && byOrigin[c.replyTo] != nil && seen < len(comments); seen++ {
+			c = byOrigin[c.replyTo]
+		}
+		return c
+	}
+
+	sorted := append([]*forgeComment(nil), comments...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].date.Before(sorted[j].date) })
+
+	// the resolution of a thread goes on its last message
+	last := map[*forgeComment]*forgeComment{}
+	for _, c := range sorted {
+		last[root(c)] = c
+	}
+
+	var r []*forgeMessage
+	for _, c := range sorted {
+		rc := root(c)
+		msg := &Message{Header: textproto.MIMEHeader{}, Body: c.body}
+		msg.Header.Set("Author", c.author)
+		msg.Header.Set("Date", c.date.UTC().Format(time.RFC3339))
+		msg.Header.Set("Origin", c.origin)
+		msg.Header.Set("Message-Id", forgeMessageId(c.origin))
+		if rc.file != "" {
+			msg.Header.Set("File", strings.TrimPrefix(rc.file, "/"))
+		}
+		if rc.line > 0 {
+			msg.Header.Set("Line", strconv.Itoa(rc.line))
+		}
+		if c.vote != "" {
+			msg.Header.Set("Vote", c.vote)
+		}
+		if last[rc] == c && c.resolved {
+			msg.Header.Set("Status", "resolved")
+		}
+		r = append(r, &forgeMessage{commit: rc.commit, msg: msg})
+	}
+	return r
+}
+
+// gitImport writes the messages that aren't there yet into review, in one notes commit,
+// and reports the ones it skips on log.
+func (g *gitContext) gitImport(review string, fms []*forgeMessage, log io.Writer) (added int, err error) {
+	rid, err := g.gitReviewId(review)
+	if err != nil {
+		return 0, err
+	}
+	ref := path.Join(*refpfx, rid)
+	notes, err := g.gitNotes(rid)
+	if err != nil {
+		return 0, err
+	}
+	have := map[string]bool{}
+	for _, msgs := range notes {
+		for _, msg := range msgs {
+			have[msg.Header.Get("Message-Id")] = true
+			for _, h := range msg.History {
+				have[h.Header.Get("Message-Id")] = true
+			}
+		}
+	}
+	head, err := g.gitHead(rid)
+	if err != nil {
+		return 0, err
+	}
+
+	texts := map[string]string{} // the notes as they will be, by commit
+	for _, fm := range fms {
+		origin := fm.msg.Header.Get("Origin")
+		if have[fm.msg.Header.Get("Message-Id")] {
+			continue
+		}
+		id := head
+		if fm.commit != "" {
+			if id, err = NewOid(fm.commit); err != nil {
+				fmt.Fprintf(log, "skipping %s: %v\n", origin, err)
+				continue
+			}
+			if _, err := g.Commit(id); err != nil {
+				fmt.Fprintf(log, "skipping %s: commit %s is not in the repository\n", origin, fm.commit)
+				continue
+			}
+		}
+		k := id.String()
+		if _, ok := texts[k]; !ok {
+			note, err := g.Note(ref, id)
+			if err != nil && err != errNotFound {
+				return 0, err
+			}
+			texts[k] = note
+		}
+		text, err := g.gitEncodeMessage(fm.msg, id, rid, false)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", origin, err)
+		}
+		texts[k] += text
+		have[fm.msg.Header.Get("Message-Id")] = true
+		added++
+	}
+	if added == 0 {
+		return 0, nil
+	}
+
+	sig, err := g.DefaultSignature()
+	if err != nil {
+		return 0, err
+	}
+	var ns []*Note
+	for k, text := range texts {
+		oid, _ := NewOid(k)
+		ns = append(ns, &Note{Id: oid, Message: text})
+	}
+	sort.Slice(ns, func(i, j int) bool { return ns[i].Id.String() < ns[j].Id.String() })
+	if err := g.SetNotes(ref, ns, sig); err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+// The payload of GitHub's POST /repos/{owner}/{repo}/pulls/{number}/reviews.
+type githubReview struct {
+	CommitId string                `json:"commit_id"`
+	Body     string                `json:"body,omitempty"`
+	Event    string                `json:"event"` // APPROVE, REQUEST_CHANGES or COMMENT
+	Comments []githubReviewComment `json:"comments,omitempty"`
+}
+
+type githubReviewComment struct {
+	Path string `json:"path"`
+	Line int    `json:"line"`
+	Side string `json:"side"`
+	Body string `json:"body"`
+}
+
+// Gerrit's ReviewInput, for POST /changes/{change-id}/revisions/{revision-id}/review.
+type gerritReview struct {
+	Message  string                          `json:"message,omitempty"`
+	Tag      string                          `json:"tag"`
+	Labels   map[string]int                  `json:"labels,omitempty"`
+	Comments map[string][]gerritCommentInput `json:"comments,omitempty"`
+}
+
+type gerritCommentInput struct {
+	Line       int    `json:"line,omitempty"`
+	Side       string `json:"side,omitempty"`
+	Message    string `json:"message"`
+	Unresolved bool   `json:"unresolved"`
+}
+
+// Gerrit's name for comments on the patch set as a whole.
+const gerritPatchsetLevel = "/PATCHSET_LEVEL"
+
+// threadBody renders the messages of t as one comment, naming the authors other than me.
+// Hosted review can only reply to comments that are already there, so a thread is exported
+// as a single comment.
+func threadBody(t *Thread, me string) string {
+	var parts []string
+	for _, msg := range t.Messages {
+		body := strings.TrimRight(msg.Body, "\n")
+		if a := msg.Header.Get("Author"); a != me {
+			body = fmt.Sprintf("%s wrote on %s:\n\n%s", a, msg.Header.Get("Date"), body)
+		}
+		parts = append(parts, body)
+	}
+	return strings.Join(parts, "\n\n---\n\n")
+}
+
+// myVote returns the latest vote of me in rep, or "".
+func myVote(rep *Report, me string) string {
+	for _, v := range rep.Votes {
+		if v.Header.Get("Author") == me {
+			return v.Header.Get("Vote")
+		}
+	}
+	return ""
+}
+
+// reportThreads calls f with the threads of rep on the commits, those on files and those
+// on commits no longer in the review.  Line is 0 for threads not on a line of the diff of
+// the head, see (*ReportFile).Annotated: hosted review only takes comments on those, and
+// refuses the whole review for one that isn't.  inDiff is whether path is in that diff.
+func reportThreads(rep *Report, f func(path string, line int, inDiff bool, t *Thread)) {
+	for _, c := range rep.Commits {
+		for _, t := range c.Threads {
+			f("", 0, false, t)
+		}
+	}
+	for _, t := range rep.Outdated {
+		f("", 0, false, t)
+	}
+	for _, rf := range rep.Files {
+		ap := rf.Annotated()
+		for _, l := range ap.Lines {
+			for _, t := range l.Threads {
+				line, _ := strconv.Atoi(t.Line)
+				f(rf.Path, line, true, t)
+			}
+		}
+		for _, t := range ap.Rest {
+			f(rf.Path, 0, rf.Status != "", t)
+		}
+	}
+}
+
+// threadPlace is where on path t is, with the commit if it isn't head.
+func threadPlace(path string, t *Thread, head string) string {
+	if t.Line != "" {
+		path += ":" + t.Line
+	}
+	if t.Commit != head {
+		path += " in " + t.Commit
+	}
+	return path
+}
+
+// githubPayload maps rep to a GitHub review by me.  GitHub review comments are on lines,
+// so the other threads go in the body, and the threads can't be resolved.
+func githubPayload(rep *Report, me string) *githubReview {
+	gr := &githubReview{CommitId: rep.HeadCommit, Event: "COMMENT"}
+	switch myVote(rep, me) {
+	case "approve":
+		gr.Event = "APPROVE"
+	case "reject":
+		gr.Event = "REQUEST_CHANGES"
+	}
+	body := []string{}
+	if rep.Description != "" {
+		body = append(body, strings.TrimRight(rep.Description, "\n"))
+	}
+	reportThreads(rep, func(path string, line int, inDiff bool, t *Thread) {
+		b := threadBody(t, me)
+		if t.Resolved {
+			b += "\n\n(resolved)"
+		}
+		if line == 0 {
+			if path != "" {
+				b = fmt.Sprintf("On %s:\n\n%s", threadPlace(path, t, rep.HeadCommit), b)
+			}
+			body = append(body, b)
+			return
+		}
+		gr.Comments = append(gr.Comments, githubReviewComment{Path: path, Line: line, Side: "RIGHT", Body: b})
+	})
+	gr.Body = strings.Join(body, "\n\n---\n\n")
+	return gr
+}
+
+// gerritPayload maps rep to a Gerrit ReviewInput by me.
+func gerritPayload(rep *Report, me string) *gerritReview {
+	gr := &gerritReview{Tag: "autogenerated:scrutinize", Message: strings.TrimRight(rep.Description, "\n"), Comments: map[string][]gerritCommentInput{}}
+	switch myVote(rep, me) {
+	case "approve":
+		gr.Labels = map[string]int{"Code-Review": 1}
+	case "reject":
+		gr.Labels = map[string]int{"Code-Review": -1}
+	}
+	reportThreads(rep, func(path string, line int, inDiff bool, t *Thread) {
+		ci := gerritCommentInput{Line: line, Message: threadBody(t, me), Unresolved: !t.Resolved}
+		if line > 0 {
+			ci.Side = "REVISION"
+		}
+		// file comments only on files in the change, and not for threads on a line elsewhere
+		if path != "" && line == 0 && (!inDiff || t.Line != "" || t.Commit != rep.HeadCommit) {
+			ci.Message = fmt.Sprintf("On %s:\n\n%s", threadPlace(path, t, rep.HeadCommit), ci.Message)
+			path = ""
+		}
+		if path == "" {
+			path = gerritPatchsetLevel
+		}
+		gr.Comments[path] = append(gr.Comments[path], ci)
+	})
+	return gr
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func readForgeFixture(t *testing.T, fname string) []*forgeMessage {
+	f, err := os.Open("testdata/authors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	authors, err := readAuthors(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comments, err := parseForge(data, "", authors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return forgeMessages(comments)
+}
+
+func TestImportGitHub(t *testing.T) {
+	fms := readForgeFixture(t, "testdata/github_comments.json")
+	if len(fms) != 3 {
+		t.Fatalf("got %d messages, expected 3", len(fms))
+	}
+	for _, fm := range fms {
+		fm.msg.Header.Set("Scrutinize-Version", messageVersion) // as gitNoteWrite does
+		if err := fm.msg.Validate(); err != nil {
+			t.Errorf("%s: %v", fm.msg.Header.Get("Origin"), err)
+		}
+	}
+	first, outdated, reply := fms[0].msg, fms[1].msg, fms[2].msg
+	if got := first.Header.Get("Author"); got != "Mona Lisa Octocat <mona@example.com>" {
+		t.Errorf("author is %q, expected the one from the authors file", got)
+	}
+	if got := reply.Header.Get("Author"); got != "hubot <hubot@users.noreply.github.com>" {
+		t.Errorf("author is %q", got)
+	}
+	if fms[2].commit != fms[0].commit || reply.Header.Get("File") != "cmd/main.go" || reply.Header.Get("Line") != "2" {
+		t.Errorf("reply is not in the thread: %s %v", fms[2].commit, reply.Header)
+	}
+	if fms[1].commit != "0a1b2c3d4e5f60718293a4b5c6d7e8f901234567" || outdated.Header.Get("Line") != "7" {
+		t.Errorf("outdated comment is on %s line %s, expected its original commit and line", fms[1].commit, outdated.Header.Get("Line"))
+	}
+
+	again := readForgeFixture(t, "testdata/github_comments.json")
+	for i := range fms {
+		if a, b := fms[i].msg.Header.Get("Message-Id"), again[i].msg.Header.Get("Message-Id"); a != b {
+			t.Errorf("importing again gives Message-Id %s instead of %s", b, a)
+		}
+	}
+}
+
+func TestImportGitLab(t *testing.T) {
+	fms := readForgeFixture(t, "testdata/gitlab_discussions.json")
+	if len(fms) != 3 {
+		t.Fatalf("got %d messages, expected 3 without the system note", len(fms))
+	}
+	if fms[0].msg.Header.Get("Status") != "" || fms[1].msg.Header.Get("Status") != "resolved" {
+		t.Errorf("resolution should be on the last message of the thread")
+	}
+	if fms[1].msg.Header.Get("File") != "lib/frob.go" || fms[1].msg.Header.Get("Line") != "18" {
+		t.Errorf("reply is on %v", fms[1].msg.Header)
+	}
+	if fms[2].commit != "" || fms[2].msg.Header.Get("File") != "" {
+		t.Errorf("general comment should be on the review head, got commit %q file %q", fms[2].commit, fms[2].msg.Header.Get("File"))
+	}
+	if got := fms[2].msg.Header.Get("Author"); got != "Jane Doe <jdoe@users.noreply.gitlab.com>" {
+		t.Errorf("author is %q", got)
+	}
+}
+
+func TestForgePayloads(t *testing.T) {
+	me := "A U Thor <author@example.com>"
+	other := testThread("a.go", "3", "why 3?", true)
+	reply := testThread("", "", "because", false).Messages[0]
+	reply.Header.Set("Author", "Re Viewer <reviewer@example.com>")
+	other.Messages = append(other.Messages, reply)
+	vote := testThread("", "", "", false).Messages[0]
+	vote.Header.Set("Vote", "reject")
+	outside := testThread("a.go", "9", "not in the diff", false)
+	earlier := testThread("a.go", "3", "on an earlier version", false)
+	earlier.Commit = "decade"
+	rep := &Report{
+		ReviewSummary: &ReviewSummary{Review: &Review{Id: "r1", Description: "Frobnicate.\n"}},
+		HeadCommit:    "c0ffee",
+		Commits:       []*ReportCommit{{Id: "c0ffee", Threads: []*Thread{testThread("", "", "nice commit", false)}}},
+		Files:         []*ReportFile{{Path: "a.go", Status: "Modified", Patch: testPatch, Threads: []*Thread{other, testThread("a.go", "", "whole file", false), outside, earlier}, head: "c0ffee"}},
+		Votes:         []*Message{vote},
+	}
+
+	gh := githubPayload(rep, me)
+	if gh.Event != "REQUEST_CHANGES" || gh.CommitId != "c0ffee" {
+		t.Errorf("github review event %s on %s", gh.Event, gh.CommitId)
+	}
+	if len(gh.Comments) != 1 {
+		t.Fatalf("got %d github comments, expected the one on a line", len(gh.Comments))
+	}
+	if c := gh.Comments[0]; c.Path != "a.go" || c.Line != 3 || c.Side != "RIGHT" ||
+		!strings.HasPrefix(c.Body, "why 3?") || !strings.Contains(c.Body, "Re Viewer <reviewer@example.com> wrote on") || !strings.HasSuffix(c.Body, "(resolved)") {
+		t.Errorf("github comment: %+v", c)
+	}
+	for _, w := range []string{"Frobnicate.", "nice commit", "On a.go:\n\nwhole file", "On a.go:9:\n\nnot in the diff", "On a.go:3 in decade:\n\non an earlier version"} {
+		if !strings.Contains(gh.Body, w) {
+			t.Errorf("github review body %q doesn't contain %q", gh.Body, w)
+		}
+	}
+
+	gr := gerritPayload(rep, me)
+	if gr.Labels["Code-Review"] != -1 {
+		t.Errorf("gerrit labels %v", gr.Labels)
+	}
+	if cs := gr.Comments["a.go"]; len(cs) != 2 || cs[0].Line != 3 || cs[0].Side != "REVISION" || cs[0].Unresolved || cs[1].Line != 0 || !cs[1].Unresolved {
+		t.Errorf("gerrit comments on a.go: %+v", cs)
+	}
+	if cs := gr.Comments[gerritPatchsetLevel]; len(cs) != 3 || cs[0].Message != "nice commit" || cs[1].Message != "On a.go:9:\n\nnot in the diff" || cs[2].Line != 0 {
+		t.Errorf("gerrit patchset level comments: %+v", cs)
+	}
+}
+
+func TestGitImport(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+	// the same comments twice, as from two overlapping dumps
+	fms := append(readForgeFixture(t, "testdata/github_comments.json"), readForgeFixture(t, "testdata/github_comments.json")...)
+	for _, fm := range fms {
+		fm.commit = f.c1.String()
+	}
+	var log strings.Builder
+	if n, err := f.gitImport("topic", fms, &log); err != nil || n != 3 {
+		t.Fatalf("gitImport: got %d, %v, want 3\n%s", n, err, log.String())
+	}
+	notes, err := f.gitNotes("topic")
+	if err != nil || len(notes[f.c1.String()]) != 3 {
+		t.Errorf("gitNotes after gitImport: got %v, %v", notes, err)
+	}
+	ref, err := f.Ref(path.Join(*refpfx, "topic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := f.Commit(ref); err != nil || c.ParentCount() != 0 {
+		t.Errorf("gitImport made more than one notes commit: %v", err)
+	}
+	if n, err := f.gitImport("topic", fms, &log); err != nil || n != 0 {
+		t.Errorf("gitImport again: got %d, %v, want 0", n, err)
+	}
+}
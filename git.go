@@ -5,154 +5,182 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log"
+	"net/url"
+	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
-
-	git "github.com/libgit2/git2go"
 )
 
-func gitConfig() ([]*git.ConfigEntry, error) {
-	cfg, err := repository.Config()
+func (g *gitContext) gitConfig() ([]*ConfigEntry, error) { return g.Config() }
+
+// log of base..head of review
+func (g *gitContext) gitLog(review string) ([]*Commit, error) {
+	head, err := g.gitHead(review)
 	if err != nil {
 		return nil, err
 	}
-
-	it, err := cfg.NewIterator()
+	base, err := g.gitBase(review)
 	if err != nil {
 		return nil, err
 	}
-	var ss []*git.ConfigEntry
-	for {
-		n, err := it.Next()
-		if ge, ok := err.(*git.GitError); ok && ge.Code == git.ErrIterOver {
-			break
-		}
-		if err != nil {
-			return ss, err
-		}
-		ss = append(ss, n)
-	}
-	return ss, nil
+	return g.Log(head, base)
 }
 
-// log of master..HEAD
-func gitLog() ([]*git.Commit, error) {
-	w, err := repository.Walk()
+func (g *gitContext) gitRefNames() ([]string, error) { return g.RefNames() }
+
+func (g *gitContext) gitNotes(review string) (map[string][]*Message, error) {
+	id, err := g.gitReviewId(review)
 	if err != nil {
 		return nil, err
 	}
+	return g.gitReadNotes(path.Join(*refpfx, id), id)
+}
 
-	w.Sorting(git.SortTopological | git.SortTime)
-	if err := w.PushHead(); err != nil {
-		return nil, err
+// gitReadNotes returns the messages of the review with id on ref, by commit.
+func (g *gitContext) gitReadNotes(ref, id string) (map[string][]*Message, error) {
+	notes, err := g.Notes(ref)
+	if err == errNotFound {
+		return nil, nil
 	}
-	if err := w.HideRef(*baseline); err != nil {
+	if err != nil {
 		return nil, err
 	}
-
-	var commits []*git.Commit
-
-	if err := w.Iterate(func(commit *git.Commit) bool {
-		commits = append(commits, commit)
-		return true
-	}); err != nil {
-		return nil, err
+	signer, err := g.gitSigner()
+	if err != nil {
+		if _, logged := signerErrs.LoadOrStore(g.Name, true); !logged {
+			log.Printf("%s: %v, signatures aren't verified", g.Name, err)
+		}
 	}
+	ss := map[string][]*Message{}
+	for _, note := range notes {
+		annid := note.Id
+		if annid.String() == emptyTree {
+			continue // the review itself, see gitReview
+		}
 
-	return commits, nil
+		msgs, err := readMessages(note.Message)
+		if err != nil {
+			return nil, fmt.Errorf("Reading note on %s: %v", annid, err)
+		}
+		for _, msg := range msgs {
+			status := sigUnverified
+			if signer != nil {
+				status = signer.verify(msg, annid, id)
+			}
+			if msg.Header.Get("Message-Id") == "" {
+				msg.Header.Set("Message-Id", legacyMessageId(msg))
+			}
+			msg.Header.Set("Signature-Status", status)
+			msg.Header.Set("Commit", annid.String()) // supply the commit oid as an extra header
+			msg.Header.Set("Review", id)             // and the review, for links in the body
+		}
+		ss[annid.String()] = foldEdits(msgs)
+	}
+	return ss, nil
 }
 
-func gitRefNames() ([]string, error) {
-	it, err := repository.NewReferenceNameIterator()
-	if err != nil {
-		return nil, err
-	}
-	var ss []string
+// readMessages reads the messages in the text of a note.
+func readMessages(text string) ([]*Message, error) {
+	var msgs []*Message
+	r := bufio.NewReader(strings.NewReader(text))
 	for {
-		n, err := it.Next()
-		if ge, ok := err.(*git.GitError); ok && ge.Code == git.ErrIterOver {
-			break
+		msg, err := ReadMessage(r)
+		if err == io.EOF {
+			return msgs, nil
 		}
 		if err != nil {
-			return ss, err
+			return nil, err
 		}
-		ss = append(ss, n)
+		msgs = append(msgs, msg)
 	}
-	return ss, nil
 }
 
-func gitNotes() (map[string][]*Message, error) {
-	head, err := repository.Head()
-	if err != nil {
-		return nil, err
-	}
-	branch, err := head.Branch().Name()
-	if err != nil {
-		return nil, err
-	}
-	it, err := repository.NewNoteIterator(path.Join(*refpfx, branch))
-	if ge, ok := err.(*git.GitError); ok && ge.Code == git.ErrNotFound {
-		return nil, nil
-	}
+// gitFindMessage returns the current version of the message with id on commit in review,
+// or nil if there is none.
+func (g *gitContext) gitFindMessage(review, commit, id string) (*Message, error) {
+	notes, err := g.gitNotes(review)
 	if err != nil {
 		return nil, err
 	}
-	ss := map[string][]*Message{}
-	for {
-		noteid, annid, err := it.Next()
-		if ge, ok := err.(*git.GitError); ok && ge.Code == git.ErrIterOver {
-			break
-		}
-		if err != nil {
-			return ss, err
-		}
-		obj, err := repository.Lookup(noteid)
-		if err != nil {
-			return ss, err
-		}
-		b, err := obj.AsBlob()
-		if err != nil {
-			return ss, err
-		}
+	return findMessage(notes[commit], id), nil
+}
 
-		r := bufio.NewReader(bytes.NewBuffer(b.Contents()))
-		for {
-			msg, err := ReadMessage(r)
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return nil, fmt.Errorf("Reading notes object %s: %v", noteid, err)
+// findMessage returns the message in msgs, folded as gitReadNotes does, that has id
+// or had it before an edit, or nil if there is none.
+func findMessage(msgs []*Message, id string) *Message {
+	for _, msg := range msgs {
+		if msg.Header.Get("Message-Id") == id {
+			return msg
+		}
+		for _, h := range msg.History {
+			if h.Header.Get("Message-Id") == id {
+				return msg
 			}
-			msg.Header.Set("Commit", annid.String()) // supply the commit oid as an extra header
-			ss[annid.String()] = append(ss[annid.String()], msg)
 		}
+	}
+	return nil
+}
 
+// gitAuthor returns the user as written in the Author header.
+func (g *gitContext) gitAuthor() (string, error) {
+	sig, err := g.DefaultSignature()
+	if err != nil {
+		return "", err
 	}
-	return ss, nil
+	return fmt.Sprintf("%s <%s>", sig.Name, sig.Email), nil
 }
 
 // returned map is indexed on the line number (as a string)
 // line-less ones are indexed under "FILE"
-func gitNotesForFile(dir, name string) (map[string][]*Message, error) {
+// Drafts come after the published messages. Messages on commits from before the file
+// was renamed are those about its old path.
+func (g *gitContext) gitNotesForFile(review, dir, name string) (map[string][]*Message, error) {
 	path := filepath.Join(dir, name)
 	if filepath.IsAbs(path) {
 		path = path[1:]
 	}
-	notes, err := gitNotes()
+	notes, err := g.gitNotes(review)
 	if err != nil {
 		return nil, err
 	}
-	r := map[string][]*Message{}
+	drafts, err := g.gitDrafts(review)
+	if err != nil {
+		return nil, err
+	}
+	var all [][]*Message
 	for _, msgs := range notes {
+		all = append(all, msgs)
+	}
+	for _, msgs := range drafts {
+		all = append(all, msgs)
+	}
+	// only messages on other paths can be on the file before a rename
+	var paths map[string]string
+	for _, msgs := range all {
+		for _, msg := range msgs {
+			if p := strings.TrimPrefix(msg.Header.Get("File"), "/"); p != "" && p != path && paths == nil {
+				if paths, err = g.gitFilePaths(review, path); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	r := map[string][]*Message{}
+	for _, msgs := range all {
 		for _, msg := range msgs {
 			if p := msg.Header.Get("File"); p != "" {
 				if filepath.IsAbs(p) {
 					p = p[1:]
 				}
-				if p != path {
+				want, ok := paths[msg.Header.Get("Commit")]
+				if !ok {
+					want = path
+				}
+				if p != want {
 					continue
 				}
 				ln := msg.Header.Get("Line")
@@ -166,216 +194,391 @@ func gitNotesForFile(dir, name string) (map[string][]*Message, error) {
 	return r, nil
 }
 
-func gitNoteAppend(id *git.Oid, msg *Message) error {
-	head, err := repository.Head()
+// gitNoteAppend appends msg, written by the current user, to the note on id in review.
+func (g *gitContext) gitNoteAppend(review string, id *Oid, msg *Message) error {
+	ref, err := g.gitNotesRef(review)
 	if err != nil {
 		return err
 	}
-	branch, err := head.Branch().Name()
+	return g.gitNoteAppendRef(ref, id, msg)
+}
+
+// gitNoteAppendRef is gitNoteAppend to the note on id in ref.
+func (g *gitContext) gitNoteAppendRef(ref string, id *Oid, msg *Message) error {
+	sig, err := g.DefaultSignature()
 	if err != nil {
 		return err
 	}
-	ref := path.Join(*refpfx, branch)
+	msg.Header.Set("Author", fmt.Sprintf("%s <%s>", sig.Name, sig.Email))
+	msg.Header.Set("Date", sig.When.Format(time.RFC3339))
+	return g.gitNoteWriteRef(ref, id, msg, *signMsgs)
+}
 
-	sig, err := repository.DefaultSignature()
+// gitNoteWrite appends msg, which has its Author and Date set, to the note on id in review,
+// signing it if sign is set and there is a key to sign with.
+func (g *gitContext) gitNoteWrite(review string, id *Oid, msg *Message, sign bool) error {
+	ref, err := g.gitNotesRef(review)
 	if err != nil {
 		return err
 	}
+	return g.gitNoteWriteRef(ref, id, msg, sign)
+}
 
-	var buf bytes.Buffer
-	w := bufio.NewWriter(&buf)
-	note, err := repository.Notes.Read(ref, id)
-	if err == nil && note != nil {
-		buf.WriteString(note.Message())
+// gitNoteWriteRef is gitNoteWrite to the note on id in ref, the notes or pending ref of a
+// review if msg is to be signed, see refReview.
+func (g *gitContext) gitNoteWriteRef(ref string, id *Oid, msg *Message, sign bool) error {
+	sig, err := g.DefaultSignature()
+	if err != nil {
+		return err
+	}
+	note, err := g.Note(ref, id)
+	if err != nil && err != errNotFound {
+		return err
 	}
+	text, err := g.gitEncodeMessage(msg, id, refReview(ref), sign)
+	if err != nil {
+		return err
+	}
+	return g.SetNote(ref, id, note+text, sig)
+}
 
-	msg.Header.Set("Author", fmt.Sprintf("%s <%s>", sig.Name, sig.Email))
-	msg.Header.Set("Date", sig.When.Format(time.RFC3339))
+// refReview returns the id of the review whose notes or pending ref is ref.
+func refReview(ref string) string {
+	for _, pfx := range []string{*refpfx + "/", *refpfx + "-pending/"} {
+		if strings.HasPrefix(ref, pfx) {
+			return strings.TrimPrefix(ref, pfx)
+		}
+	}
+	return ref
+}
+
+// gitEncodeMessage gives msg, which has its Author and Date set, a Message-Id if it has none
+// and the current version, checks it, signs it as gitNoteWrite does for the note on commit
+// in review, and returns it as text.
+func (g *gitContext) gitEncodeMessage(msg *Message, commit *Oid, review string, sign bool) (string, error) {
+	if msg.Header.Get("Message-Id") == "" {
+		msg.Header.Set("Message-Id", newMessageId())
+	}
+	msg.Header.Set("Scrutinize-Version", messageVersion)
+	if err := msg.Validate(); err != nil {
+		return "", err
+	}
+	if sign {
+		signer, err := g.gitSigner()
+		if err != nil {
+			return "", err
+		}
+		if signer.key != "" {
+			if err := signer.sign(msg, commit, review); err != nil {
+				return "", err
+			}
+		}
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
 	msg.WriteTo(w)
 	w.Flush()
-
-	_, err = repository.Notes.Create(ref, sig, sig, id, buf.String(), true)
-	return err
+	return buf.String(), nil
 }
 
-func gitDiffs() ([]*git.DiffDelta, error) {
-	master, err := repository.References.Lookup(*baseline)
+// gitCommitTree returns the tree of commit id.
+func (g *gitContext) gitCommitTree(id *Oid) (*Oid, error) {
+	c, err := g.Commit(id)
 	if err != nil {
 		return nil, err
 	}
+	return c.TreeId(), nil
+}
 
-	oc, err := repository.LookupCommit(master.Target())
-	if err != nil {
-		return nil, err
-	}
-	otree, err := oc.Tree()
+// gitDiffs returns the files that change in review, with opts, nil for those of the repository.
+func (g *gitContext) gitDiffs(review string, opts *DiffOptions) ([]*DiffDelta, error) {
+	base, err := g.gitBase(review)
 	if err != nil {
 		return nil, err
 	}
-
-	head, err := repository.Head()
+	head, err := g.gitHead(review)
 	if err != nil {
 		return nil, err
 	}
+	return g.gitCommitDiffs(base, head, opts)
+}
 
-	nc, err := repository.LookupCommit(head.Target())
+// gitCommitDiffs returns the files that change between the trees of the commits ocid and ncid.
+func (g *gitContext) gitCommitDiffs(ocid, ncid *Oid, opts *DiffOptions) ([]*DiffDelta, error) {
+	otree, err := g.gitCommitTree(ocid)
 	if err != nil {
 		return nil, err
 	}
-	ntree, err := nc.Tree()
+	ntree, err := g.gitCommitTree(ncid)
 	if err != nil {
 		return nil, err
 	}
-	opts, err := git.DefaultDiffOptions()
-	if err != nil {
-		return nil, err
+	if opts == nil {
+		if opts, err = g.gitDiffOptions(); err != nil {
+			return nil, err
+		}
 	}
-	diff, err := repository.DiffTreeToTree(otree, ntree, &opts)
+	return g.DiffTrees(otree, ntree, opts)
+}
+
+func (g *gitContext) gitPatches(ocid, ncid *Oid, opts *DiffOptions) ([]string, error) {
+	otree, err := g.gitCommitTree(ocid)
 	if err != nil {
 		return nil, err
 	}
-	N, err := diff.NumDeltas()
+	ntree, err := g.gitCommitTree(ncid)
 	if err != nil {
 		return nil, err
 	}
-	var r []*git.DiffDelta
-	for i := 0; i < N; i++ {
-		dd, err := diff.GetDelta(i)
-		if err != nil {
+	if opts == nil {
+		if opts, err = g.gitDiffOptions(); err != nil {
 			return nil, err
 		}
-		r = append(r, &dd)
 	}
-	return r, nil
+	return g.Patches(otree, ntree, opts)
 }
 
-func gitPatches(ocid, ncid *git.Oid) ([]string, error) {
-	oc, err := repository.LookupCommit(ocid)
+// gitReviewPatches returns the patches of the files in gitDiffs, in the same order.
+func (g *gitContext) gitReviewPatches(review string, opts *DiffOptions) ([]string, error) {
+	base, err := g.gitBase(review)
 	if err != nil {
 		return nil, err
 	}
-	otree, err := oc.Tree()
+	head, err := g.gitHead(review)
 	if err != nil {
 		return nil, err
 	}
+	return g.gitPatches(base, head, opts)
+}
 
-	nc, err := repository.LookupCommit(ncid)
-	if err != nil {
-		return nil, err
+// gitDiffOptions returns how to compare trees, from git config: diff.renames is false,
+// true or copies as in git, and scrutinize.renameThreshold and scrutinize.copyThreshold
+// are percentages, 50% by default; and from the [diff] section of .scrutinize in the working
+// directory, if there is one, see setDiffOption.
+func (g *gitContext) gitDiffOptions() (*DiffOptions, error) {
+	opts := &DiffOptions{Renames: true, RenameThreshold: 50, CopyThreshold: 50}
+	if v, err := g.ConfigString("diff.renames"); err == nil {
+		switch strings.ToLower(v) {
+		case "copies", "copy":
+			opts.Copies = true
+		case "false", "no", "off", "0":
+			opts.Renames = false
+		case "true", "yes", "on", "1", "":
+		default:
+			return nil, fmt.Errorf("diff.renames: %q is not a boolean or copies", v)
+		}
 	}
-	ntree, err := nc.Tree()
-	if err != nil {
-		return nil, err
+	for k, p := range map[string]*int{"scrutinize.renameThreshold": &opts.RenameThreshold, "scrutinize.copyThreshold": &opts.CopyThreshold} {
+		v, err := g.ConfigString(k)
+		if err != nil || v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(v, "%"))
+		if err != nil || n < 1 || n > 100 {
+			return nil, fmt.Errorf("%s: %q is not a percentage from 1 to 100", k, v)
+		}
+		*p = n
+	}
+	if g.Workdir() == "" {
+		return opts, nil
+	}
+	fname := filepath.Join(g.Workdir(), checkConfig)
+	if _, err := os.Stat(fname); os.IsNotExist(err) {
+		return opts, nil
 	}
-	opts, err := git.DefaultDiffOptions()
+	entries, err := g.ReadConfig(fname)
 	if err != nil {
 		return nil, err
 	}
-	diff, err := repository.DiffTreeToTree(otree, ntree, &opts)
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name, "diff.") {
+			continue
+		}
+		if err := setDiffOption(opts, e.Name[len("diff."):], e.Value); err != nil {
+			return nil, fmt.Errorf("%s: %v", fname, err)
+		}
+	}
+	return opts, nil
+}
+
+// gitCompleteDiffOptions returns the diff options of the repository without those that leave
+// out files or changes, for what has to cover all of a change, like a report or findings.
+func (g *gitContext) gitCompleteDiffOptions() (*DiffOptions, error) {
+	opts, err := g.gitDiffOptions()
 	if err != nil {
 		return nil, err
 	}
-	N, err := diff.NumDeltas()
+	opts.IgnoreWhitespace, opts.Ignore = false, nil
+	return opts, nil
+}
+
+// diffOptionKeys are the keys of the [diff] section of .scrutinize, which the diffs page
+// and api take as parameters too.
+var diffOptionKeys = []string{"ignoreWhitespace", "context", "algorithm", "ignore"}
+
+// setDiffOption sets the diff option key in opts: ignoreWhitespace is a boolean, context a
+// number of lines, algorithm myers, minimal, patience or histogram, and ignore adds globs,
+// separated by spaces.
+func setDiffOption(opts *DiffOptions, key, value string) error {
+	switch strings.ToLower(key) {
+	case "ignorewhitespace":
+		switch strings.ToLower(value) {
+		case "true", "yes", "on", "1", "":
+			opts.IgnoreWhitespace = true
+		case "false", "no", "off", "0":
+			opts.IgnoreWhitespace = false
+		default:
+			return fmt.Errorf("diff.ignoreWhitespace: %q is not a boolean", value)
+		}
+	case "context":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("diff.context: %q is not a number of lines", value)
+		}
+		opts.Context = n
+	case "algorithm":
+		switch v := strings.ToLower(value); v {
+		case "myers", "default", "":
+			opts.Algorithm = ""
+		case "minimal", "patience", "histogram":
+			opts.Algorithm = v
+		default:
+			return fmt.Errorf("diff.algorithm: %q is not myers, minimal, patience or histogram", value)
+		}
+	case "ignore":
+		opts.Ignore = append(opts.Ignore, strings.Fields(value)...)
+	default:
+		return fmt.Errorf("diff.%s is not a diff option", key)
+	}
+	return nil
+}
+
+// gitFormDiffOptions returns the diff options of the repository, with those set in form
+// instead.  An ignore parameter replaces the globs of the repository.
+func (g *gitContext) gitFormDiffOptions(form url.Values) (*DiffOptions, error) {
+	opts, err := g.gitDiffOptions()
 	if err != nil {
 		return nil, err
 	}
-	var r []string
-	for i := 0; i < N; i++ {
-		dd, err := diff.Patch(i)
-		if err != nil {
-			return nil, err
+	for _, k := range diffOptionKeys {
+		vv, ok := form[k]
+		if !ok {
+			continue
 		}
-		s, err := dd.String()
-		if err != nil {
-			return nil, err
+		if k == "ignore" {
+			opts.Ignore = nil
+		}
+		for _, v := range vv {
+			if err := setDiffOption(opts, k, v); err != nil {
+				return nil, err
+			}
 		}
-		r = append(r, s)
 	}
-	return r, nil
+	return opts, nil
 }
 
-func gitDeltaString(d git.Delta) string {
+// gitPageDiffOptions is gitFormDiffOptions for templates, with the parameters of the diffs
+// page that aren't empty.
+func (g *gitContext) gitPageDiffOptions(ignoreWhitespace, context, algorithm, ignore string) (*DiffOptions, error) {
+	form := url.Values{}
+	for i, v := range []string{ignoreWhitespace, context, algorithm, ignore} {
+		if v != "" {
+			form.Set(diffOptionKeys[i], v)
+		}
+	}
+	return g.gitFormDiffOptions(form)
+}
+
+func gitDeltaString(d Delta) string {
 	switch d {
-	case git.DeltaUnmodified:
+	case DeltaUnmodified:
 		return "Unmodified"
-	case git.DeltaAdded:
+	case DeltaAdded:
 		return "Added"
-	case git.DeltaDeleted:
+	case DeltaDeleted:
 		return "Deleted"
-	case git.DeltaModified:
+	case DeltaModified:
 		return "Modified"
-	case git.DeltaRenamed:
+	case DeltaRenamed:
 		return "Renamed"
-	case git.DeltaCopied:
+	case DeltaCopied:
 		return "Copied"
-	case git.DeltaIgnored:
+	case DeltaIgnored:
 		return "Ignored"
-	case git.DeltaUntracked:
+	case DeltaUntracked:
 		return "Untracked"
-	case git.DeltaTypeChange:
+	case DeltaTypeChange:
 		return "TypeChange"
 	}
 	return fmt.Sprintf("Delta[%d]", int(d))
 }
 
-func gitDiffFlagString(d git.DiffFlag) string {
+func gitDiffFlagString(d DiffFlag) string {
 	var f []string
-	if d&git.DiffFlagBinary != 0 {
+	if d&DiffFlagBinary != 0 {
 		f = append(f, "binary")
 	}
-	if d&git.DiffFlagNotBinary != 0 {
+	if d&DiffFlagNotBinary != 0 {
 		f = append(f, "text")
 	}
-	if d&git.DiffFlagValidOid != 0 {
+	if d&DiffFlagValidOid != 0 {
 		f = append(f, "valid")
 	}
 	return strings.Join(f, ",")
 }
 
-func gitTree(path string) ([]*git.TreeEntry, error) {
-	head, err := repository.Head()
+func (g *gitContext) gitTree(review, path string) ([]*TreeEntry, error) {
+	head, err := g.gitHead(review)
 	if err != nil {
 		return nil, err
 	}
-	c, err := repository.LookupCommit(head.Target())
-	if err != nil {
-		return nil, err
-	}
-	tree, err := c.Tree()
+	tree, err := g.gitCommitTree(head)
 	if err != nil {
 		return nil, err
 	}
 	if path != "" {
-		entry, err := tree.EntryByPath(path)
+		entry, err := g.TreeEntry(tree, path)
 		if err != nil {
 			return nil, err
 		}
-		if entry.Type != git.ObjectTree {
+		if entry.Type != ObjectTree {
 			return nil, fmt.Errorf("not a tree: %q", path)
 		}
-		tree, err = repository.LookupTree(entry.Id)
-		if err != nil {
-			return nil, err
-		}
+		tree = entry.Id
 	}
+	return g.Tree(tree)
+}
 
-	var r []*git.TreeEntry
-	for i, e := uint64(0), tree.EntryCount(); i < e; i++ {
-		r = append(r, tree.EntryByIndex(i))
+// gitBlobId returns the id of the blob at path in the head of review.
+func (g *gitContext) gitBlobId(review, path string) (*Oid, error) {
+	head, err := g.gitHead(review)
+	if err != nil {
+		return nil, err
 	}
-	return r, nil
+	tree, err := g.gitCommitTree(head)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := g.TreeEntry(tree, path)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Type != ObjectBlob {
+		return nil, fmt.Errorf("not a blob: %q", path)
+	}
+	return entry.Id, nil
 }
 
-func gitBlob(oid string) (<-chan string, error) {
-	id, err := git.NewOid(oid)
+func (g *gitContext) gitBlob(oid string) (<-chan string, error) {
+	id, err := NewOid(oid)
 	if err != nil {
 		return nil, err
 	}
-	blob, err := repository.LookupBlob(id)
+	blob, err := g.Blob(id)
 	if err != nil {
 		return nil, err
 	}
-	r := bufio.NewScanner(bytes.NewReader(blob.Contents()))
+	r := bufio.NewScanner(bytes.NewReader(blob))
 	ch := make(chan string)
 	go func() {
 		defer close(ch)
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGitLog(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+
+	for _, review := range []string{"topic", ""} {
+		log, err := f.gitLog(review)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range log {
+			got = append(got, c.Summary())
+		}
+		if want := []string{"Replace b with dir/c", "Change a"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("f.gitLog(%q): got %q, want %q", review, got, want)
+		}
+	}
+
+	f.commit("master", "Moving on", map[string]string{"d": "dee\n"})
+	if log, err := f.gitLog("topic"); err != nil || len(log) != 2 {
+		t.Errorf("gitLog after master moved: got %d commits, %v", len(log), err)
+	}
+	if log, err := f.gitLog("master"); err != nil || len(log) != 0 {
+		t.Errorf("gitLog of the baseline: got %d commits, %v", len(log), err)
+	}
+}
+
+func TestGitNotes(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+
+	if notes, err := f.gitNotes("topic"); err != nil || notes != nil {
+		t.Errorf("gitNotes without notes: got %v, %v", notes, err)
+	}
+
+	c := f.comment("topic", f.c1, "Alice <alice@example.com>", "why 2?", "File", "a", "Line", "2")
+	f.comment("topic", f.c1, "Bob <bob@example.com>", "why not?")
+	f.comment("topic", f.c1, "Alice <alice@example.com>", "why 2, not two?", "File", "a", "Line", "2", "Supersedes", c.Header.Get("Message-Id"))
+	f.comment("topic", f.c2, "Bob <bob@example.com>", "LGTM", "Vote", "approve")
+
+	notes, err := f.gitNotes("topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 2 || len(notes[f.c1.String()]) != 2 || len(notes[f.c2.String()]) != 1 {
+		t.Fatalf("gitNotes: got %v", notes)
+	}
+	m := notes[f.c1.String()][0]
+	if m.Body != "why 2, not two?\n" || len(m.History) != 1 || m.History[0].Body != "why 2?\n" {
+		t.Errorf("gitNotes: edit not folded: %q with %d earlier versions", m.Body, len(m.History))
+	}
+	for k, v := range map[string]string{
+		"Message-Id":         c.Header.Get("Message-Id"),
+		"Commit":             f.c1.String(),
+		"Review":             "topic",
+		"Signature-Status":   sigUnverified,
+		"Scrutinize-Version": messageVersion,
+	} {
+		if got := m.Header.Get(k); got != v {
+			t.Errorf("gitNotes: %s is %q, want %q", k, got, v)
+		}
+	}
+
+	found, err := f.gitFindMessage("topic", f.c1.String(), c.Header.Get("Message-Id"))
+	if err != nil || found == nil || found.Body != m.Body {
+		t.Errorf("gitFindMessage: got %v, %v", found, err)
+	}
+
+	byLine, err := f.gitNotesForFile("topic", "", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byLine["2"]) != 1 || len(byLine) != 1 {
+		t.Errorf("gitNotesForFile: got %v", byLine)
+	}
+}
+
+func TestGitNoteAppend(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+
+	msg := &Message{Header: textproto.MIMEHeader{}, Body: "nit"}
+	msg.Header.Set("File", "dir/c")
+	if err := f.gitNoteAppend("topic", f.c2, msg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := msg.Header.Get("Author"), "Test <test@example.com>"; got != want {
+		t.Errorf("Author: got %q, want %q", got, want)
+	}
+	if msg.Header.Get("Date") == "" || msg.Header.Get("Message-Id") == "" {
+		t.Errorf("no Date or Message-Id: %v", msg.Header)
+	}
+
+	bad := &Message{Header: textproto.MIMEHeader{}, Body: "hmm"}
+	bad.Header.Set("Vote", "maybe")
+	if err := f.gitNoteAppend("topic", f.c2, bad); err == nil {
+		t.Errorf("gitNoteAppend of an invalid Vote succeeded")
+	}
+
+	notes, err := f.gitNotes("topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs := notes[f.c2.String()]; len(msgs) != 1 || msgs[0].Body != "nit\n" {
+		t.Errorf("gitNotes after gitNoteAppend: got %v", msgs)
+	}
+	if text, err := f.Note(*refpfx+"/topic", f.c2); err != nil || strings.Count(text, "Message-Id:") != 1 {
+		t.Errorf("the note holds %q, %v", text, err)
+	}
+}
+
+func TestGitDiffs(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+
+	deltas, err := f.gitDiffs("topic", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range deltas {
+		got = append(got, gitDeltaString(d.Status)+" "+d.NewFile.Path)
+	}
+	if want := []string{"Modified a", "Deleted b", "Added dir/c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("gitDiffs: got %q, want %q", got, want)
+	}
+
+	patches, err := f.gitPatches(f.base, f.c1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patches) != 1 || !strings.Contains(patches[0], "-two\n+2\n") {
+		t.Errorf("gitPatches: got %q", patches)
+	}
+
+	entries, err := f.gitTree("topic", "dir")
+	if err != nil || len(entries) != 1 || entries[0].Name != "c" {
+		t.Errorf("gitTree: got %v, %v", entries, err)
+	}
+	if _, err := f.gitBlobId("topic", "b"); err == nil {
+		t.Errorf("gitBlobId of a removed file succeeded")
+	}
+}
+
+func TestGitReview(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+
+	r, err := f.gitNewReview("A topic", "", "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.Branches, []string{"topic"}) {
+		t.Errorf("gitNewReview: branches %q", r.Branches)
+	}
+	if _, err := f.gitNewReview("Again", "", r.Id); err == nil {
+		t.Errorf("gitNewReview of a review id succeeded")
+	}
+	for _, name := range []string{"topic", "", r.Id} {
+		if id, err := f.gitReviewId(name); err != nil || id != r.Id {
+			t.Errorf("f.gitReviewId(%q): got %q, %v, want %q", name, id, err, r.Id)
+		}
+	}
+	// as with -review, which only applies to the repository it is given for
+	named := &gitContext{Repo: f.Repo, Name: "named", review: "other"}
+	if id, err := named.gitReviewId(""); err != nil || id != "other" {
+		t.Errorf("gitReviewId of the checkout with a review name: got %q, %v", id, err)
+	}
+	if id, err := f.gitReviewId(""); err != nil || id != r.Id {
+		t.Errorf("gitReviewId of the checkout of another context: got %q, %v", id, err)
+	}
+	for _, name := range []string{"../../heads/master", "/topic", "a//b", "topic/", ".hidden", "x.lock", "a b", "a~1", "a@{0}", "a\\b"} {
+		if _, err := f.gitReviewId(name); err == nil {
+			t.Errorf("f.gitReviewId(%q) succeeded", name)
+		}
+		if _, err := f.gitNewReview("Bad", "", name); err == nil {
+			t.Errorf("f.gitNewReview of %q succeeded", name)
+		}
+	}
+	if head, err := f.gitHead(r.Id); err != nil || !head.Equal(f.c2) {
+		t.Errorf("gitHead: got %v, %v", head, err)
+	}
+
+	// as git branch -m topic renamed does
+	f.branch("renamed", "topic")
+	if err := f.DeleteRef("refs/heads/topic"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetConfig("branch.renamed.scrutinizeReview", r.Id); err != nil {
+		t.Fatal(err)
+	}
+	if head, err := f.gitHead(r.Id); err != nil || !head.Equal(f.c2) {
+		t.Errorf("gitHead after a rename: got %v, %v", head, err)
+	}
+	if id, err := f.gitReviewId("renamed"); err != nil || id != r.Id {
+		t.Errorf("f.gitReviewId of the renamed branch: got %q, %v", id, err)
+	}
+	f.branch("topic", "renamed")
+
+	// branches that only end in one of the review
+	for _, b := range []string{"alice/topic", "fix/topic"} {
+		f.branch(b, "master")
+		if id, err := f.gitReviewId(b); err != nil || id == r.Id {
+			t.Errorf("f.gitReviewId(%q): got %q, %v, the review of topic", b, id, err)
+		}
+	}
+
+	r.Description = "Changes a and more"
+	if err := f.gitSaveReview(r); err != nil {
+		t.Fatal(err)
+	}
+	got, err := f.gitReview("topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "A topic" || got.Description != "Changes a and more\n" || got.Base != "refs/heads/master" {
+		t.Errorf("gitReview: got %+v", got)
+	}
+}
+
+func TestTrimRemote(t *testing.T) {
+	remotes := []string{"origin", "team/upstream"}
+	for branch, want := range map[string]string{
+		"origin/feature":        "feature",
+		"origin/alice/feature":  "alice/feature",
+		"team/upstream/feature": "feature",
+		"alice/feature":         "alice/feature",
+		"feature":               "feature",
+	} {
+		if got := trimRemote(branch, remotes); got != want {
+			t.Errorf("trimRemote(%q): got %q, want %q", branch, got, want)
+		}
+	}
+}
+
+func TestGitCheckoutName(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+
+	if name, err := f.gitCheckoutName(); err != nil || name != "topic" {
+		t.Errorf("gitCheckoutName: got %q, %v", name, err)
+	}
+	// a CI checkout of a branch that is only on the remote
+	c := f.commit("feature", "Feature", map[string]string{"f": "eff\n"})
+	if err := f.SetConfig("remote.origin.url", "https://example.com/repo.git"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(f.Path(), "refs", "remotes", "origin"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, fname := range []string{"refs/remotes/origin/feature", "HEAD"} {
+		if err := ioutil.WriteFile(filepath.Join(f.Path(), filepath.FromSlash(fname)), []byte(c.String()+"\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.DeleteRef("refs/heads/feature"); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := f.gitCheckoutName(); err != nil || name != "feature" {
+		t.Errorf("gitCheckoutName on a remote branch: got %q, %v, want feature", name, err)
+	}
+}
+
+func TestGitDiffRenames(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+	f.comment("", f.c1, "Alice <alice@example.com>", "why 2?", "File", "a", "Line", "2")
+	f.commit("topic", "Move a", map[string]string{"a": "", "moved/a": "one\n2\nthree\n"})
+
+	diffs := func() []string {
+		t.Helper()
+		deltas, err := f.gitDiffs("", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, d := range deltas {
+			got = append(got, gitDeltaString(d.Status)+" "+d.OldFile.Path+" "+d.NewFile.Path)
+		}
+		return got
+	}
+	if got, want := diffs(), []string{"Deleted b b", "Added dir/c dir/c", "Renamed a moved/a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("gitDiffs: got %q, want %q", got, want)
+	}
+	if patches, err := f.gitReviewPatches("", nil); err != nil || len(patches) != 3 || !strings.Contains(patches[2], "-two\n+2\n") {
+		t.Errorf("gitReviewPatches: got %q, %v", patches, err)
+	}
+
+	notes, err := f.gitNotesForFile("", "moved", "a")
+	if err != nil || len(notes["2"]) != 1 {
+		t.Errorf("gitNotesForFile of the renamed file: got %v, %v", notes, err)
+	}
+	rep, err := f.gitReport("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rf := range rep.Files {
+		if rf.Path == "a" || rf.Path == "moved/a" && len(rf.Threads) != 1 {
+			t.Errorf("gitReport: thread on a doesn't follow it to moved/a: %s has %d", rf.Path, len(rf.Threads))
+		}
+	}
+
+	if err := f.SetConfig("diff.renames", "false"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := diffs(), []string{"Deleted a a", "Deleted b b", "Added dir/c dir/c", "Added moved/a moved/a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("gitDiffs with diff.renames=false: got %q, want %q", got, want)
+	}
+	f.SetConfig("diff.renames", "true")
+	if err := f.SetConfig("scrutinize.renameThreshold", "80%"); err != nil {
+		t.Fatal(err)
+	}
+	if opts, err := f.gitDiffOptions(); err != nil || !opts.Renames || opts.RenameThreshold != 80 {
+		t.Errorf("gitDiffOptions: got %+v, %v", opts, err)
+	}
+	if got, want := diffs(), []string{"Deleted a a", "Deleted b b", "Added dir/c dir/c", "Added moved/a moved/a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("gitDiffs with a threshold of 80%%: got %q, want %q", got, want)
+	}
+	f.SetConfig("scrutinize.renameThreshold", "0")
+	if _, err := f.gitDiffs("", nil); err == nil {
+		t.Errorf("gitDiffs with a threshold of 0 succeeded")
+	}
+}
+
+func TestGitDiffOptions(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+
+	const conf = "[diff]\n\tignoreWhitespace = true\n\tcontext = 5\n\talgorithm = Patience\n\tignore = dir/ *.pb.go\n\tignore = vendor/\n"
+	if err := ioutil.WriteFile(filepath.Join(f.Workdir(), checkConfig), []byte(conf), 0666); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := f.gitDiffOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &DiffOptions{Renames: true, RenameThreshold: 50, CopyThreshold: 50, IgnoreWhitespace: true, Context: 5, Algorithm: "patience", Ignore: []string{"dir/", "*.pb.go", "vendor/"}}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("gitDiffOptions: got %+v, want %+v", opts, want)
+	}
+	deltas, err := f.gitDiffs("", nil)
+	if err != nil || len(deltas) != 2 || deltas[0].NewFile.Path != "a" || deltas[1].NewFile.Path != "b" {
+		t.Errorf("gitDiffs without dir/: got %v, %v", deltas, err)
+	}
+	// reports and mailed patches cover everything
+	if rep, err := f.gitReport(""); err != nil || len(rep.Files) != 3 {
+		t.Errorf("gitReport with ignored files: got %v, %v", rep, err)
+	}
+	var mbox bytes.Buffer
+	if err := f.gitMailExport("", &mbox); err != nil || !strings.Contains(mbox.String(), "+++ b/dir/c") {
+		t.Errorf("gitMailExport with ignored files: got %v\n%s", err, mbox.String())
+	}
+
+	// not even from the server's working directory
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(f.Workdir()); err != nil {
+		t.Fatal(err)
+	}
+	bare := &gitContext{Repo: bareRepo{f.Repo}, Name: "bare"}
+	if opts, err := bare.gitDiffOptions(); err != nil || opts.IgnoreWhitespace || opts.Ignore != nil {
+		t.Errorf("gitDiffOptions of a bare repository: got %+v, %v", opts, err)
+	}
+
+	opts, err = f.gitFormDiffOptions(url.Values{"ignoreWhitespace": {"false"}, "context": {"10"}, "ignore": {""}})
+	if err != nil || opts.IgnoreWhitespace || opts.Context != 10 || opts.Algorithm != "patience" || opts.Ignore != nil {
+		t.Errorf("gitFormDiffOptions: got %+v, %v", opts, err)
+	}
+	if patches, err := f.gitReviewPatches("", opts); err != nil || len(patches) != 3 {
+		t.Errorf("gitReviewPatches with the form's options: got %q, %v", patches, err)
+	}
+	for _, form := range []url.Values{{"context": {"0"}}, {"algorithm": {"bogus"}}, {"ignoreWhitespace": {"maybe"}}} {
+		if _, err := f.gitFormDiffOptions(form); err == nil {
+			t.Errorf("gitFormDiffOptions(%v) succeeded", form)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(f.Workdir(), checkConfig), []byte("[diff]\n\tcolor = true\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.gitDiffs("", nil); err == nil {
+		t.Errorf("gitDiffs with an unknown diff option succeeded")
+	}
+}
+
+func TestServeDiffs(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+	ts, stop := newTestServer(t, nil, f.gitContext)
+	defer stop()
+
+	if status, body := ts.do("GET", "/r/test/diffs?context=1&ignore=dir/", nil); status != http.StatusOK || !strings.Contains(body, "-two\n") || strings.Contains(body, "sea") || !strings.Contains(body, `value="dir/"`) {
+		t.Errorf("GET /r/test/diffs with options: got %d\n%s", status, body)
+	}
+	status, body := ts.do("GET", "/r/test/api/v1/diffs?review=&ignore=*/c", nil)
+	var diffs []*FileDiff
+	if status != http.StatusOK || json.Unmarshal([]byte(body), &diffs) != nil || len(diffs) != 2 || diffs[0].Path != "a" || !strings.Contains(diffs[0].Patch, "+2\n") || diffs[1].Status != "Deleted" {
+		t.Errorf("GET /r/test/api/v1/diffs: got %d %s", status, body)
+	}
+	if status, body := ts.do("GET", "/r/test/api/v1/diffs?review=&context=none", nil); status != http.StatusBadRequest {
+		t.Errorf("GET /r/test/api/v1/diffs with a bad context: got %d %s", status, body)
+	}
+}
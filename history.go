@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A FileVersion is a commit in a review that changes a file, and what it changes.
+type FileVersion struct {
+	Commit   *Commit
+	Status   Delta
+	Path     string // the path of the file after the commit
+	OldPath  string // the path before, if the commit renames the file
+	Patch    string // "" if the file is only moved
+	Messages []*Message
+}
+
+// gitFileHistory returns the commits of review that change the file at p, newest first,
+// following it back through renames, with the comments on the file at each of them.
+// Besides the renames the backend reports, a file that is removed in the same commit as
+// one with the same contents is added counts as renamed.
+func (g *gitContext) gitFileHistory(review, p string) ([]*FileVersion, error) {
+	log, err := g.gitLog(review)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := g.gitNotes(review)
+	if err != nil {
+		return nil, err
+	}
+	r, err := g.gitFileVersions(log, p, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range r {
+		for _, msg := range notes[v.Commit.Id().String()] {
+			if strings.TrimPrefix(msg.Header.Get("File"), "/") == v.Path {
+				v.Messages = append(v.Messages, msg)
+			}
+		}
+	}
+	return r, nil
+}
+
+// gitFileVersions does the walk of gitFileHistory over log, without the messages,
+// and without the patches unless asked for, which only needs to compare trees.
+func (g *gitContext) gitFileVersions(log []*Commit, p string, patches bool) ([]*FileVersion, error) {
+	empty, err := NewOid(emptyTree)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := g.gitDiffOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts.Ignore = nil // asked for by path, even if the diffs leave it out
+
+	var r []*FileVersion
+	for _, c := range log {
+		otree := empty
+		if c.ParentCount() > 0 {
+			if otree, err = g.gitCommitTree(c.ParentId(0)); err != nil {
+				return nil, err
+			}
+		}
+		deltas, err := g.DiffTrees(otree, c.TreeId(), opts)
+		if err != nil {
+			return nil, err
+		}
+		i := -1
+		for j, d := range deltas {
+			if d.NewFile.Path == p {
+				i = j
+			}
+		}
+		if i < 0 {
+			continue
+		}
+		d := deltas[i]
+		v := &FileVersion{Commit: c, Status: d.Status, Path: p}
+		moved := false // renamed as it is, the patch shows nothing, or all of it as added
+		if d.Status == DeltaRenamed {
+			v.OldPath, moved = d.OldFile.Path, d.OldFile.Oid.Equal(d.NewFile.Oid)
+		} else if d.Status == DeltaAdded {
+			for _, o := range deltas {
+				if o.Status == DeltaDeleted && o.OldFile.Oid.Equal(d.NewFile.Oid) {
+					v.Status, v.OldPath, moved = DeltaRenamed, o.OldFile.Path, true
+				}
+			}
+		}
+		if patches && !moved {
+			patches, err := g.Patches(otree, c.TreeId(), opts)
+			if err != nil {
+				return nil, err
+			}
+			if len(patches) != len(deltas) {
+				return nil, fmt.Errorf("commit %s: %d patches for %d files", c.Id(), len(patches), len(deltas))
+			}
+			v.Patch = patches[i]
+		}
+		r = append(r, v)
+
+		switch {
+		case v.Status == DeltaRenamed:
+			p = v.OldPath
+		case v.Status == DeltaAdded:
+			return r, nil
+		}
+	}
+	return r, nil
+}
+
+// gitFilePaths returns the path that the file at p in the head of review has at each commit
+// of the review, by commit id, following it back through renames as gitFileHistory does.
+func (g *gitContext) gitFilePaths(review, p string) (map[string]string, error) {
+	log, err := g.gitLog(review)
+	if err != nil {
+		return nil, err
+	}
+	h, err := g.gitFileVersions(log, p, false)
+	if err != nil {
+		return nil, err
+	}
+	renames := map[string]string{}
+	for _, v := range h {
+		if v.Status == DeltaRenamed {
+			renames[v.Commit.Id().String()] = v.OldPath
+		}
+	}
+	r := map[string]string{}
+	for _, c := range log {
+		r[c.Id().String()] = p
+		if old, ok := renames[c.Id().String()]; ok {
+			p = old
+		}
+	}
+	return r, nil
+}
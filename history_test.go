@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGitFileHistory(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+	c3 := f.commit("topic", "Move dir/c to dir/d", map[string]string{"dir/c": "", "dir/d": strings.Repeat("sea\n", 3)})
+	c4 := f.commit("topic", "Change dir/d", map[string]string{"dir/d": "sea\nsee\nsea\n"})
+	f.comment("", f.c2, "Alice <alice@example.com>", "why c?", "File", "dir/c", "Line", "1")
+	f.comment("", c4, "Alice <alice@example.com>", "see?", "File", "dir/d", "Line", "2")
+	f.comment("", c4, "Alice <alice@example.com>", "not this one", "File", "a")
+
+	h, err := f.gitFileHistory("", "dir/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type version struct {
+		commit        Oid
+		status        Delta
+		path, oldPath string
+		patch         bool
+		messages      int
+	}
+	want := []version{
+		{*c4, DeltaModified, "dir/d", "", true, 1},
+		{*c3, DeltaRenamed, "dir/d", "dir/c", false, 0},
+		{*f.c2, DeltaAdded, "dir/c", "", true, 1},
+	}
+	if len(h) != len(want) {
+		t.Fatalf("gitFileHistory: got %d versions, want %d", len(h), len(want))
+	}
+	for i, v := range h {
+		got := version{*v.Commit.Id(), v.Status, v.Path, v.OldPath, v.Patch != "", len(v.Messages)}
+		if got != want[i] {
+			t.Errorf("gitFileHistory[%d]: got %+v, want %+v", i, got, want[i])
+		}
+	}
+	if !strings.Contains(h[0].Patch, "+see") || strings.Contains(h[0].Patch, "a/a") {
+		t.Errorf("gitFileHistory: patch of another file or none:\n%s", h[0].Patch)
+	}
+
+	if h, err := f.gitFileHistory("", "b"); err != nil || len(h) != 1 || h[0].Status != DeltaDeleted {
+		t.Errorf("gitFileHistory of a removed file: got %v, %v", h, err)
+	}
+	if h, err := f.gitFileHistory("", "nope"); err != nil || len(h) != 0 {
+		t.Errorf("gitFileHistory of an unknown file: got %v, %v", h, err)
+	}
+}
+
+func TestServeHistory(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+	ts, stop := newTestServer(t, nil, f.gitContext)
+	defer stop()
+
+	if status, body := ts.do("GET", "/r/test/history?file=a", nil); status != http.StatusOK || !strings.Contains(body, "Modified a") || !strings.Contains(body, "Change a") {
+		t.Errorf("GET /r/test/history?file=a: got %d\n%s", status, body)
+	}
+	if status, body := ts.do("GET", "/r/test/history?file=nope", nil); status != http.StatusOK || !strings.Contains(body, "No commit in the review changes nope") {
+		t.Errorf("GET /r/test/history?file=nope: got %d\n%s", status, body)
+	}
+	id, err := f.gitBlobId("", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := ts.do("GET", "/r/test/blob/"+id.String()+"?dir=&name=a", nil); status != http.StatusOK || !strings.Contains(body, "/r/test/history?file=a") {
+		t.Errorf("GET the blob page of a: got %d\n%s", status, body)
+	}
+}
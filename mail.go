@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reviews go over a mailing list the way git format-patch and send-email do it: a cover
+// letter, a mail per commit with its patch, and the comments as replies quoting the lines
+// they are about.  Mails are encoded with textproto like the notes, in an mboxrd file.
+
+// The Message-Id of the mail with the patch of a commit, or of the cover letter for the head,
+// in review.  mail import finds the commit a reply is about from its In-Reply-To.
+func patchMailId(review, commit string, cover bool) string {
+	if cover {
+		return fmt.Sprintf("<cover.%s.%s@scrutinize>", commit, review)
+	}
+	return fmt.Sprintf("<%s.%s@scrutinize>", commit, review)
+}
+
+var patchMailIdRe = regexp.MustCompile(`<(?:cover\.)?([0-9a-f]{40})\.[^>]*@scrutinize>`)
+
+// The Message-Id of the mail with a review message.
+func commentMailId(msg *Message) string {
+	return fmt.Sprintf("<%s@scrutinize>", msg.Header.Get("Message-Id"))
+}
+
+// mboxFromRe matches the lines mboxrd escapes with a >.
+var mboxFromRe = regexp.MustCompile(`^>*From `)
+
+// writeMail writes msg as an mboxrd entry: a From line, the header and the body.
+func writeMail(w io.Writer, from string, msg *Message) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "From %s Mon Sep 17 00:00:00 2001\n", from) // like git format-patch
+	var keys []string
+	for k := range msg.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range msg.Header[k] {
+			fmt.Fprintf(bw, "%s: %s\n", k, canonicalValue(v))
+		}
+	}
+	fmt.Fprintln(bw)
+	for _, l := range strings.Split(strings.TrimRight(canonicalBody(msg.Body), "\n"), "\n") {
+		if mboxFromRe.MatchString(l) {
+			l = ">" + l
+		}
+		fmt.Fprintln(bw, l)
+	}
+	fmt.Fprintln(bw)
+	return bw.Flush()
+}
+
+// readMbox reads the mails in an mboxrd file, or a single mail without From line,
+// with their bodies decoded to text.
+func readMbox(r io.Reader) ([]*Message, error) {
+	var (
+		mails []string
+		cur   []string
+		prev  = ""
+	)
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<24)
+	for n := 0; s.Scan(); n++ {
+		l := s.Text()
+		if strings.HasPrefix(l, "From ") && (n == 0 || prev == "") {
+			if len(cur) > 0 {
+				mails = append(mails, strings.Join(cur, "\n"))
+			}
+			cur = nil
+			prev = l
+			continue
+		}
+		if mboxFromRe.MatchString(l) && strings.HasPrefix(l, ">") {
+			l = l[1:]
+		}
+		cur = append(cur, l)
+		prev = l
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(cur) > 0 {
+		mails = append(mails, strings.Join(cur, "\n"))
+	}
+
+	var msgs []*Message
+	for _, m := range mails {
+		tr := textproto.NewReader(bufio.NewReader(strings.NewReader(m + "\n")))
+		hdr, err := tr.ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		raw, err := ioutil.ReadAll(tr.R)
+		if err != nil {
+			return nil, err
+		}
+		body, err := mailText(hdr, raw)
+		if err != nil {
+			return nil, fmt.Errorf("mail %s: %v", hdr.Get("Message-Id"), err)
+		}
+		msgs = append(msgs, &Message{Header: hdr, Body: body})
+	}
+	return msgs, nil
+}
+
+// mailText returns the text of a mail body: decoded, and the first text/plain part
+// if it is multipart.
+func mailText(hdr textproto.MIMEHeader, raw []byte) (string, error) {
+	var r io.Reader = bytes.NewReader(raw)
+	switch strings.ToLower(hdr.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, &newlineSkipper{r})
+	}
+	mt, params, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mt, "multipart/") {
+		b, err := ioutil.ReadAll(r)
+		return strings.Replace(string(b), "\r\n", "\n", -1), err
+	}
+	mr := multipart.NewReader(r, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		pt, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if pt != "" && pt != "text/plain" && !strings.HasPrefix(pt, "multipart/") {
+			continue
+		}
+		b, err := ioutil.ReadAll(p)
+		if err != nil {
+			return "", err
+		}
+		return mailText(textproto.MIMEHeader(p.Header), b)
+	}
+}
+
+// newlineSkipper drops the line breaks in base64 encoded bodies.
+type newlineSkipper struct{ r io.Reader }
+
+func (n *newlineSkipper) Read(p []byte) (int, error) {
+	c, err := n.r.Read(p)
+	j := 0
+	for _, b := range p[:c] {
+		if b != '\r' && b != '\n' {
+			p[j] = b
+			j++
+		}
+	}
+	return j, err
+}
+
+// quotePatch returns the lines of patch, the one for a file from gitPatches, that
+// lead up to line in the new version of the file: the file header, the hunk header
+// and up to context lines before it.  It returns nil if line is not in the patch.
+func quotePatch(patch string, line, context int) []string {
+	var (
+		header []string
+		hunk   []string
+		ln     = 0
+	)
+	for _, l := range strings.Split(strings.TrimSuffix(patch, "\n"), "\n") {
+		if m := hunkRe.FindStringSubmatch(l); m != nil {
+			ln, _ = strconv.Atoi(m[1])
+			hunk = []string{l}
+			continue
+		}
+		if ln == 0 {
+			header = append(header, l)
+			continue
+		}
+		hunk = append(hunk, l)
+		if strings.HasPrefix(l, "-") || strings.HasPrefix(l, `\`) {
+			continue
+		}
+		if ln == line {
+			body := hunk[1:]
+			if len(body) > context+1 {
+				body = body[len(body)-context-1:]
+			}
+			return append(append(header, hunk[0]), body...)
+		}
+		ln++
+	}
+	return nil
+}
+
+// mailDate formats the Date header of msg for a mail.
+func mailDate(msg *Message) string {
+	return messageTime(msg).Format(time.RFC1123Z)
+}
+
+// gitMailExport writes the commits of review as a patch series to w, with the messages
+// in the review as replies.
+func (g *gitContext) gitMailExport(review string, w io.Writer) error {
+	rev, err := g.gitReview(review)
+	if err != nil {
+		return err
+	}
+	commits, err := g.gitLog(rev.Id)
+	if err != nil {
+		return err
+	}
+	head, err := g.gitHead(rev.Id)
+	if err != nil {
+		return err
+	}
+	notes, err := g.gitNotes(rev.Id)
+	if err != nil {
+		return err
+	}
+	byCommit := map[string][]*Thread{}
+	for _, t := range threads(notes) {
+		byCommit[t.Commit] = append(byCommit[t.Commit], t)
+	}
+	n := len(commits)
+
+	title := rev.Title
+	if title == "" {
+		title = rev.Id
+	}
+	cover := &Message{Header: textproto.MIMEHeader{}, Body: rev.Description}
+	cover.Header.Set("Subject", fmt.Sprintf("[PATCH 0/%d] %s", n, title))
+	cover.Header.Set("Message-Id", patchMailId(rev.Id, head.String(), true))
+	if me, err := g.gitAuthor(); err == nil {
+		cover.Header.Set("From", me)
+	}
+	cover.Header.Set("Date", time.Now().Format(time.RFC1123Z))
+	if err := writeMail(w, head.String(), cover); err != nil {
+		return err
+	}
+	onCover := byCommit[head.String()]
+	for _, v := range votes(notes) {
+		if v.Header.Get("File") == "" {
+			onCover = append(onCover, &Thread{Commit: v.Header.Get("Commit"), Messages: []*Message{v}})
+		}
+	}
+	if err := writeReplies(w, head.String(), cover, onCover, nil, true); err != nil {
+		return err
+	}
+
+	for i := range commits {
+		c := commits[n-1-i] // oldest first
+		msg := c.Message()
+		subject, body := msg, ""
+		if j := strings.Index(msg, "\n"); j >= 0 {
+			subject, body = msg[:j], strings.TrimLeft(msg[j:], "\n")
+		}
+		var patches []string
+		if c.ParentCount() > 0 {
+			// plain patches, whatever the diffs page shows, for git am
+			if patches, err = g.gitPatches(c.ParentId(0), c.Id(), &DiffOptions{}); err != nil {
+				return err
+			}
+		}
+		pm := &Message{Header: textproto.MIMEHeader{}, Body: body + "---\n" + strings.Join(patches, "") + "-- \nscrutinize\n"}
+		pm.Header.Set("From", fmt.Sprintf("%s <%s>", c.Author().Name, c.Author().Email))
+		pm.Header.Set("Date", c.Author().When.Format(time.RFC1123Z))
+		pm.Header.Set("Subject", fmt.Sprintf("[PATCH %d/%d] %s", i+1, n, subject))
+		pm.Header.Set("Message-Id", patchMailId(rev.Id, c.Id().String(), false))
+		pm.Header.Set("In-Reply-To", cover.Header.Get("Message-Id"))
+		pm.Header.Set("References", cover.Header.Get("Message-Id"))
+		if err := writeMail(w, c.Id().String(), pm); err != nil {
+			return err
+		}
+		ths := byCommit[c.Id().String()]
+		if c.Id().Equal(head) {
+			ths = nil // the ones on the commit as a whole went on the cover letter
+			for _, t := range byCommit[c.Id().String()] {
+				if t.File != "" {
+					ths = append(ths, t)
+				}
+			}
+		}
+		if err := writeReplies(w, c.Id().String(), pm, ths, patches, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeReplies writes the messages in threads as replies to the mail parent, each quoting
+// the lines of patches it is on.  Commit-level threads go on the cover letter if isCover,
+// on the patch otherwise.  Votes become Reviewed-by and Nacked-by trailers.
+func writeReplies(w io.Writer, from string, parent *Message, threads []*Thread, patches []string, isCover bool) error {
+	for _, t := range threads {
+		if isCover && t.File != "" {
+			continue // they go with the patch
+		}
+		inReplyTo := parent.Header.Get("Message-Id")
+		for _, msg := range t.Messages {
+			var quoted []string
+			if t.File != "" {
+				line, _ := strconv.Atoi(t.Line)
+				for _, p := range patches {
+					if !strings.Contains(p, "\n+++ b/"+t.File+"\n") && !strings.HasPrefix(p, "diff --git a/"+t.File+" ") {
+						continue
+					}
+					if line == 0 {
+						quoted = strings.Split(strings.SplitN(p, "\n@@", 2)[0], "\n")
+					} else {
+						quoted = quotePatch(p, line, 3)
+					}
+				}
+			}
+			body := ""
+			if quoted != nil {
+				body = "> " + strings.Join(quoted, "\n> ") + "\n\n"
+			} else if t.File != "" {
+				body = fmt.Sprintf("On %s:%s:\n\n", t.File, t.Line)
+			}
+			body += strings.TrimRight(msg.Body, "\n") + "\n"
+			switch msg.Header.Get("Vote") {
+			case "approve":
+				body += "\nReviewed-by: " + msg.Header.Get("Author") + "\n"
+			case "reject":
+				body += "\nNacked-by: " + msg.Header.Get("Author") + "\n"
+			}
+			if t.Resolved && msg == t.Messages[len(t.Messages)-1] {
+				body += "\n(resolved)\n"
+			}
+
+			rm := &Message{Header: textproto.MIMEHeader{}, Body: body}
+			rm.Header.Set("From", msg.Header.Get("Author"))
+			rm.Header.Set("Date", mailDate(msg))
+			rm.Header.Set("Subject", "Re: "+parent.Header.Get("Subject"))
+			rm.Header.Set("Message-Id", commentMailId(msg))
+			rm.Header.Set("In-Reply-To", inReplyTo)
+			rm.Header.Set("References", strings.TrimSpace(parent.Header.Get("References")+" "+parent.Header.Get("Message-Id")))
+			rm.Header.Set("X-Scrutinize-Message-Id", msg.Header.Get("Message-Id"))
+			if err := writeMail(w, from, rm); err != nil {
+				return err
+			}
+			inReplyTo = rm.Header.Get("Message-Id")
+		}
+	}
+	return nil
+}
+
+var (
+	subjectRe = regexp.MustCompile(`^(?i:(?:re|aw|sv):\s*)*(?:\[[^\]]*\]\s*)?`)
+	trailerRe = regexp.MustCompile(`^(Reviewed-by|Acked-by|Nacked-by):\s*(.*)$`)
+)
+
+// mailCommit returns the commit a reply is about, from the patch mail id in its In-Reply-To
+// or References, or else by its subject from summaries, which maps commit summaries to ids.
+func mailCommit(msg *Message, summaries map[string]string) string {
+	for _, k := range []string{"In-Reply-To", "References"} {
+		if m := patchMailIdRe.FindStringSubmatch(msg.Header.Get(k)); m != nil {
+			return m[1]
+		}
+	}
+	return summaries[strings.TrimSpace(subjectRe.ReplaceAllString(msg.Header.Get("Subject"), ""))]
+}
+
+// mailComments parses the inline replies in msg, a mail about commit.  Text after quoted
+// lines of a patch is a comment on the last of those lines, text before any is about the
+// commit as a whole.  The signature, quoted text that isn't a patch and "X wrote:" lines
+// are left out.
+func mailComments(msg *Message, commit string) ([]*forgeComment, error) {
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return nil, fmt.Errorf("From: %v", err)
+	}
+	date, err := mail.ParseDate(msg.Header.Get("Date"))
+	if err != nil {
+		return nil, fmt.Errorf("Date: %v", err)
+	}
+	author := fmt.Sprintf("%s <%s>", from.Name, from.Address)
+	if from.Name == "" {
+		author = fmt.Sprintf("%s <%s>", from.Address, from.Address)
+	}
+
+	var (
+		r          []*forgeComment
+		text       []string
+		file       string
+		ln, last   int // next and last quoted line in the new version of file
+		inPatch    bool
+		commentNum int
+	)
+	flush := func() {
+		for len(text) > 0 && strings.TrimSpace(text[len(text)-1]) == "" {
+			text = text[:len(text)-1]
+		}
+		for len(text) > 0 && strings.TrimSpace(text[0]) == "" {
+			text = text[1:]
+		}
+		if len(text) == 0 {
+			return
+		}
+		c := &forgeComment{
+			origin: fmt.Sprintf("mail:%s#%d", strings.Trim(msg.Header.Get("Message-Id"), "<>"), commentNum),
+			author: author,
+			date:   date,
+			commit: commit,
+			body:   strings.Join(text, "\n") + "\n",
+		}
+		if inPatch {
+			c.file, c.line = file, last
+		}
+		for _, l := range text {
+			if m := trailerRe.FindStringSubmatch(strings.TrimSpace(l)); m != nil {
+				if a, err := mail.ParseAddress(m[2]); err == nil && a.Address == from.Address {
+					c.vote = "approve"
+					if m[1] == "Nacked-by" {
+						c.vote = "reject"
+					}
+				}
+			}
+		}
+		r = append(r, c)
+		commentNum++
+		text = nil
+	}
+
+	for _, l := range strings.Split(msg.Body, "\n") {
+		if l == "-- " {
+			break
+		}
+		if !strings.HasPrefix(l, ">") {
+			text = append(text, l)
+			continue
+		}
+		if len(text) > 0 && strings.HasSuffix(strings.TrimSpace(text[len(text)-1]), "wrote:") {
+			text = text[:len(text)-1]
+		}
+		flush()
+		q := strings.TrimPrefix(l, ">")
+		if strings.HasPrefix(q, " ") {
+			q = q[1:]
+		}
+		switch {
+		case strings.HasPrefix(q, "diff --git "):
+			f := strings.Fields(q)
+			file, inPatch, ln, last = strings.TrimPrefix(f[len(f)-1], "b/"), true, 0, 0
+		case strings.HasPrefix(q, "+++ ") && ln == 0:
+			if p := strings.TrimPrefix(q[4:], "b/"); p != "/dev/null" {
+				file, inPatch = p, true
+			}
+		case hunkRe.MatchString(q):
+			ln, _ = strconv.Atoi(hunkRe.FindStringSubmatch(q)[1])
+			last = 0
+		case ln > 0 && strings.HasPrefix(q, "-"):
+			last = ln
+		case ln > 0 && (q == "" || strings.HasPrefix(q, "+") || strings.HasPrefix(q, " ")):
+			last = ln
+			ln++
+		}
+	}
+	flush()
+	return r, nil
+}
+
+// gitMailImport adds the comments in the replies in mails to review, skipping the mails
+// that came from scrutinize itself.
+func (g *gitContext) gitMailImport(review string, mails []*Message, log io.Writer) (added, total int, err error) {
+	commits, err := g.gitLog(review)
+	if err != nil {
+		return 0, 0, err
+	}
+	summaries := map[string]string{}
+	for _, c := range commits {
+		summaries[c.Summary()] = c.Id().String()
+	}
+	var comments []*forgeComment
+	for _, m := range mails {
+		if m.Header.Get("X-Scrutinize-Message-Id") != "" || patchMailIdRe.MatchString(m.Header.Get("Message-Id")) {
+			continue // exported by us
+		}
+		commit := mailCommit(m, summaries)
+		if commit == "" {
+			fmt.Fprintf(log, "skipping %s %q: no commit in the review it replies to\n", m.Header.Get("Message-Id"), m.Header.Get("Subject"))
+			continue
+		}
+		if _, err := NewOid(commit); err != nil {
+			return 0, 0, err
+		}
+		cs, err := mailComments(m, commit)
+		if err != nil {
+			fmt.Fprintf(log, "skipping %s: %v\n", m.Header.Get("Message-Id"), err)
+			continue
+		}
+		comments = append(comments, cs...)
+	}
+	added, err = g.gitImport(review, forgeMessages(comments), log)
+	return added, len(comments), err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"net/textproto"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMailComments(t *testing.T) {
+	f, err := os.Open("testdata/reply.mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	mails, err := readMbox(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mails) != 2 {
+		t.Fatalf("got %d mails, expected 2", len(mails))
+	}
+
+	summaries := map[string]string{"Frobnicate harder": "0123456789012345678901234567890123456789"}
+	if c := mailCommit(mails[0], summaries); c != "6dcb09b5b57875f334f61aebed695e2e4193db5e" {
+		t.Errorf("first reply is about %q, expected the commit in its In-Reply-To", c)
+	}
+	if c := mailCommit(mails[1], summaries); c != summaries["Frobnicate harder"] {
+		t.Errorf("second reply is about %q, expected the commit with its subject", c)
+	}
+
+	cs, err := mailComments(mails[0], "6dcb09b5b57875f334f61aebed695e2e4193db5e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type comment struct {
+		file string
+		line int
+		body string
+		vote string
+	}
+	var got []comment
+	for _, c := range cs {
+		got = append(got, comment{c.file, c.line, c.body, c.vote})
+	}
+	want := []comment{
+		{"", 0, "Thanks, looks mostly fine.\n", ""},
+		{"a.go", 3, "Why 3? It seems arbitrary.\nFrom the docs it should be 4.\n", ""},
+		{"a.go", 4, "Reviewed-by: Jane Doe <jane@example.com>\n", "approve"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got comments\n%+v\nexpected\n%+v", got, want)
+	}
+	if cs[0].author != "Jane Doe <jane@example.com>" || cs[0].origin == cs[1].origin {
+		t.Errorf("author %q, origins %q and %q", cs[0].author, cs[0].origin, cs[1].origin)
+	}
+}
+
+func TestQuotePatch(t *testing.T) {
+	got := quotePatch(testPatch, 3, 1)
+	want := []string{"diff --git a/a.go b/a.go", "--- a/a.go", "+++ b/a.go", "@@ -1,3 +1,4 @@", "+var x = 2", "+var y = 3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, expected %q", got, want)
+	}
+	if got := quotePatch(testPatch, 9, 1); got != nil {
+		t.Errorf("line outside the patch gave %q", got)
+	}
+}
+
+func TestMboxRoundTrip(t *testing.T) {
+	msg := &Message{Header: textproto.MIMEHeader{"Subject": {"[PATCH 1/1] x"}, "From": {"A <a@example.com>"}}, Body: "From here on\n>From there\nplain\n"}
+	var buf bytes.Buffer
+	if err := writeMail(&buf, "c0ffee", msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMail(&buf, "c0ffee", msg); err != nil {
+		t.Fatal(err)
+	}
+	mails, err := readMbox(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mails) != 2 {
+		t.Fatalf("got %d mails, expected 2:\n%s", len(mails), buf.String())
+	}
+	if got := strings.TrimRight(mails[1].Body, "\n"); got != strings.TrimRight(msg.Body, "\n") {
+		t.Errorf("body %q, expected %q", got, msg.Body)
+	}
+	if mails[1].Header.Get("Subject") != "[PATCH 1/1] x" {
+		t.Errorf("header %v", mails[1].Header)
+	}
+}
@@ -6,25 +6,29 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/lvdlvd/go-net-http-tmpl"
 	"github.com/lvdlvd/go-rest"
-
-	git "github.com/libgit2/git2go"
 )
 
 var (
-	verbose  = flag.Bool("debug", false, "be extra verbose")
-	refpfx   = flag.String("ref", "refs/notes/scrutinize", "Notes ref prefix to store review messages on.")
-	webroot  = flag.String("webroot", filepath.Join(findHome(), "s"), "Path to dir with static webpages.")
-	tmplroot = flag.String("tmplroot", filepath.Join(findHome(), "t"), "Path to dir with template webpages.")
-	baseline = flag.String("baseline", "refs/heads/master", ".git/refs path of branch to compare to.")
+	verbose    = flag.Bool("debug", false, "be extra verbose")
+	refpfx     = flag.String("ref", "refs/notes/scrutinize", "Notes ref prefix to store review messages on.")
+	webroot    = flag.String("webroot", filepath.Join(findHome(), "s"), "Path to dir with static webpages.")
+	tmplroot   = flag.String("tmplroot", filepath.Join(findHome(), "t"), "Path to dir with template webpages.")
+	baseline   = flag.String("baseline", "refs/heads/master", ".git/refs path of branch to compare to.")
+	signMsgs   = flag.Bool("sign", true, "Sign messages with the key in git config user.signingkey, if there is one.")
+	scan       = flag.String("scan", "", "Also serve the repositories in the subdirectories of this directory.")
+	reviewName = flag.String("review", "", "Name of the review of the current checkout, defaults to the branch HEAD is on (or a branch pointing at it, or its oid, if HEAD is detached). Only for one repository.")
 )
 
 var binHome string
@@ -52,10 +56,19 @@ func findHome() string {
 	return binHome
 }
 
-var repository *git.Repository
-
 func usage() {
-	fmt.Fprintln(os.Stderr, "Usage: git-scrutinize [options] [repo]")
+	fmt.Fprintln(os.Stderr, "Usage: git-scrutinize [options] [repo...]")
+	fmt.Fprintln(os.Stderr, "       git-scrutinize [options] command [arguments]")
+	fmt.Fprintln(os.Stderr, "Commands, run in the repository of the current directory:")
+	var names []string
+	for k := range commands {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\n    \t%s\n", k, commands[k].args, commands[k].short)
+	}
+	fmt.Fprintln(os.Stderr, "Options:")
 	flag.PrintDefaults()
 	os.Exit(2)
 }
@@ -65,64 +78,53 @@ func main() {
 	flag.Usage = usage
 	flag.Parse()
 
+	if cmd, ok := commands[flag.Arg(0)]; ok {
+		wd, err := os.Getwd()
+		if err != nil {
+			log.Fatal(err)
+		}
+		repo, err := openRepository(wd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := cmd.run(&gitContext{Repo: repo, Name: repoName(repo), review: *reviewName}, flag.Args()[1:]); err != nil {
+			log.Fatalf("%s: %v", flag.Arg(0), err)
+		}
+		return
+	}
+
 	if _, err := os.Stat(*webroot); err != nil {
 		log.Fatalf("%q can't find %s, probably mis-inferred %s as where i'm run from.", os.Args[0], *webroot, binHome)
 	}
 
-	var (
-		repo string
-		err  error
-	)
-
-	switch len(flag.Args()) {
-	case 0:
-		repo, err = os.Getwd()
+	paths := flag.Args()
+	if len(paths) == 0 && *scan == "" {
+		wd, err := os.Getwd()
 		if err != nil {
 			log.Fatal(err)
 		}
-	case 1:
-		repo = flag.Arg(0)
-	default:
-		flag.Usage()
+		paths = []string{wd}
 	}
-
-	repository, err = git.OpenRepositoryExtended(repo, 0, "/")
+	repos, err := openContexts(paths, *scan)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	log.Println("Git repository", repository.Path())
-
-	r := mux.NewRouter()
-	r.KeepContext = true // cleared in loghandler
-
-	th := tmpl.NewHandler(filepath.Join(*tmplroot, "*.html"), nil, tmplFuncs)
-
-	r.Path("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, "/commits", http.StatusMovedPermanently)
-	})
-
-	r.Path("/commits").Handler(substPath("commits.html", th))
-	r.PathPrefix("/tree/").Handler(substPath("tree.html", th))
-	r.Path("/blob/{oid}").Handler(substPath("blob.html", th)) // todo add pattern
-	r.Path("/diffs").Handler(substPath("diffs.html", th))
-	r.Path("/settings").Handler(substPath("settings.html", th))
-
-	api := r.PathPrefix("/api/v1").Subrouter()
-	all := rest.Everyone(rest.All)
-	api.Path("/commits/{commit}/notes").Handler(&rest.Handler{Auth: all, Post: http.HandlerFunc(postNote)})
+	if len(repos) == 0 {
+		log.Fatalf("No repositories in %s", *scan)
+	}
+	if *reviewName != "" {
+		// it names the review of one checkout, the submodules of that have their own
+		if len(paths) != 1 || *scan != "" {
+			log.Fatal("-review can only be used when serving one repository")
+		}
+		repos[0].review = *reviewName
+	}
+	for _, g := range repos {
+		log.Printf("Git repository %s on %s", g.Path(), g.root())
+	}
 
 	exit := make(chan bool)
-	r.Path("/quit").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "Bye...")
-		close(exit)
-	})
-
-	// debug/vars and debug/pprof are served by the default mux
-	r.PathPrefix("/debug/").Handler(http.DefaultServeMux)
-
-	// all paths that haven't been matched will be served as static files out of the webroot.
-	r.Methods("GET", "HEAD").Handler(http.FileServer(http.Dir(*webroot)))
+	r := newRouter(repos, exit)
 
 	// :0 lets the OS choose a port
 	ln, err := net.Listen("tcp", "localhost:0")
@@ -149,19 +151,132 @@ func main() {
 
 }
 
-// Invoke h after setting request path to path.
-// Saves the original path in mux var "path".
+// newRouter sets up the pages and the api of each of repos under /r/<name>/, a page to pick one
+// of them on /, and the static files of the UI. Requesting /quit closes exit.
+func newRouter(repos []*gitContext, exit chan bool) *mux.Router {
+	r := mux.NewRouter()
+	r.KeepContext = true // cleared in loghandler
+
+	fm := (*gitContext)(nil).repoFuncs(repos)
+	picker := (*gitContext)(nil).substPath("repos.html", tmpl.NewHandler(filepath.Join(*tmplroot, "*.html"), nil, fm))
+	r.Path("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(repos) == 1 {
+			http.Redirect(w, r, repos[0].root()+"/commits", http.StatusMovedPermanently)
+			return
+		}
+		picker(w, r)
+	})
+
+	// submodules are under their parent, and have to come first
+	byRoot := append([]*gitContext(nil), repos...)
+	sort.SliceStable(byRoot, func(i, j int) bool { return len(byRoot[i].root()) > len(byRoot[j].root()) })
+	for _, g := range byRoot {
+		g.routes(r.PathPrefix(g.root()+"/").Subrouter(), repos)
+	}
+
+	r.Path("/quit").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Bye...")
+		close(exit)
+	})
+
+	// debug/vars and debug/pprof are served by the default mux
+	r.PathPrefix("/debug/").Handler(http.DefaultServeMux)
+
+	// all paths that haven't been matched will be served as static files out of the webroot.
+	r.Methods("GET", "HEAD").Handler(http.FileServer(http.Dir(*webroot)))
+
+	return r
+}
+
+// routes sets up the pages and the api of g on r, which is under g.root().
+func (g *gitContext) routes(r *mux.Router, repos []*gitContext) {
+	th := tmpl.NewHandler(filepath.Join(*tmplroot, "*.html"), nil, g.repoFuncs(repos))
+
+	r.Path("/reviews").Handler(g.substPath("reviews.html", th))
+	r.Path("/commits").Handler(g.substPath("commits.html", th))
+	r.PathPrefix("/tree/").Handler(g.substPath("tree.html", th))
+	r.Path("/blob/{oid}").Handler(g.substPath("blob.html", th)) // todo add pattern
+	r.Path("/diffs").Handler(g.substPath("diffs.html", th))
+	r.Path("/history").Handler(g.substPath("history.html", th))
+	r.Path("/settings").Handler(g.substPath("settings.html", th))
+	r.Path("/pending").Handler(g.substPath("pending.html", th))
+	r.Path("/file").HandlerFunc(g.gotoFile)
+	r.Path("/export").HandlerFunc(g.exportReview)
+
+	api := r.PathPrefix("/api/v1").Subrouter()
+	all := rest.Everyone(rest.All)
+	api.Path("/commits/{commit}/notes").Handler(&rest.Handler{Auth: all, Post: http.HandlerFunc(g.postNote)})
+	api.Path("/drafts/publish").Handler(&rest.Handler{Auth: all, Post: http.HandlerFunc(g.postPublish)})
+	api.Path("/drafts/discard").Handler(&rest.Handler{Auth: all, Post: http.HandlerFunc(g.postDiscard)})
+	api.Path("/checks").Handler(&rest.Handler{Auth: all, Post: http.HandlerFunc(g.postChecks)})
+	api.Path("/submodules").Handler(&rest.Handler{Auth: all, Post: http.HandlerFunc(g.postSubmodule)})
+	api.Path("/diffs").Handler(&rest.Handler{Auth: all, Get: http.HandlerFunc(g.getDiffs)})
+	api.Path("/viewed").Handler(&rest.Handler{Auth: all, Post: http.HandlerFunc(g.postViewed)})
+	api.Path("/pending").Handler(&rest.Handler{Auth: all, Post: http.HandlerFunc(g.postPending)})
+	api.Path("/pending/anchor").Handler(&rest.Handler{Auth: all, Post: http.HandlerFunc(g.postAnchor)})
+	api.Path("/reviews").Handler(&rest.Handler{Auth: all, Get: http.HandlerFunc(g.getReviews), Post: http.HandlerFunc(g.postReview)})
+	api.Path("/reviews/{review:.+}").Handler(&rest.Handler{Auth: all, Get: http.HandlerFunc(g.getReview), Post: http.HandlerFunc(g.postReview)})
+}
+
+// Invoke h after setting request path to path, unless the review parameter is invalid.
+// Saves the original path, without g.root(), in mux var "path".
 // This is useful because the template handler looks at the url
 // path to invoke the template but we want to register under a path without the html.
 // TODO automate?
-func substPath(p string, h http.Handler) http.HandlerFunc {
+func (g *gitContext) substPath(p string, h http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		mux.Vars(r)["path"] = r.URL.Path
+		if review := r.FormValue("review"); review != "" {
+			if err := checkReviewId(review); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		mux.Vars(r)["path"] = strings.TrimPrefix(r.URL.Path, g.root())
 		r.URL.Path = p
 		h.ServeHTTP(w, r)
 	}
 }
 
+// Redirect to the blob page of a file by path, as it is in the head of the review.
+// This is where file:line references in messages link to.
+func (g *gitContext) gotoFile(w http.ResponseWriter, r *http.Request) {
+	review := r.FormValue("review")
+	p := strings.TrimPrefix(r.FormValue("path"), "/")
+	id, err := g.gitBlobId(review, p)
+	if err != nil {
+		reviewError(w, err, http.StatusNotFound)
+		return
+	}
+	q := url.Values{"dir": {""}, "name": {path.Base(p)}}
+	if d := path.Dir(p); d != "." {
+		q.Set("dir", d)
+	}
+	if review != "" {
+		q.Set("review", review)
+	}
+	http.Redirect(w, r, fmt.Sprintf("%s/blob/%s?%s", g.root(), id, q.Encode()), http.StatusFound)
+}
+
+// Serve the report of a review for download, see writeReport.
+func (g *gitContext) exportReview(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	f, ok := exportFormats[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown format %q, want md, html, json, github or gerrit", format), http.StatusBadRequest)
+		return
+	}
+	rep, err := g.gitReport(r.FormValue("review"))
+	if err != nil {
+		reviewError(w, err, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", f.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "review-"+path.Base(rep.Id)+"."+format))
+	if err := f.write(g, w, rep); err != nil {
+		log.Println(err)
+	}
+}
+
 // helper copied from golang.org/pkg/http
 type tcpKeepAliveListener struct{ *net.TCPListener }
 
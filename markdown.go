@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Comment bodies and descriptions are rendered as github flavoured markdown.
+// Goldmark's defaults keep it safe: raw HTML is dropped and so are links to
+// javascript: and other dangerous urls.  Fenced code blocks are highlighted,
+// and commit ids and file:line references become links into the review.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(
+		extension.GFM,
+		highlighting.NewHighlighting(highlighting.WithStyle("github")),
+	),
+	goldmark.WithParserOptions(
+		parser.WithASTTransformers(util.Prioritized(refLinker{}, 1000)),
+	),
+)
+
+var (
+	reviewKey = parser.NewContextKey()
+	repoKey   = parser.NewContextKey()
+)
+
+// renderMarkdown renders s for display in the context of review in g.
+// With a nil g, outside of the UI, commit ids are not linked.
+func (g *gitContext) renderMarkdown(review, s string) (template.HTML, error) {
+	pc := parser.NewContext()
+	pc.Set(reviewKey, review)
+	pc.Set(repoKey, g)
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(s), &buf, parser.WithContext(pc)); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+var (
+	oidRe      = regexp.MustCompile(`\b[0-9a-f]{7,40}\b`)
+	fileLineRe = regexp.MustCompile(`\b[\w][\w./-]*\.\w+:(\d+)\b`)
+)
+
+// refLinker replaces commit ids and file:line references in text with links.
+// Hex strings only count as commit ids if the repository has such a commit.
+type refLinker struct{}
+
+func (refLinker) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	review, _ := pc.Get(reviewKey).(string)
+	g, _ := pc.Get(repoKey).(*gitContext)
+	src := reader.Source()
+
+	var texts []*ast.Text
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		switch n.(type) {
+		case *ast.Link, *ast.AutoLink, *ast.CodeSpan, *ast.CodeBlock, *ast.FencedCodeBlock:
+			return ast.WalkSkipChildren, nil
+		case *ast.Text:
+			if entering {
+				texts = append(texts, n.(*ast.Text))
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	// the parser splits text at potential delimiters like _, join them back up
+	var runs []*ast.Text
+	for _, t := range texts {
+		if p, ok := t.PreviousSibling().(*ast.Text); ok && len(runs) > 0 && runs[len(runs)-1] == p &&
+			p.Segment.Stop == t.Segment.Start && !p.SoftLineBreak() && !p.HardLineBreak() {
+			p.Segment = p.Segment.WithStop(t.Segment.Stop)
+			p.SetSoftLineBreak(t.SoftLineBreak())
+			p.SetHardLineBreak(t.HardLineBreak())
+			t.Parent().RemoveChild(t.Parent(), t)
+			continue
+		}
+		runs = append(runs, t)
+	}
+
+	for _, t := range runs {
+		seg := t.Segment
+		val := seg.Value(src)
+		var (
+			parent = t.Parent()
+			pos    = 0
+			last   ast.Node
+		)
+		for _, m := range refMatches(val) {
+			dest := g.refLink(review, string(val[m[0]:m[1]]))
+			if dest == "" {
+				continue
+			}
+			if m[0] > pos {
+				parent.InsertBefore(parent, t, ast.NewTextSegment(text.NewSegment(seg.Start+pos, seg.Start+m[0])))
+			}
+			link := ast.NewLink()
+			link.Destination = []byte(dest)
+			link.AppendChild(link, ast.NewTextSegment(text.NewSegment(seg.Start+m[0], seg.Start+m[1])))
+			parent.InsertBefore(parent, t, link)
+			pos, last = m[1], link
+		}
+		if last == nil {
+			continue
+		}
+		if pos < len(val) || t.SoftLineBreak() || t.HardLineBreak() {
+			rest := ast.NewTextSegment(text.NewSegment(seg.Start+pos, seg.Stop))
+			rest.SetSoftLineBreak(t.SoftLineBreak())
+			rest.SetHardLineBreak(t.HardLineBreak())
+			parent.InsertBefore(parent, t, rest)
+		}
+		parent.RemoveChild(parent, t)
+	}
+}
+
+// refMatches returns the non-overlapping [start, end) of references in b, in order.
+func refMatches(b []byte) [][]int {
+	var r [][]int
+	fl := fileLineRe.FindAllIndex(b, -1)
+	for _, m := range fl {
+		r = append(r, m)
+	}
+	for _, m := range oidRe.FindAllIndex(b, -1) {
+		overlaps := false
+		for _, f := range fl {
+			if m[0] < f[1] && f[0] < m[1] {
+				overlaps = true
+			}
+		}
+		if !overlaps {
+			r = append(r, m)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i][0] < r[j][0] })
+	return r
+}
+
+// refLink returns the link into the UI for ref, or "" if it isn't one. Without a g,
+// as in a report that has to stand on its own, there is no UI to link to.
+func (g *gitContext) refLink(review, ref string) string {
+	if g == nil {
+		return ""
+	}
+	q := url.Values{}
+	if review != "" {
+		q.Set("review", review)
+	}
+	if m := fileLineRe.FindStringSubmatch(ref); m != nil {
+		q.Set("path", path.Clean(ref[:len(ref)-len(m[1])-1]))
+		return fmt.Sprintf("%s/file?%s#L%s", g.root(), q.Encode(), m[1])
+	}
+	id, err := g.Revparse(ref)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/commits?%s#%s", g.root(), q.Encode(), id)
+}
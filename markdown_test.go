@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		want     []string
+		dontwant []string
+	}{
+		{in: "*emphasis* and `code`", want: []string{"<em>emphasis</em>", "<code>code</code>"}},
+		{in: "- one\n- two\n", want: []string{"<ul>", "<li>one</li>"}},
+		{in: "<script>alert(1)</script>", dontwant: []string{"<script"}},
+		{in: `<a href="x" onclick="alert(1)">x</a>`, dontwant: []string{"onclick"}},
+		{in: "[click](javascript:alert(1))", dontwant: []string{"javascript:"}},
+		{in: "[docs](https://example.com/)", want: []string{`<a href="https://example.com/">docs</a>`}},
+		{in: "```go\nfunc main() {}\n```\n", want: []string{"<pre", "func"}},
+		{in: "see git.go:42 please", want: []string{"see git.go:42 please"}, dontwant: []string{"<a "}},
+	} {
+		got, err := (*gitContext)(nil).renderMarkdown("r", tc.in)
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		for _, w := range tc.want {
+			if !strings.Contains(string(got), w) {
+				t.Errorf("%q rendered as %q, expected it to contain %q", tc.in, got, w)
+			}
+		}
+		for _, w := range tc.dontwant {
+			if strings.Contains(string(got), w) {
+				t.Errorf("%q rendered as %q, expected it not to contain %q", tc.in, got, w)
+			}
+		}
+	}
+}
+
+func TestRenderMarkdownRoot(t *testing.T) {
+	g := &gitContext{Name: "myrepo"}
+	for _, tc := range []struct {
+		in       string
+		want     []string
+		dontwant []string
+	}{
+		{in: "see git.go:42 please", want: []string{`see <a href="/r/myrepo/file?path=git.go&amp;review=r#L42">git.go:42</a> please`}},
+		{in: "in `git.go:42` not linked", dontwant: []string{"<a "}},
+		{in: "see s/my_file.go:7\nand a.go:1\nb.go:2", want: []string{`>s/my_file.go:7</a>`, "a.go:1</a>\n<a"}},
+	} {
+		got, err := g.renderMarkdown("r", tc.in)
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		for _, w := range tc.want {
+			if !strings.Contains(string(got), w) {
+				t.Errorf("%q rendered as %q, expected it to contain %q", tc.in, got, w)
+			}
+		}
+		for _, w := range tc.dontwant {
+			if strings.Contains(string(got), w) {
+				t.Errorf("%q rendered as %q, expected it not to contain %q", tc.in, got, w)
+			}
+		}
+	}
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"net/textproto"
 	"sort"
@@ -11,24 +15,36 @@ import (
 type Message struct {
 	Header textproto.MIMEHeader
 	Body   string
-}
 
-var headerNewlineToSpace = strings.NewReplacer("\n", " ", "\r", " ")
+	// Earlier versions, oldest first, of a message that has been edited or retracted.
+	// Not stored, see foldEdits.
+	History []*Message
+}
 
+// WriteTo writes the canonical encoding of msg: header keys in canonical form and
+// sorted, values on one line without surrounding space or control characters, and
+// the body dot-encoded, see canonicalBody.
+// ReadMessage of the encoding gives back a message with the same encoding.
 func (msg *Message) WriteTo(w *bufio.Writer) error {
 	pw := textproto.NewWriter(w)
 
+	hdr := textproto.MIMEHeader{}
+	for k, vv := range msg.Header {
+		if !validHeaderKey(k) {
+			return fmt.Errorf("invalid header key %q", k)
+		}
+		k = textproto.CanonicalMIMEHeaderKey(k)
+		hdr[k] = append(hdr[k], vv...)
+	}
 	var keys []string
-	for k, _ := range msg.Header {
+	for k := range hdr {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
 
 	for _, k := range keys {
-		for _, v := range msg.Header[k] {
-			v = headerNewlineToSpace.Replace(v)
-			v = textproto.TrimString(v)
-			if err := pw.PrintfLine("%s: %s", k, v); err != nil {
+		for _, v := range hdr[k] {
+			if err := pw.PrintfLine("%s: %s", k, canonicalValue(v)); err != nil {
 				return err
 			}
 		}
@@ -38,12 +54,34 @@ func (msg *Message) WriteTo(w *bufio.Writer) error {
 	}
 
 	dw := pw.DotWriter()
-	if _, err := dw.Write([]byte(msg.Body)); err != nil {
+	if _, err := dw.Write([]byte(canonicalBody(msg.Body))); err != nil {
 		return err
 	}
 	return dw.Close()
 }
 
+// canonicalValue replaces control characters in v by spaces and trims it.
+func canonicalValue(v string) string {
+	v = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, v)
+	return textproto.TrimString(v)
+}
+
+// canonicalBody returns s with \n line endings, ending in a newline.
+// The dot encoding can't tell an empty body from a single newline.
+func canonicalBody(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	s = strings.Replace(s, "\r", "\n", -1)
+	if !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	return s
+}
+
 func ReadMessage(r *bufio.Reader) (msg *Message, err error) {
 	pr := textproto.NewReader(r)
 	hdr, err := pr.ReadMIMEHeader()
@@ -59,6 +97,79 @@ func ReadMessage(r *bufio.Reader) (msg *Message, err error) {
 	return &Message{Header: hdr, Body: string(b)}, nil
 }
 
+// newMessageId returns a fresh value for a Message-Id header.
+func newMessageId() string { return hex.EncodeToString(mustRand(12)) }
+
+// legacyMessageId makes up a Message-Id for messages written before they had one,
+// from their contents so that it stays the same.
+func legacyMessageId(msg *Message) string {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	msg.WriteTo(w)
+	w.Flush()
+	h := sha1.Sum(buf.Bytes())
+	return hex.EncodeToString(h[:12])
+}
+
+// Headers that an edit can not change.
+var anchorHeaders = []string{"Author", "Date", "Message-Id", "Supersedes", "Commit", "Review", "File", "Line"}
+
+// foldEdits applies the messages with a Supersedes: <Message-Id> header to the message
+// they edit, in place, keeping the previous version in its History. Headers of the
+// edit other than the anchorHeaders override those of the message.
+// An edit with Retracted: true withdraws the message, leaving it with an empty body.
+// Only the Author of a message can edit it, edits by others are dropped, as are
+// edits of messages that aren't there and unverified edits of verified messages.
+// Edits of edits apply to the original.
+func foldEdits(msgs []*Message) []*Message {
+	var (
+		r    []*Message
+		byId = map[string]*Message{}
+	)
+	for _, msg := range msgs {
+		sup := msg.Header.Get("Supersedes")
+		if sup == "" {
+			r = append(r, msg)
+			byId[msg.Header.Get("Message-Id")] = msg
+			continue
+		}
+		orig := byId[sup]
+		if orig == nil || orig.Header.Get("Author") != msg.Header.Get("Author") {
+			continue
+		}
+		if orig.Header.Get("Signature-Status") == sigVerified && msg.Header.Get("Signature-Status") != sigVerified {
+			continue // anyone can write an Author header, but not sign as them
+		}
+
+		prev := &Message{Header: textproto.MIMEHeader{}, Body: orig.Body}
+		for k, v := range orig.Header {
+			prev.Header[k] = v
+		}
+		orig.History = append(orig.History, prev)
+
+		hdr := textproto.MIMEHeader{}
+		for k, v := range orig.Header {
+			hdr[k] = v
+		}
+	next:
+		for k, v := range msg.Header {
+			for _, a := range anchorHeaders {
+				if k == a {
+					continue next
+				}
+			}
+			hdr[k] = v
+		}
+		hdr.Set("Edited", msg.Header.Get("Date"))
+		orig.Header, orig.Body = hdr, msg.Body
+		if hdr.Get("Retracted") == "true" {
+			orig.Body = ""
+		}
+		byId[msg.Header.Get("Message-Id")] = orig
+	}
+	return r
+}
+
 // func getMessages() ([]*Message, error) {
 // 	notes, err := gitNotesList(*ref)
 // 	if err != nil {
@@ -64,3 +64,144 @@ and a dot
 	}
 
 }
+
+func TestFoldEdits(t *testing.T) {
+	msg := func(id, author, body string, kv ...string) *Message {
+		m := &Message{Header: textproto.MIMEHeader{}, Body: body}
+		m.Header.Set("Message-Id", id)
+		m.Header.Set("Author", author)
+		m.Header.Set("File", "a.go")
+		for i := 0; i+1 < len(kv); i += 2 {
+			m.Header.Set(kv[i], kv[i+1])
+		}
+		return m
+	}
+
+	msgs := foldEdits([]*Message{
+		msg("1", "alice", "tpyo"),
+		msg("2", "bob", "looks good", "Vote", "approve"),
+		msg("3", "alice", "typo", "Supersedes", "1", "Date", "later"),
+		msg("4", "bob", "hijacked", "Supersedes", "1"),
+		msg("5", "alice", "typo!", "Supersedes", "3", "File", "b.go"),
+		msg("6", "bob", "", "Supersedes", "2", "Retracted", "true"),
+		msg("7", "bob", "dangling", "Supersedes", "99"),
+	})
+
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, expected 2", len(msgs))
+	}
+	if m := msgs[0]; m.Body != "typo!" || len(m.History) != 2 || m.History[0].Body != "tpyo" || m.History[1].Body != "typo" {
+		t.Errorf("edited message: %q with %d earlier versions", m.Body, len(m.History))
+	}
+	if m := msgs[0]; m.Header.Get("Message-Id") != "1" || m.Header.Get("File") != "a.go" || m.Header.Get("Supersedes") != "" {
+		t.Errorf("edit changed the anchor headers: %v", m.Header)
+	}
+	if m := msgs[0]; m.History[1].Header.Get("Edited") != "later" {
+		t.Errorf("edit time is %q, expected %q", m.History[1].Header.Get("Edited"), "later")
+	}
+	if m := msgs[1]; m.Header.Get("Retracted") != "true" || m.Body != "" || m.Header.Get("Vote") != "approve" || len(m.History) != 1 {
+		t.Errorf("retracted message: %v %q", m.Header, m.Body)
+	}
+}
+
+func encode(t *testing.T, msg *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := msg.WriteTo(w); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func FuzzMessageRoundTrip(f *testing.F) {
+	f.Add("Status", "resolved", "a body\n.\nwith a dot\n")
+	f.Add("file", " /a/../b.go ", "no newline")
+	f.Add("X-Thing", "tab\there\r\nand newline", "crlf\r\nbody\r")
+	f.Add("Vote", "", "")
+	f.Add("Author", "Ünïcödé <u@example.com>", ".\n..\n")
+	f.Fuzz(func(t *testing.T, key, value, body string) {
+		msg := &Message{Header: textproto.MIMEHeader{key: {value}}, Body: body}
+		b, err := encode(t, msg)
+		if err != nil {
+			if validHeaderKey(key) {
+				t.Fatalf("WriteTo(%q: %q): %v", key, value, err)
+			}
+			return
+		}
+		msg2, err := ReadMessage(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil {
+			t.Fatalf("ReadMessage(%q): %v", b, err)
+		}
+		if got, want := msg2.Header.Get(key), canonicalValue(value); got != want {
+			t.Errorf("header %q: got %q, expected %q", key, got, want)
+		}
+		if got, want := msg2.Body, canonicalBody(body); got != want {
+			t.Errorf("body: got %q, expected %q", got, want)
+		}
+		b2, err := encode(t, msg2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, b2) {
+			t.Errorf("encoding is not canonical:\n%q\nre-encoded as\n%q", b, b2)
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() textproto.MIMEHeader {
+		return textproto.MIMEHeader{
+			"Scrutinize-Version": {messageVersion},
+			"Author":             {"A U Thor <author@example.com>"},
+			"Date":               {"2016-05-04T12:00:00Z"},
+			"Message-Id":         {"0123456789abcdef01234567"},
+		}
+	}
+	for _, tc := range []struct {
+		kv     []string
+		client bool // as posted by a client, without the server headers
+		ok     bool
+	}{
+		{ok: true},
+		{kv: []string{"File", "a/b.go", "Line", "12", "Status", "open"}, ok: true},
+		{kv: []string{"File", "/a/b.go"}},
+		{kv: []string{"File", "a/../b.go"}},
+		{kv: []string{"Line", "-1"}},
+		{kv: []string{"Line", "012"}},
+		{kv: []string{"Vote", "maybe"}},
+		{kv: []string{"Supersedes", "not hex"}},
+		{kv: []string{"Commit", "0123abcd"}},
+		{kv: []string{"Frobnicate", "yes"}},
+		{kv: []string{"Date", "yesterday"}},
+		{kv: []string{"Kind", "review", "Id", "x", "Branch", "a", "Branch", "b"}, ok: true},
+		{kv: []string{"Status", "open", "Status", "resolved"}},
+		{kv: []string{"Vote", "approve", "Supersedes", "abc123"}, client: true, ok: true},
+		{kv: []string{"Author", "someone else"}, client: true},
+		{kv: []string{"Kind", "review"}, client: true},
+		{kv: []string{"Signature-Status", "verified"}, client: true},
+	} {
+		hdr := textproto.MIMEHeader{}
+		if !tc.client {
+			hdr = valid()
+		}
+		for i := 0; i+1 < len(tc.kv); i += 2 {
+			if tc.kv[i] == "Date" || tc.kv[i] == "Author" && !tc.client {
+				hdr.Set(tc.kv[i], tc.kv[i+1])
+			} else {
+				hdr.Add(tc.kv[i], tc.kv[i+1])
+			}
+		}
+		var err error
+		if tc.client {
+			err = validateClient(hdr)
+		} else {
+			err = (&Message{Header: hdr}).Validate()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%v: got error %v, expected ok: %v", tc.kv, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/textproto"
+	"path"
+	"strings"
+)
+
+// migrateMessage returns msg, as read from a note, rewritten into the current schema:
+// with a Message-Id and Scrutinize-Version, a relative File path, and without empty
+// headers or the ones gitNotes adds.  The Message-Id is the one gitNotes makes up for
+// messages without one, so that edits referring to it still apply.
+// Signed messages are returned as they are, changing them would break the signature.
+func migrateMessage(msg *Message) *Message {
+	if msg.Header.Get("Signature") != "" {
+		return msg
+	}
+	m := &Message{Header: textproto.MIMEHeader{}, Body: msg.Body}
+	for k, vv := range msg.Header {
+		if s, ok := messageSchema[k]; ok && s.read {
+			continue
+		}
+		var keep []string
+		for _, v := range vv {
+			if v = canonicalValue(v); v != "" {
+				keep = append(keep, v)
+			}
+		}
+		if len(keep) > 0 {
+			m.Header[k] = keep
+		}
+	}
+	if m.Header.Get("Message-Id") == "" {
+		m.Header.Set("Message-Id", legacyMessageId(msg))
+	}
+	if p := m.Header.Get("File"); p != "" {
+		m.Header.Set("File", strings.TrimPrefix(path.Clean("/"+p), "/"))
+	}
+	m.Header.Set("Scrutinize-Version", messageVersion)
+	return m
+}
+
+// migrateNote rewrites the messages in the note text s, and returns the new text.
+func migrateNote(s string) (string, error) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	r := bufio.NewReader(strings.NewReader(s))
+	for {
+		msg, err := ReadMessage(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := migrateMessage(msg).WriteTo(w); err != nil {
+			return "", err
+		}
+	}
+	w.Flush()
+	return buf.String(), nil
+}
+
+// gitMigrate migrates all notes on the review refs, writing one new notes commit per ref,
+// or none if dryRun is set.  It reports the changes to each note as a diff on out,
+// followed by the messages that still don't pass Validate.
+func (g *gitContext) gitMigrate(dryRun bool, out io.Writer) error {
+	ids, err := g.gitReviewIds()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := g.gitMigrateRef(path.Join(*refpfx, id), dryRun, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *gitContext) gitMigrateRef(ref string, dryRun bool, out io.Writer) error {
+	notes, err := g.Notes(ref)
+	if err != nil {
+		return err
+	}
+
+	changed := 0
+	for _, note := range notes {
+		migrated, err := migrateNote(note.Message)
+		if err != nil {
+			return fmt.Errorf("Reading note on %s: %v", note.Id, err)
+		}
+		if migrated != note.Message {
+			changed++
+			fmt.Fprintf(out, "--- %s %s\n+++ %s %s\n", ref, note.Id, ref, note.Id)
+			diffLines(out, strings.SplitAfter(note.Message, "\n"), strings.SplitAfter(migrated, "\n"))
+		}
+		for _, msg := range splitMessages(migrated) {
+			if err := msg.Validate(); err != nil {
+				fmt.Fprintf(out, "warning: %s %s message %s: %v\n", ref, note.Id, msg.Header.Get("Message-Id"), err)
+			}
+		}
+		note.Message = migrated
+	}
+
+	fmt.Fprintf(out, "%s: %d notes changed\n", ref, changed)
+	if dryRun || changed == 0 {
+		return nil
+	}
+
+	var entries []*TreeEntry
+	for _, note := range notes {
+		id, err := g.CreateBlob([]byte(note.Message))
+		if err != nil {
+			return err
+		}
+		entries = append(entries, &TreeEntry{Name: note.Id.String(), Id: id, Type: ObjectBlob, Filemode: FilemodeBlob})
+	}
+	tree, err := g.CreateTree(entries)
+	if err != nil {
+		return err
+	}
+	parent, err := g.Ref(ref)
+	if err != nil {
+		return err
+	}
+	sig, err := g.DefaultSignature()
+	if err != nil {
+		return err
+	}
+	_, err = g.CreateCommit(ref, sig, fmt.Sprintf("Migrate to message format version %s\n", messageVersion), tree, parent)
+	return err
+}
+
+// splitMessages reads all messages in a note, ignoring errors.
+func splitMessages(s string) []*Message {
+	var msgs []*Message
+	r := bufio.NewReader(strings.NewReader(s))
+	for {
+		msg, err := ReadMessage(r)
+		if err != nil {
+			return msgs
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// diffLines writes a line diff of a and b to out, lines only in a prefixed with "-",
+// only in b with "+", and common ones with " ". It splits the problem in halves as
+// Hirschberg does, so that notes of thousands of lines don't need a table of all pairs.
+func diffLines(out io.Writer, a, b []string) {
+	line := func(pfx, s string) {
+		if s == "" {
+			return // the empty string after the last newline
+		}
+		s = strings.TrimRight(s, "\r\n") + "\n"
+		fmt.Fprint(out, pfx, s)
+	}
+	var diff func(a, b []string)
+	diff = func(a, b []string) {
+		for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+			line(" ", a[0])
+			a, b = a[1:], b[1:]
+		}
+		n := 0
+		for n < len(a) && n < len(b) && a[len(a)-1-n] == b[len(b)-1-n] {
+			n++
+		}
+		common := a[len(a)-n:]
+		a, b = a[:len(a)-n], b[:len(b)-n]
+
+		switch {
+		case len(a) == 0:
+			for _, s := range b {
+				line("+", s)
+			}
+		case len(b) == 0:
+			for _, s := range a {
+				line("-", s)
+			}
+		case len(a) == 1:
+			j := 0
+			for j < len(b) && b[j] != a[0] {
+				j++
+			}
+			if j == len(b) {
+				line("-", a[0])
+			}
+			for k, s := range b {
+				if k == j {
+					line(" ", s)
+				} else {
+					line("+", s)
+				}
+			}
+		default:
+			// split b where the longest common subsequences of the halves of a add up the most
+			mid := len(a) / 2
+			fwd := lcsLengths(a[:mid], b, false)
+			bwd := lcsLengths(a[mid:], b, true)
+			k := 0
+			for j := range fwd {
+				if fwd[j]+bwd[len(b)-j] > fwd[k]+bwd[len(b)-k] {
+					k = j
+				}
+			}
+			diff(a[:mid], b[:k])
+			diff(a[mid:], b[k:])
+		}
+
+		for _, s := range common {
+			line(" ", s)
+		}
+	}
+	diff(a, b)
+}
+
+// lcsLengths returns the lengths of the longest common subsequences of a and each
+// prefix b[:j] of b, by j, or with reverse, of a and each suffix b[len(b)-j:], both
+// compared from the end. It only keeps one row of the table at a time.
+func lcsLengths(a, b []string, reverse bool) []int {
+	at := func(s []string, i int) string {
+		if reverse {
+			return s[len(s)-1-i]
+		}
+		return s[i]
+	}
+	prev, cur := make([]int, len(b)+1), make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			switch {
+			case at(a, i) == at(b, j):
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] >= cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMigrateNote(t *testing.T) {
+	legacy := "Author: A U Thor <author@example.com>\r\nDate: 2016-05-04T12:00:00Z\r\nFile: /dir//a.go\r\nLine: 12\r\nVote: \r\n\r\nfix this\r\n.\r\n" +
+		"Author: A U Thor <author@example.com>\r\nDate: 2016-05-04T12:00:00Z\r\nSignature: ssh c2ln\r\n\r\nsigned\r\n.\r\n"
+
+	migrated, err := migrateNote(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := splitMessages(migrated)
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, expected 2:\n%s", len(msgs), migrated)
+	}
+	orig := splitMessages(legacy)
+	if got, want := msgs[0].Header.Get("Message-Id"), legacyMessageId(orig[0]); got != want {
+		t.Errorf("Message-Id is %q, expected the legacy id %q", got, want)
+	}
+	if got := msgs[0].Header.Get("File"); got != "dir/a.go" {
+		t.Errorf("File is %q, expected %q", got, "dir/a.go")
+	}
+	if _, ok := msgs[0].Header["Vote"]; ok {
+		t.Errorf("empty Vote header was kept")
+	}
+	if err := msgs[0].Validate(); err != nil {
+		t.Errorf("migrated message doesn't validate: %v", err)
+	}
+	if msgs[1].Header.Get("Scrutinize-Version") != "" || msgs[1].Header.Get("Message-Id") != "" {
+		t.Errorf("signed message was changed: %v", msgs[1].Header)
+	}
+
+	again, err := migrateNote(migrated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != migrated {
+		t.Errorf("migrating twice changed the note:\n%q\n%q", migrated, again)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	var buf bytes.Buffer
+	diffLines(&buf, strings.SplitAfter("a\nb\nc\n", "\n"), strings.SplitAfter("a\nB\nc\nd\n", "\n"))
+	if got, want := buf.String(), " a\n-b\n+B\n c\n+d\n"; got != want {
+		t.Errorf("got diff\n%s\nexpected\n%s", got, want)
+	}
+
+	for _, tc := range []struct {
+		a, b   string
+		common int // the length of their longest common subsequence
+	}{
+		{"", "x\ny\n", 0},
+		{"x\ny\n", "", 0},
+		{"a\nb\nc\nd\ne\nf\n", "b\nx\nd\nf\ng\n", 3},
+		{"1\n2\n3\n4\n5\n6\n7\n8\n", "8\n7\n6\n5\n4\n3\n2\n1\n", 1},
+	} {
+		buf.Reset()
+		diffLines(&buf, strings.SplitAfter(tc.a, "\n"), strings.SplitAfter(tc.b, "\n"))
+		var a, b, common strings.Builder
+		for _, l := range strings.SplitAfter(buf.String(), "\n") {
+			switch {
+			case strings.HasPrefix(l, " "):
+				a.WriteString(l[1:])
+				b.WriteString(l[1:])
+				common.WriteString(l[1:])
+			case strings.HasPrefix(l, "-"):
+				a.WriteString(l[1:])
+			case strings.HasPrefix(l, "+"):
+				b.WriteString(l[1:])
+			}
+		}
+		if a.String() != tc.a || b.String() != tc.b {
+			t.Errorf("diff of %q and %q doesn't give them back:\n%s", tc.a, tc.b, buf.String())
+		}
+		if strings.Count(common.String(), "\n") != tc.common {
+			t.Errorf("diff of %q and %q isn't minimal:\n%s", tc.a, tc.b, buf.String())
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Work that isn't committed yet can be reviewed as well: the index, or the tracked files
+// as they are in the working tree, as if they were committed on top of HEAD.
+// Comments on it are kept in the pending area, on HEAD in <ref>-pending/<review id>,
+// until gitAnchorPending moves them to the notes of the review, on the commit made of it.
+
+// The scopes of pending work.
+const (
+	scopeIndex   = "index"
+	scopeWorkdir = "workdir"
+)
+
+// Pending is the uncommitted work in the current checkout.
+type Pending struct {
+	Scope    string
+	Review   string // the id of the review of the current checkout
+	Head     *Oid   // the commit the work is on top of
+	Tree     *Oid   // the work, see gitPendingTree
+	Deltas   []*DiffDelta
+	Patches  []string
+	Messages []*Message // the comments on it
+	Stale    int        // the number of comments in the pending area made on top of other commits
+}
+
+func pendingRef(id string) string { return path.Join(*refpfx+"-pending", id) }
+
+// gitPendingReview returns the id of review, which has to be the review of the current
+// checkout, as only that has pending work.
+func (g *gitContext) gitPendingReview(review string) (string, error) {
+	id, err := g.gitReviewId(review)
+	if err != nil {
+		return "", err
+	}
+	if cur, err := g.gitReviewId(""); err != nil {
+		return "", err
+	} else if id != cur {
+		return "", &invalidReviewError{review, "it is not checked out"}
+	}
+	return id, nil
+}
+
+// gitPendingTree writes a tree of the index, or, for scopeWorkdir, of the files in the
+// index as they are in the working tree, leaving out those that have been removed.
+// A conflict is taken as our side of it, as git diff --ours shows it.
+// Like git stash does, it writes the trees, and the blobs of files that differ from the
+// index, to the repository, but leaves the index and the refs alone.
+func (g *gitContext) gitPendingTree(scope string) (*Oid, error) {
+	switch scope {
+	case scopeIndex:
+	case scopeWorkdir:
+		if g.Workdir() == "" {
+			return nil, fmt.Errorf("a bare repository has no working tree")
+		}
+	default:
+		return nil, fmt.Errorf("unknown scope %q, want %s or %s", scope, scopeIndex, scopeWorkdir)
+	}
+	entries, err := g.Index()
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]*TreeEntry{}
+	for _, e := range entries {
+		if e.Stage != 0 && e.Stage != 2 {
+			continue // a conflict, of which ours will do
+		}
+		te := &TreeEntry{Name: path.Base(e.Path), Id: e.Id, Type: e.Filemode.Type(), Filemode: e.Filemode}
+		if scope == scopeWorkdir && e.Filemode != FilemodeCommit {
+			if te, err = g.workdirEntry(e.Path, te); err != nil {
+				return nil, err
+			}
+		}
+		files[e.Path] = te
+	}
+	return g.writeTree(files)
+}
+
+// workdirEntry returns the entry of the file at p in the working tree, or nil if it isn't there.
+// That is indexed if the file hasn't changed since, otherwise its contents are written as a blob.
+func (g *gitContext) workdirEntry(p string, indexed *TreeEntry) (*TreeEntry, error) {
+	fname := filepath.Join(g.Workdir(), filepath.FromSlash(p))
+	fi, err := os.Lstat(fname)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	mode := FilemodeBlob
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(fname)
+		if err != nil {
+			return nil, err
+		}
+		data, mode = []byte(target), FilemodeLink
+	case fi.IsDir():
+		return nil, nil // replaced by a directory, whose files aren't in the index
+	default:
+		if data, err = ioutil.ReadFile(fname); err != nil {
+			return nil, err
+		}
+		if fi.Mode()&0111 != 0 {
+			mode = FilemodeBlobExecutable
+		}
+	}
+	if mode == indexed.Filemode && blobOid(data).Equal(indexed.Id) {
+		return indexed, nil
+	}
+	id, err := g.CreateBlob(data)
+	if err != nil {
+		return nil, err
+	}
+	return &TreeEntry{Name: path.Base(p), Id: id, Type: ObjectBlob, Filemode: mode}, nil
+}
+
+// blobOid returns the id data has as a blob, without writing it.
+func blobOid(data []byte) *Oid {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(data))
+	h.Write(data)
+	var id Oid
+	copy(id[:], h.Sum(nil))
+	return &id
+}
+
+// writeTree writes the entries, by slash separated path, as a tree with subtrees.
+// Nil entries are left out.
+func (g *gitContext) writeTree(files map[string]*TreeEntry) (*Oid, error) {
+	var entries []*TreeEntry
+	dirs := map[string]map[string]*TreeEntry{}
+	for p, e := range files {
+		if e == nil {
+			continue
+		}
+		if i := strings.Index(p, "/"); i >= 0 {
+			if dirs[p[:i]] == nil {
+				dirs[p[:i]] = map[string]*TreeEntry{}
+			}
+			dirs[p[:i]][p[i+1:]] = e
+			continue
+		}
+		entries = append(entries, e)
+	}
+	for name, sub := range dirs {
+		id, err := g.writeTree(sub)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &TreeEntry{Name: name, Id: id, Type: ObjectTree, Filemode: FilemodeTree})
+	}
+	return g.CreateTree(entries)
+}
+
+// gitPending returns the work in scope on top of HEAD, and the comments on it, if review
+// is the one of the current checkout.
+func (g *gitContext) gitPending(review, scope string) (*Pending, error) {
+	id, err := g.gitPendingReview(review)
+	if err != nil {
+		return nil, err
+	}
+	_, head, err := g.Head()
+	if err != nil {
+		return nil, err
+	}
+	htree, err := g.gitCommitTree(head)
+	if err != nil {
+		return nil, err
+	}
+	p := &Pending{Scope: scope, Review: id, Head: head}
+	if p.Tree, err = g.gitPendingTree(scope); err != nil {
+		return nil, err
+	}
+	opts, err := g.gitDiffOptions()
+	if err != nil {
+		return nil, err
+	}
+	if p.Deltas, err = g.DiffTrees(htree, p.Tree, opts); err != nil {
+		return nil, err
+	}
+	if p.Patches, err = g.Patches(htree, p.Tree, opts); err != nil {
+		return nil, err
+	}
+	notes, err := g.gitReadNotes(pendingRef(id), id)
+	if err != nil {
+		return nil, err
+	}
+	for commit, msgs := range notes {
+		if commit == head.String() {
+			p.Messages = msgs
+		} else {
+			p.Stale += len(msgs)
+		}
+	}
+	return p, nil
+}
+
+// gitPendingAppend adds msg, by the current user, to the pending area of review, which
+// has to be the one of the current checkout, as a comment on the work in scope.
+func (g *gitContext) gitPendingAppend(review, scope string, msg *Message) error {
+	id, err := g.gitPendingReview(review)
+	if err != nil {
+		return err
+	}
+	if scope != scopeIndex && scope != scopeWorkdir {
+		return fmt.Errorf("unknown scope %q, want %s or %s", scope, scopeIndex, scopeWorkdir)
+	}
+	_, head, err := g.Head()
+	if err != nil {
+		return err
+	}
+	msg.Header.Set("Pending", scope)
+	return g.gitNoteAppendRef(pendingRef(id), head, msg)
+}
+
+// gitAnchorPending moves the comments in the pending area of review that were made on top
+// of a commit that HEAD has since moved on from, to the notes of the review on the commit
+// made on top of it, and returns how many it moved. Comments on commits HEAD doesn't
+// descend from, eg. after an amend, stay where they are.
+func (g *gitContext) gitAnchorPending(review string) (int, error) {
+	id, err := g.gitReviewId(review)
+	if err != nil {
+		return 0, err
+	}
+	notes, err := g.Notes(pendingRef(id))
+	if err == errNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	_, head, err := g.Head()
+	if err != nil {
+		return 0, err
+	}
+	sig, err := g.DefaultSignature()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, note := range notes {
+		if note.Id.Equal(head) {
+			continue
+		}
+		log, err := g.Log(head, note.Id)
+		if err != nil {
+			return n, err
+		}
+		var onto *Oid
+		for _, c := range log { // children first, so the last one is made right on top
+			for i := uint(0); i < c.ParentCount(); i++ {
+				if c.ParentId(i).Equal(note.Id) {
+					onto = c.Id()
+				}
+			}
+		}
+		if onto == nil {
+			continue
+		}
+		msgs, err := readMessages(note.Message)
+		if err != nil {
+			return n, fmt.Errorf("Reading pending note on %s: %v", note.Id, err)
+		}
+		for _, msg := range msgs {
+			// signed again, a signature on the pending note is for another commit
+			msg.Header.Del("Signature")
+			if err := g.gitNoteWriteRef(path.Join(*refpfx, id), onto, msg, *signMsgs); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if err := g.RemoveNote(pendingRef(id), note.Id, sig); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newPendingFixture checks out the master of a topic fixture, with b removed and a changed
+// in the working tree, and c added to the index.
+func newPendingFixture(t *testing.T) (*topicFixture, func()) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("staging files needs git")
+	}
+	f, done := newTopicFixture(t)
+	f.checkout("master")
+	for p, data := range map[string]string{"a": "one\ntwo\nthree\n", "b": "bee\n", "c": "sea\n"} {
+		if err := ioutil.WriteFile(filepath.Join(f.Workdir(), p), []byte(data), 0666); err != nil {
+			done()
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command("git", "add", "a", "b", "c")
+	cmd.Dir = f.Workdir()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		done()
+		t.Fatalf("git add: %v\n%s", err, out)
+	}
+	if err := ioutil.WriteFile(filepath.Join(f.Workdir(), "a"), []byte("one\ntwo\n3\n"), 0666); err != nil {
+		done()
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(f.Workdir(), "b")); err != nil {
+		done()
+		t.Fatal(err)
+	}
+	return f, done
+}
+
+func TestPending(t *testing.T) {
+	f, done := newPendingFixture(t)
+	defer done()
+
+	for scope, want := range map[string][]string{
+		scopeIndex:   {"Added c"},
+		scopeWorkdir: {"Modified a", "Deleted b", "Added c"},
+	} {
+		p, err := f.gitPending("", scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, d := range p.Deltas {
+			got = append(got, gitDeltaString(d.Status)+" "+d.NewFile.Path)
+		}
+		if !reflect.DeepEqual(got, want) || !p.Head.Equal(f.base) || len(p.Patches) != len(want) {
+			t.Errorf("gitPending(%s): got %q on %v, want %q on %v", scope, got, p.Head, want, f.base)
+		}
+	}
+	if _, err := f.gitPending("topic", scopeWorkdir); err == nil {
+		t.Errorf("gitPending of a review that isn't checked out succeeded")
+	}
+
+	msg := &Message{Header: textproto.MIMEHeader{}, Body: "why 3?"}
+	msg.Header.Set("File", "a")
+	msg.Header.Set("Line", "3")
+	if err := f.gitPendingAppend("", scopeWorkdir, msg); err != nil {
+		t.Fatal(err)
+	}
+	p, err := f.gitPending("", scopeWorkdir)
+	if err != nil || len(p.Messages) != 1 || p.Messages[0].Header.Get("Pending") != scopeWorkdir || p.Stale != 0 {
+		t.Fatalf("gitPending after a comment: got %+v, %v", p, err)
+	}
+	if notes, err := f.gitNotes(""); err != nil || notes != nil {
+		t.Errorf("the comment is in the review already: %v, %v", notes, err)
+	}
+	if n, err := f.gitAnchorPending(""); err != nil || n != 0 {
+		t.Errorf("gitAnchorPending before committing: got %d, %v", n, err)
+	}
+
+	c := f.commit("master", "Work", map[string]string{"a": "one\ntwo\n3\n", "b": "", "c": "sea\n"})
+	if p, err := f.gitPending("", scopeWorkdir); err != nil || len(p.Messages) != 0 || p.Stale != 1 || len(p.Deltas) != 0 {
+		t.Errorf("gitPending after committing: got %+v, %v", p, err)
+	}
+	if n, err := f.gitAnchorPending(""); err != nil || n != 1 {
+		t.Errorf("gitAnchorPending: got %d, %v", n, err)
+	}
+	notes, err := f.gitNotes("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs := notes[c.String()]; len(msgs) != 1 || msgs[0].Body != "why 3?\n" || msgs[0].Header.Get("Line") != "3" {
+		t.Errorf("gitNotes after gitAnchorPending: got %v", notes)
+	}
+	if p, err := f.gitPending("", scopeWorkdir); err != nil || p.Stale != 0 {
+		t.Errorf("gitPending after gitAnchorPending: got %+v, %v", p, err)
+	}
+}
+
+func TestServePending(t *testing.T) {
+	f, done := newPendingFixture(t)
+	defer done()
+	ts, stop := newTestServer(t, nil, f.gitContext)
+	defer stop()
+
+	if status, body := ts.do("GET", "/r/test/pending", nil); status != http.StatusOK || !strings.Contains(body, "Deleted b") || !strings.Contains(body, "-three") {
+		t.Fatalf("GET /r/test/pending: got %d\n%s", status, body)
+	}
+	if status, body := ts.do("GET", "/r/test/pending?scope=index", nil); status != http.StatusOK || strings.Contains(body, "Deleted b") || !strings.Contains(body, "Added c") {
+		t.Errorf("GET /r/test/pending?scope=index: got %d\n%s", status, body)
+	}
+	form := url.Values{"review": {""}, "scope": {"workdir"}, "file": {"a"}, "line": {"3"}, "text": {"why 3?"}}
+	if status, body := ts.do("POST", "/r/test/api/v1/pending", form); status != http.StatusNoContent {
+		t.Errorf("POST /r/test/api/v1/pending: got %d %q", status, body)
+	}
+	form.Set("scope", "stash")
+	if status, _ := ts.do("POST", "/r/test/api/v1/pending", form); status != http.StatusBadRequest {
+		t.Errorf("POST /r/test/api/v1/pending to an unknown scope: got %d", status)
+	}
+	form.Set("scope", "workdir")
+	form.Set("review", "topic")
+	if status, _ := ts.do("POST", "/r/test/api/v1/pending", form); status != http.StatusBadRequest {
+		t.Errorf("POST /r/test/api/v1/pending to a review that isn't checked out: got %d", status)
+	}
+	if status, body := ts.do("GET", "/r/test/pending", nil); status != http.StatusOK || !strings.Contains(body, "why 3?") {
+		t.Errorf("GET /r/test/pending after a comment: got %d\n%s", status, body)
+	}
+}
+
+func TestPendingConflict(t *testing.T) {
+	f, done := newPendingFixture(t)
+	defer done()
+
+	var info strings.Builder
+	info.WriteString("0 0000000000000000000000000000000000000000\ta\n")
+	for stage, data := range []string{"one\ntwo\nthree\n", "one\ntwo\nours\n", "one\ntwo\ntheirs\n"} {
+		id, err := f.CreateBlob([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := blobOid([]byte(data)); !b.Equal(id) {
+			t.Errorf("blobOid(%q): got %v, want %v", data, b, id)
+		}
+		fmt.Fprintf(&info, "100644 %s %d\ta\n", id, stage+1)
+	}
+	cmd := exec.Command("git", "update-index", "--index-info")
+	cmd.Dir = f.Workdir()
+	cmd.Stdin = strings.NewReader(info.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git update-index: %v\n%s", err, out)
+	}
+
+	tree, err := f.gitPendingTree(scopeIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := f.TreeEntry(tree, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := f.Blob(e.Id); err != nil || string(data) != "one\ntwo\nours\n" {
+		t.Errorf("gitPendingTree of a conflict: got %q, %v, want ours", data, err)
+	}
+}
+
+func TestPendingSigned(t *testing.T) {
+	f, done := newPendingFixture(t)
+	defer done()
+	key, _, allowed := testSSHKey(t, f.Path(), testSig.Email)
+	for k, v := range map[string]string{"gpg.format": "ssh", "user.signingkey": key, "gpg.ssh.allowedSignersFile": allowed} {
+		if err := f.SetConfig(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	*signMsgs = true
+
+	msg := &Message{Header: textproto.MIMEHeader{}, Body: "why 3?"}
+	msg.Header.Set("File", "a")
+	msg.Header.Set("Line", "3")
+	if err := f.gitPendingAppend("", scopeWorkdir, msg); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := f.gitPending("", scopeWorkdir); err != nil || len(p.Messages) != 1 || p.Messages[0].Header.Get("Signature-Status") != sigVerified {
+		t.Fatalf("gitPending of a signed comment: got %+v, %v", p, err)
+	}
+	c := f.commit("master", "Work", map[string]string{"a": "one\ntwo\n3\n", "b": "", "c": "sea\n"})
+	if n, err := f.gitAnchorPending(""); err != nil || n != 1 {
+		t.Fatalf("gitAnchorPending: got %d, %v", n, err)
+	}
+	notes, err := f.gitNotes("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs := notes[c.String()]; len(msgs) != 1 || msgs[0].Header.Get("Signature-Status") != sigVerified {
+		t.Errorf("gitNotes after anchoring a signed comment: got %v", notes)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// A Repo is what scrutinize needs from a git repository.  The types it deals in mirror
+// those of git2go, so that templates and most code don't care which backend is in use:
+// libgit2 through git2go by default, see repo_libgit2.go, or pure Go with go-git when
+// built with -tags gogit, see repo_gogit.go.  Both are held to repo_test.go.
+//
+// Methods return errNotFound for missing objects, refs, notes, branches and config entries.
+type Repo interface {
+	Path() string    // the .git directory
+	Workdir() string // the root of the working tree, "" if the repository is bare
+
+	Commit(id *Oid) (*Commit, error)
+	Blob(id *Oid) ([]byte, error)
+	Tree(id *Oid) ([]*TreeEntry, error)
+	TreeEntry(tree *Oid, path string) (*TreeEntry, error)
+	CreateBlob(data []byte) (*Oid, error)
+	CreateTree(entries []*TreeEntry) (*Oid, error)
+	// CreateCommit writes a commit by sig, and points ref at it unless ref is "".
+	CreateCommit(ref string, sig *Signature, msg string, tree *Oid, parents ...*Oid) (*Oid, error)
+	// Checkout writes the files in tree to dir, without touching the index or HEAD.
+	Checkout(tree *Oid, dir string) error
+	// Index returns the files staged in the index, ordered by path. Files with conflicts
+	// have an entry per stage.
+	Index() ([]*IndexEntry, error)
+
+	// Log returns the commits reachable from head but not from hide, children before
+	// their parents and otherwise newest first.
+	Log(head, hide *Oid) ([]*Commit, error)
+	AheadBehind(local, upstream *Oid) (ahead, behind int, err error)
+	// DiffTrees returns the changed files between two trees, ordered by (new) path,
+	// and Patches the unified diff of each of them, in the same order.
+	DiffTrees(old, new *Oid, opts *DiffOptions) ([]*DiffDelta, error)
+	Patches(old, new *Oid, opts *DiffOptions) ([]string, error)
+
+	// Head returns the branch HEAD is on, "" if it is detached, and the commit it points to.
+	Head() (branch string, id *Oid, err error)
+	Ref(name string) (*Oid, error)
+	RefNames() ([]string, error)
+	DeleteRef(name string) error
+	// Dwim resolves a short name as git does, eg. master to refs/heads/master.
+	Dwim(name string) (*Oid, error)
+	// Revparse resolves a revision, eg. HEAD~2 or an abbreviated oid, to a commit.
+	Revparse(spec string) (*Oid, error)
+	Branches() ([]*Branch, error)
+	Branch(name string, remote bool) (*Branch, error)
+
+	// Notes returns all notes on ref, Note the one on id.  SetNote replaces it with text,
+	// SetNotes replaces the notes on the ids of notes, all in one commit.
+	Notes(ref string) ([]*Note, error)
+	Note(ref string, id *Oid) (string, error)
+	SetNote(ref string, id *Oid, text string, sig *Signature) error
+	SetNotes(ref string, notes []*Note, sig *Signature) error
+	RemoveNote(ref string, id *Oid, sig *Signature) error
+
+	Config() ([]*ConfigEntry, error)
+	ConfigString(name string) (string, error)
+	SetConfig(name, value string) error // in the repository's own config
+	// ReadConfig reads a file in git config syntax, like .gitmodules.
+	ReadConfig(fname string) ([]*ConfigEntry, error)
+	// DefaultSignature is the user as configured in user.name and user.email, now.
+	DefaultSignature() (*Signature, error)
+}
+
+var errNotFound = errors.New("not found")
+
+type Oid [20]byte
+
+func NewOid(s string) (*Oid, error) {
+	if len(s) != 2*len(Oid{}) {
+		return nil, fmt.Errorf("invalid oid %q", s)
+	}
+	var o Oid
+	if _, err := hex.Decode(o[:], []byte(s)); err != nil {
+		return nil, fmt.Errorf("invalid oid %q", s)
+	}
+	return &o, nil
+}
+
+func (o *Oid) String() string        { return hex.EncodeToString(o[:]) }
+func (o *Oid) Equal(other *Oid) bool { return other != nil && *o == *other }
+func (o *Oid) IsZero() bool          { return *o == Oid{} }
+
+type Signature struct {
+	Name  string
+	Email string
+	When  time.Time
+}
+
+type Commit struct {
+	id, tree          *Oid
+	parents           []*Oid
+	author, committer *Signature
+	message           string
+}
+
+func (c *Commit) Id() *Oid              { return c.id }
+func (c *Commit) TreeId() *Oid          { return c.tree }
+func (c *Commit) ParentCount() uint     { return uint(len(c.parents)) }
+func (c *Commit) ParentId(n uint) *Oid  { return c.parents[n] }
+func (c *Commit) Author() *Signature    { return c.author }
+func (c *Commit) Committer() *Signature { return c.committer }
+func (c *Commit) Message() string       { return c.message }
+
+// Summary is the first paragraph of the message on one line, as in git log --oneline.
+func (c *Commit) Summary() string {
+	p := strings.TrimSpace(c.message)
+	if i := strings.Index(p, "\n\n"); i >= 0 {
+		p = p[:i]
+	}
+	return strings.Join(strings.Fields(p), " ")
+}
+
+type ObjectType int
+
+const (
+	ObjectCommit ObjectType = 1
+	ObjectTree   ObjectType = 2
+	ObjectBlob   ObjectType = 3
+)
+
+func (t ObjectType) String() string {
+	switch t {
+	case ObjectCommit:
+		return "Commit"
+	case ObjectTree:
+		return "Tree"
+	case ObjectBlob:
+		return "Blob"
+	}
+	return fmt.Sprintf("ObjectType[%d]", int(t))
+}
+
+type Filemode int
+
+const (
+	FilemodeTree           Filemode = 0040000
+	FilemodeBlob           Filemode = 0100644
+	FilemodeBlobExecutable Filemode = 0100755
+	FilemodeLink           Filemode = 0120000
+	FilemodeCommit         Filemode = 0160000
+)
+
+func (m Filemode) Type() ObjectType {
+	switch m {
+	case FilemodeTree:
+		return ObjectTree
+	case FilemodeCommit:
+		return ObjectCommit
+	}
+	return ObjectBlob
+}
+
+type TreeEntry struct {
+	Name     string
+	Id       *Oid
+	Type     ObjectType
+	Filemode Filemode
+}
+
+// An IndexEntry is a file staged in the index.
+type IndexEntry struct {
+	Path     string
+	Id       *Oid
+	Filemode Filemode
+	Stage    int // 0, or for a conflict 1, 2 and 3 for the common ancestor, ours and theirs
+}
+
+type Delta int
+
+const (
+	DeltaUnmodified Delta = iota
+	DeltaAdded
+	DeltaDeleted
+	DeltaModified
+	DeltaRenamed
+	DeltaCopied
+	DeltaIgnored
+	DeltaUntracked
+	DeltaTypeChange
+)
+
+type DiffFlag uint32
+
+const (
+	DiffFlagBinary    DiffFlag = 1 << 0
+	DiffFlagNotBinary DiffFlag = 1 << 1
+	DiffFlagValidOid  DiffFlag = 1 << 2
+)
+
+type DiffFile struct {
+	Path  string
+	Oid   *Oid
+	Size  int
+	Flags DiffFlag
+	Mode  uint16
+}
+
+// A DiffDelta is a changed file.  For added and deleted files,
+// both OldFile and NewFile have the path.
+type DiffDelta struct {
+	Status     Delta
+	Flags      DiffFlag
+	Similarity uint16
+	OldFile    DiffFile
+	NewFile    DiffFile
+}
+
+// DiffOptions are how DiffTrees and Patches compare trees, nil finds no renames or copies.
+type DiffOptions struct {
+	// Renames pairs removed files with added ones that are at least RenameThreshold percent
+	// similar, Copies added files with changed ones at least CopyThreshold percent similar.
+	Renames, Copies                bool
+	RenameThreshold, CopyThreshold int
+	// IgnoreWhitespace leaves changes in whitespace out of the patches, and files that
+	// only change in whitespace out altogether.
+	IgnoreWhitespace bool
+	// Context is the number of unchanged lines around changes in patches, 3 if 0.
+	Context int
+	// Algorithm is that of git diff --diff-algorithm: "" for myers, minimal, patience or
+	// histogram. Backends use the closest they have.
+	Algorithm string
+	// Ignore are globs of files to leave out, as in .gitignore: *.pb.go matches in any
+	// directory, vendor/ only directories, and a glob with a slash whole paths from the root.
+	Ignore []string
+}
+
+// ignores reports whether o leaves the file at p out.
+func (o *DiffOptions) ignores(p string) bool {
+	if o == nil {
+		return false
+	}
+	parts := strings.Split(p, "/")
+	for _, pat := range o.Ignore {
+		n := len(parts)
+		if strings.HasSuffix(pat, "/") {
+			n-- // only the directories p is in
+		}
+		pat = strings.Trim(pat, "/")
+		if pat == "" {
+			continue
+		}
+		for i := 0; i < n; i++ {
+			var ok bool
+			if strings.Contains(pat, "/") {
+				ok, _ = path.Match(pat, strings.Join(parts[:i+1], "/"))
+			} else {
+				ok, _ = path.Match(pat, parts[i])
+			}
+			if ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// onlyWhitespace reports whether a and b have the same lines but for whitespace, as git diff -w sees them.
+func onlyWhitespace(a, b []byte) bool {
+	la, lb := bytes.Split(a, []byte("\n")), bytes.Split(b, []byte("\n"))
+	if len(la) != len(lb) {
+		return false
+	}
+	for i := range la {
+		if !bytes.Equal(bytes.Join(bytes.Fields(la[i]), nil), bytes.Join(bytes.Fields(lb[i]), nil)) {
+			return false
+		}
+	}
+	return true
+}
+
+type Branch struct {
+	Name     string // eg. feature, or origin/feature for remote branches
+	Remote   bool
+	Target   *Oid
+	Upstream string // the remote branch a local one tracks, "" if none
+}
+
+// A Note is the text a notes ref holds on the object with Id.
+type Note struct {
+	Id      *Oid
+	Message string
+}
+
+type ConfigLevel int
+
+// as in git2go, which settings.html relies on
+const (
+	ConfigLevelSystem ConfigLevel = 2
+	ConfigLevelXDG    ConfigLevel = 3
+	ConfigLevelGlobal ConfigLevel = 4
+	ConfigLevelLocal  ConfigLevel = 5
+	ConfigLevelApp    ConfigLevel = 6
+)
+
+type ConfigEntry struct {
+	Name  string // section.key or section.subsection.key, with section and key in lower case
+	Value string
+	Level ConfigLevel
+}
@@ -0,0 +1,1029 @@
+//go:build gogit
+// +build gogit
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	format "github.com/go-git/go-git/v5/plumbing/format/config"
+	fdiff "github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/utils/merkletrie"
+)
+
+// gogitRepo is the Repo implemented in pure Go with go-git, for builds without cgo.
+type gogitRepo struct {
+	r       *gogit.Repository
+	path    string // with a trailing slash, as libgit2 has it
+	common  string // likewise, the directory a linked worktree shares with the main one
+	workdir string // likewise
+}
+
+// openRepository opens the repository that path is in.
+func openRepository(path string) (Repo, error) {
+	r, err := gogit.PlainOpenWithOptions(path, &gogit.PlainOpenOptions{DetectDotGit: true, EnableDotGitCommonDir: true})
+	if err != nil {
+		return nil, err
+	}
+	return newGogitRepo(r, path)
+}
+
+// initRepository creates an empty repository in path, for tests.
+func initRepository(path string) (Repo, error) {
+	r, err := gogit.PlainInit(path, false)
+	if err != nil {
+		return nil, err
+	}
+	return newGogitRepo(r, path)
+}
+
+// newGogitRepo takes the git directory from the storage, as .git can be a file pointing
+// elsewhere, in worktrees and submodules.
+func newGogitRepo(r *gogit.Repository, path string) (*gogitRepo, error) {
+	g := &gogitRepo{r: r}
+	if wt, err := r.Worktree(); err == nil {
+		g.workdir = wt.Filesystem.Root() + "/"
+	}
+	if s, ok := r.Storer.(*filesystem.Storage); ok {
+		g.path = s.Filesystem().Root() + "/"
+	} else {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		g.path = abs + "/"
+	}
+	g.common = g.path
+	if data, err := ioutil.ReadFile(filepath.Join(g.path, "commondir")); err == nil {
+		dir := strings.TrimSpace(string(data))
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(g.path, dir)
+		}
+		g.common = filepath.Clean(dir) + "/"
+	}
+	return g, nil
+}
+
+func gogitErr(err error) error {
+	switch err {
+	case plumbing.ErrObjectNotFound, plumbing.ErrReferenceNotFound,
+		object.ErrEntryNotFound, object.ErrDirectoryNotFound, object.ErrFileNotFound:
+		return errNotFound
+	}
+	return err
+}
+
+func hashOid(h plumbing.Hash) *Oid {
+	o := Oid(h)
+	return &o
+}
+
+func oidHash(o *Oid) plumbing.Hash { return plumbing.Hash(*o) }
+
+func gogitCommit(c *object.Commit) *Commit {
+	r := &Commit{
+		id:        hashOid(c.Hash),
+		tree:      hashOid(c.TreeHash),
+		author:    &Signature{Name: c.Author.Name, Email: c.Author.Email, When: c.Author.When},
+		committer: &Signature{Name: c.Committer.Name, Email: c.Committer.Email, When: c.Committer.When},
+		message:   c.Message,
+	}
+	for _, p := range c.ParentHashes {
+		r.parents = append(r.parents, hashOid(p))
+	}
+	return r
+}
+
+func (g *gogitRepo) Path() string    { return g.path }
+func (g *gogitRepo) Workdir() string { return g.workdir }
+
+func (g *gogitRepo) Commit(id *Oid) (*Commit, error) {
+	c, err := g.r.CommitObject(oidHash(id))
+	if err != nil {
+		return nil, gogitErr(err)
+	}
+	return gogitCommit(c), nil
+}
+
+func (g *gogitRepo) blob(h plumbing.Hash) ([]byte, error) {
+	b, err := g.r.BlobObject(h)
+	if err != nil {
+		return nil, gogitErr(err)
+	}
+	rc, err := b.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+func (g *gogitRepo) Blob(id *Oid) ([]byte, error) { return g.blob(oidHash(id)) }
+
+func (g *gogitRepo) Tree(id *Oid) ([]*TreeEntry, error) {
+	t, err := g.r.TreeObject(oidHash(id))
+	if err != nil {
+		return nil, gogitErr(err)
+	}
+	var r []*TreeEntry
+	for _, e := range t.Entries {
+		m := Filemode(e.Mode)
+		r = append(r, &TreeEntry{Name: e.Name, Id: hashOid(e.Hash), Type: m.Type(), Filemode: m})
+	}
+	return r, nil
+}
+
+func (g *gogitRepo) TreeEntry(tree *Oid, path string) (*TreeEntry, error) {
+	t, err := g.r.TreeObject(oidHash(tree))
+	if err != nil {
+		return nil, gogitErr(err)
+	}
+	e, err := t.FindEntry(path)
+	if err != nil {
+		return nil, gogitErr(err)
+	}
+	m := Filemode(e.Mode)
+	return &TreeEntry{Name: e.Name, Id: hashOid(e.Hash), Type: m.Type(), Filemode: m}, nil
+}
+
+type encoder interface {
+	Encode(plumbing.EncodedObject) error
+}
+
+func (g *gogitRepo) store(e encoder) (*Oid, error) {
+	obj := g.r.Storer.NewEncodedObject()
+	if err := e.Encode(obj); err != nil {
+		return nil, err
+	}
+	h, err := g.r.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	return hashOid(h), nil
+}
+
+func (g *gogitRepo) CreateBlob(data []byte) (*Oid, error) {
+	obj := g.r.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	h, err := g.r.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	return hashOid(h), nil
+}
+
+func (g *gogitRepo) CreateTree(entries []*TreeEntry) (*Oid, error) {
+	t := &object.Tree{}
+	for _, e := range entries {
+		t.Entries = append(t.Entries, object.TreeEntry{Name: e.Name, Mode: filemode.FileMode(e.Filemode), Hash: oidHash(e.Id)})
+	}
+	// git sorts trees as if the names of subtrees ended in a slash
+	key := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(t.Entries, func(i, j int) bool { return key(t.Entries[i]) < key(t.Entries[j]) })
+	return g.store(t)
+}
+
+func (g *gogitRepo) CreateCommit(ref string, sig *Signature, msg string, tree *Oid, parents ...*Oid) (*Oid, error) {
+	s := object.Signature{Name: sig.Name, Email: sig.Email, When: sig.When}
+	c := &object.Commit{Author: s, Committer: s, Message: msg, TreeHash: oidHash(tree)}
+	for _, p := range parents {
+		c.ParentHashes = append(c.ParentHashes, oidHash(p))
+	}
+	id, err := g.store(c)
+	if err != nil || ref == "" {
+		return id, err
+	}
+	return id, g.r.Storer.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(ref), oidHash(id)))
+}
+
+func (g *gogitRepo) Checkout(tree *Oid, dir string) error {
+	entries, err := g.Tree(tree)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name)
+		switch e.Filemode {
+		case FilemodeTree:
+			if err := g.Checkout(e.Id, p); err != nil {
+				return err
+			}
+			continue
+		case FilemodeCommit:
+			// submodules are left empty, as git does before git submodule update
+			if err := os.MkdirAll(p, 0777); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := g.Blob(e.Id)
+		if err != nil {
+			return err
+		}
+		switch e.Filemode {
+		case FilemodeLink:
+			err = os.Symlink(string(data), p)
+		case FilemodeBlobExecutable:
+			err = ioutil.WriteFile(p, data, 0777)
+		default:
+			err = ioutil.WriteFile(p, data, 0666)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Which of the commits paint starts from a commit is reachable from.
+const (
+	fromA = 1 << iota
+	fromB
+)
+
+// paint walks back from a and, unless nil, b, newest commits first, and returns the commits
+// it visits with which of the two they are reachable from.  It stops once every commit left
+// to visit is reachable from both, so it goes no further back than their merge bases.  Like
+// git, it counts on committer dates to go forward, more or less.
+func (g *gogitRepo) paint(a plumbing.Hash, b *Oid) (map[plumbing.Hash]int, map[plumbing.Hash]*object.Commit, error) {
+	flags := map[plumbing.Hash]int{}
+	commits := map[plumbing.Hash]*object.Commit{}
+	var queue []*object.Commit
+	push := func(h plumbing.Hash, f int) error {
+		if flags[h]&f == f {
+			return nil
+		}
+		flags[h] |= f
+		c := commits[h]
+		if c == nil {
+			var err error
+			if c, err = g.r.CommitObject(h); err != nil {
+				return gogitErr(err)
+			}
+			commits[h] = c
+		}
+		queue = append(queue, c)
+		return nil
+	}
+	if err := push(a, fromA); err != nil {
+		return nil, nil, err
+	}
+	if b != nil {
+		if err := push(oidHash(b), fromB); err != nil {
+			return nil, nil, err
+		}
+	}
+	for {
+		done := true
+		for _, c := range queue {
+			if flags[c.Hash] != fromA|fromB {
+				done = false
+				break
+			}
+		}
+		if done {
+			break // nothing left, or only commits reachable from both
+		}
+		newest := 0
+		for i, c := range queue {
+			if c.Committer.When.After(queue[newest].Committer.When) {
+				newest = i
+			}
+		}
+		c := queue[newest]
+		queue = append(queue[:newest], queue[newest+1:]...)
+		for _, p := range c.ParentHashes {
+			if err := push(p, flags[c.Hash]); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return flags, commits, nil
+}
+
+func (g *gogitRepo) Log(head, hide *Oid) ([]*Commit, error) {
+	flags, commits, err := g.paint(oidHash(head), hide)
+	if err != nil {
+		return nil, err
+	}
+	for h := range commits {
+		if flags[h] != fromA {
+			delete(commits, h)
+		}
+	}
+
+	// a commit is ready once all its children are out, of those the newest goes first
+	children := map[plumbing.Hash]int{}
+	for _, c := range commits {
+		for _, p := range c.ParentHashes {
+			if commits[p] != nil {
+				children[p]++
+			}
+		}
+	}
+	var ready []*object.Commit
+	for h, c := range commits {
+		if children[h] == 0 {
+			ready = append(ready, c)
+		}
+	}
+	var r []*Commit
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool {
+			ti, tj := ready[i].Committer.When, ready[j].Committer.When
+			if !ti.Equal(tj) {
+				return ti.After(tj)
+			}
+			return ready[i].Hash.String() < ready[j].Hash.String()
+		})
+		c := ready[0]
+		ready = ready[1:]
+		r = append(r, gogitCommit(c))
+		for _, p := range c.ParentHashes {
+			if commits[p] == nil {
+				continue
+			}
+			if children[p]--; children[p] == 0 {
+				ready = append(ready, commits[p])
+			}
+		}
+	}
+	return r, nil
+}
+
+func (g *gogitRepo) AheadBehind(local, upstream *Oid) (int, int, error) {
+	flags, _, err := g.paint(oidHash(local), upstream)
+	if err != nil {
+		return 0, 0, err
+	}
+	ahead, behind := 0, 0
+	for _, f := range flags {
+		switch f {
+		case fromA:
+			ahead++
+		case fromB:
+			behind++
+		}
+	}
+	return ahead, behind, nil
+}
+
+// changes returns the changes between two trees, ordered by path like libgit2 does.
+func (g *gogitRepo) changes(old, new *Oid, opts *DiffOptions) (object.Changes, error) {
+	ot, err := g.r.TreeObject(oidHash(old))
+	if err != nil {
+		return nil, gogitErr(err)
+	}
+	nt, err := g.r.TreeObject(oidHash(new))
+	if err != nil {
+		return nil, gogitErr(err)
+	}
+	if opts == nil {
+		opts = &DiffOptions{}
+	}
+	changes, err := object.DiffTreeWithOptions(context.Background(), ot, nt, &object.DiffTreeOptions{DetectRenames: opts.Renames, RenameScore: uint(opts.RenameThreshold)})
+	if err != nil {
+		return nil, err
+	}
+	if opts.Copies {
+		if changes, err = g.findCopies(changes, opts.CopyThreshold); err != nil {
+			return nil, err
+		}
+	}
+	if changes, err = g.skipChanges(changes, opts); err != nil {
+		return nil, err
+	}
+	name := func(c *object.Change) string {
+		if c.To.Name != "" {
+			return c.To.Name
+		}
+		return c.From.Name
+	}
+	sort.Slice(changes, func(i, j int) bool { return name(changes[i]) < name(changes[j]) })
+	return changes, nil
+}
+
+// skipChanges returns changes without the files opts ignore and, if it ignores whitespace,
+// those that only change in whitespace.  go-git can't leave whitespace out of the patches
+// of the others.
+func (g *gogitRepo) skipChanges(changes object.Changes, opts *DiffOptions) (object.Changes, error) {
+	var r object.Changes
+	for _, c := range changes {
+		if opts.ignores(c.From.Name) || opts.ignores(c.To.Name) {
+			continue
+		}
+		if opts.IgnoreWhitespace && c.From.Name != "" && c.From.Name == c.To.Name && c.To.TreeEntry.Mode != filemode.Submodule {
+			a, err := g.blob(c.From.TreeEntry.Hash)
+			if err != nil {
+				return nil, err
+			}
+			b, err := g.blob(c.To.TreeEntry.Hash)
+			if err != nil {
+				return nil, err
+			}
+			if onlyWhitespace(a, b) {
+				continue
+			}
+		}
+		r = append(r, c)
+	}
+	return r, nil
+}
+
+// findCopies pairs the added files in changes with the changed file they are most similar
+// to, if that is at least threshold percent, as git diff -C does. go-git only finds renames.
+func (g *gogitRepo) findCopies(changes object.Changes, threshold int) (object.Changes, error) {
+	var sources []*object.Change
+	for _, c := range changes {
+		if c.From.Name != "" && c.From.Name == c.To.Name {
+			sources = append(sources, c)
+		}
+	}
+	data := map[plumbing.Hash][]byte{}
+	blob := func(e object.ChangeEntry) ([]byte, error) {
+		h := e.TreeEntry.Hash
+		if _, ok := data[h]; !ok {
+			b, err := g.blob(h)
+			if err != nil {
+				return nil, err
+			}
+			data[h] = b
+		}
+		return data[h], nil
+	}
+	var r object.Changes
+	for _, c := range changes {
+		if c.From.Name != "" || c.To.TreeEntry.Mode == filemode.Submodule {
+			r = append(r, c)
+			continue
+		}
+		added, err := blob(c.To)
+		if err != nil {
+			return nil, err
+		}
+		var best *object.Change
+		score := threshold
+		for _, s := range sources {
+			if s.From.TreeEntry.Mode == filemode.Submodule {
+				continue
+			}
+			src, err := blob(s.From)
+			if err != nil {
+				return nil, err
+			}
+			if n := similarity(src, added); n >= score {
+				best, score = s, n
+			}
+		}
+		if best != nil {
+			c = &object.Change{From: best.From, To: c.To}
+		}
+		r = append(r, c)
+	}
+	return r, nil
+}
+
+// similarity is how much of the larger of a and b, in percent, is in lines they have in
+// common, a rough version of how git scores renames and copies.
+func similarity(a, b []byte) int {
+	size := len(a)
+	if len(b) > size {
+		size = len(b)
+	}
+	if size == 0 {
+		return 100
+	}
+	lines := map[string]int{}
+	for _, l := range bytes.SplitAfter(a, []byte("\n")) {
+		lines[string(l)]++
+	}
+	common := 0
+	for _, l := range bytes.SplitAfter(b, []byte("\n")) {
+		if lines[string(l)] > 0 {
+			lines[string(l)]--
+			common += len(l)
+		}
+	}
+	return 100 * common / size
+}
+
+func (g *gogitRepo) diffFile(e object.ChangeEntry) (DiffFile, error) {
+	f := DiffFile{Path: e.Name, Oid: &Oid{}}
+	if e.Name == "" {
+		return f, nil
+	}
+	f.Oid = hashOid(e.TreeEntry.Hash)
+	f.Mode = uint16(e.TreeEntry.Mode)
+	f.Flags = DiffFlagValidOid
+	if e.TreeEntry.Mode == filemode.Submodule {
+		return f, nil
+	}
+	data, err := g.blob(e.TreeEntry.Hash)
+	if err != nil {
+		return f, err
+	}
+	f.Size = len(data)
+	if isBinary(data) {
+		f.Flags |= DiffFlagBinary
+	} else {
+		f.Flags |= DiffFlagNotBinary
+	}
+	return f, nil
+}
+
+func (g *gogitRepo) DiffTrees(old, new *Oid, opts *DiffOptions) ([]*DiffDelta, error) {
+	changes, err := g.changes(old, new, opts)
+	if err != nil {
+		return nil, err
+	}
+	var r []*DiffDelta
+	for _, c := range changes {
+		action, err := c.Action()
+		if err != nil {
+			return nil, err
+		}
+		d := &DiffDelta{}
+		if d.OldFile, err = g.diffFile(c.From); err != nil {
+			return nil, err
+		}
+		if d.NewFile, err = g.diffFile(c.To); err != nil {
+			return nil, err
+		}
+		switch action {
+		case merkletrie.Insert:
+			d.Status = DeltaAdded
+			d.OldFile.Path = d.NewFile.Path
+		case merkletrie.Delete:
+			d.Status = DeltaDeleted
+			d.NewFile.Path = d.OldFile.Path
+		case merkletrie.Modify:
+			d.Status = DeltaModified
+			if d.OldFile.Path != d.NewFile.Path {
+				// a copy if the file it came from is still there
+				d.Status = DeltaRenamed
+				if _, err := g.TreeEntry(new, d.OldFile.Path); err == nil {
+					d.Status = DeltaCopied
+				}
+				d.Similarity = 100
+				if !d.OldFile.Oid.Equal(d.NewFile.Oid) {
+					a, err := g.blob(c.From.TreeEntry.Hash)
+					if err != nil {
+						return nil, err
+					}
+					b, err := g.blob(c.To.TreeEntry.Hash)
+					if err != nil {
+						return nil, err
+					}
+					d.Similarity = uint16(similarity(a, b))
+				}
+			} else if Filemode(d.OldFile.Mode).Type() != Filemode(d.NewFile.Mode).Type() || (d.OldFile.Mode == uint16(FilemodeLink)) != (d.NewFile.Mode == uint16(FilemodeLink)) {
+				d.Status = DeltaTypeChange
+			}
+		}
+		if (d.OldFile.Flags|d.NewFile.Flags)&DiffFlagBinary != 0 {
+			d.Flags = DiffFlagBinary
+		} else {
+			d.Flags = DiffFlagNotBinary
+		}
+		r = append(r, d)
+	}
+	return r, nil
+}
+
+func (g *gogitRepo) Patches(old, new *Oid, opts *DiffOptions) ([]string, error) {
+	changes, err := g.changes(old, new, opts)
+	if err != nil {
+		return nil, err
+	}
+	context := fdiff.DefaultContextLines
+	if opts != nil && opts.Context > 0 {
+		context = opts.Context
+	}
+	// go-git has one diff algorithm
+	var r []string
+	for _, c := range changes {
+		p, err := c.Patch()
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := fdiff.NewUnifiedEncoder(&buf, context).Encode(p); err != nil {
+			return nil, err
+		}
+		r = append(r, buf.String())
+	}
+	return r, nil
+}
+
+func (g *gogitRepo) Index() ([]*IndexEntry, error) {
+	idx, err := g.r.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+	var r []*IndexEntry
+	for _, e := range idx.Entries {
+		r = append(r, &IndexEntry{Path: e.Name, Id: hashOid(e.Hash), Filemode: Filemode(e.Mode), Stage: int(e.Stage)})
+	}
+	return r, nil
+}
+
+func (g *gogitRepo) Head() (string, *Oid, error) {
+	ref, err := g.r.Head()
+	if err != nil {
+		return "", nil, gogitErr(err)
+	}
+	if ref.Name().IsBranch() {
+		return ref.Name().Short(), hashOid(ref.Hash()), nil
+	}
+	return "", hashOid(ref.Hash()), nil
+}
+
+func (g *gogitRepo) Ref(name string) (*Oid, error) {
+	ref, err := g.r.Reference(plumbing.ReferenceName(name), true)
+	if err != nil {
+		return nil, gogitErr(err)
+	}
+	return hashOid(ref.Hash()), nil
+}
+
+func (g *gogitRepo) DeleteRef(name string) error {
+	if _, err := g.r.Reference(plumbing.ReferenceName(name), false); err != nil {
+		return gogitErr(err)
+	}
+	return g.r.Storer.RemoveReference(plumbing.ReferenceName(name))
+}
+
+func (g *gogitRepo) RefNames() ([]string, error) {
+	it, err := g.r.References()
+	if err != nil {
+		return nil, err
+	}
+	var r []string
+	err = it.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() != plumbing.HEAD {
+			r = append(r, ref.Name().String())
+		}
+		return nil
+	})
+	return r, err
+}
+
+// the rules of git rev-parse, in order
+var dwimRules = []string{"%s", "refs/%s", "refs/tags/%s", "refs/heads/%s", "refs/remotes/%s", "refs/remotes/%s/HEAD"}
+
+func (g *gogitRepo) Dwim(name string) (*Oid, error) {
+	for _, rule := range dwimRules {
+		if ref, err := g.r.Reference(plumbing.ReferenceName(fmt.Sprintf(rule, name)), true); err == nil {
+			return hashOid(ref.Hash()), nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (g *gogitRepo) Revparse(spec string) (*Oid, error) {
+	h, err := g.r.ResolveRevision(plumbing.Revision(spec))
+	if err != nil {
+		return nil, gogitErr(err)
+	}
+	if _, err := g.r.CommitObject(*h); err != nil {
+		return nil, gogitErr(err)
+	}
+	return hashOid(*h), nil
+}
+
+func (g *gogitRepo) Branches() ([]*Branch, error) {
+	cfg, err := g.r.Config()
+	if err != nil {
+		return nil, err
+	}
+	it, err := g.r.References()
+	if err != nil {
+		return nil, err
+	}
+	var r []*Branch
+	err = it.ForEach(func(ref *plumbing.Reference) error {
+		n := ref.Name()
+		if !n.IsBranch() && !n.IsRemote() {
+			return nil
+		}
+		b := &Branch{Name: n.Short(), Remote: n.IsRemote()}
+		if t, err := g.r.Reference(n, true); err == nil {
+			b.Target = hashOid(t.Hash())
+		}
+		if c := cfg.Branches[b.Name]; !b.Remote && c != nil && c.Remote != "" && c.Merge != "" {
+			b.Upstream = c.Remote + "/" + c.Merge.Short()
+			if c.Remote == "." {
+				b.Upstream = c.Merge.Short() // tracking a local branch
+			}
+		}
+		r = append(r, b)
+		return nil
+	})
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r, err
+}
+
+func (g *gogitRepo) Branch(name string, remote bool) (*Branch, error) {
+	branches, err := g.Branches()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range branches {
+		if b.Name == name && b.Remote == remote {
+			return b, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+// noteBlobs returns the blobs in the notes tree on ref by the object they annotate,
+// and the commit ref points to.  git fans out large notes trees into directories
+// named after the first bytes of the oid, those are read as well.
+func (g *gogitRepo) noteBlobs(ref string) (map[string]plumbing.Hash, *Oid, error) {
+	head, err := g.Ref(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := g.r.CommitObject(oidHash(head))
+	if err != nil {
+		return nil, nil, gogitErr(err)
+	}
+	r := map[string]plumbing.Hash{}
+	var walk func(tree plumbing.Hash, prefix string) error
+	walk = func(tree plumbing.Hash, prefix string) error {
+		t, err := g.r.TreeObject(tree)
+		if err != nil {
+			return gogitErr(err)
+		}
+		for _, e := range t.Entries {
+			switch e.Mode {
+			case filemode.Dir:
+				if err := walk(e.Hash, prefix+e.Name); err != nil {
+					return err
+				}
+			case filemode.Regular, filemode.Executable, filemode.Deprecated:
+				if _, err := NewOid(prefix + e.Name); err == nil {
+					r[prefix+e.Name] = e.Hash
+				}
+			}
+		}
+		return nil
+	}
+	return r, head, walk(c.TreeHash, "")
+}
+
+func (g *gogitRepo) Notes(ref string) ([]*Note, error) {
+	blobs, _, err := g.noteBlobs(ref)
+	if err != nil {
+		return nil, err
+	}
+	var r []*Note
+	for id, h := range blobs {
+		data, err := g.blob(h)
+		if err != nil {
+			return nil, err
+		}
+		oid, _ := NewOid(id)
+		r = append(r, &Note{Id: oid, Message: string(data)})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Id.String() < r[j].Id.String() })
+	return r, nil
+}
+
+func (g *gogitRepo) Note(ref string, id *Oid) (string, error) {
+	blobs, _, err := g.noteBlobs(ref)
+	if err != nil {
+		return "", err
+	}
+	h, ok := blobs[id.String()]
+	if !ok {
+		return "", errNotFound
+	}
+	data, err := g.blob(h)
+	return string(data), err
+}
+
+// SetNote writes the notes tree flat, as git itself does for all but the largest.
+func (g *gogitRepo) SetNote(ref string, id *Oid, text string, sig *Signature) error {
+	blob, err := g.CreateBlob([]byte(text))
+	if err != nil {
+		return err
+	}
+	return g.updateNotes(ref, sig, "Notes added by 'git notes add'\n", func(blobs map[string]plumbing.Hash) error {
+		blobs[id.String()] = oidHash(blob)
+		return nil
+	})
+}
+
+func (g *gogitRepo) SetNotes(ref string, notes []*Note, sig *Signature) error {
+	set := map[string]plumbing.Hash{}
+	for _, n := range notes {
+		blob, err := g.CreateBlob([]byte(n.Message))
+		if err != nil {
+			return err
+		}
+		set[n.Id.String()] = oidHash(blob)
+	}
+	return g.updateNotes(ref, sig, "Notes added by 'git notes add'\n", func(blobs map[string]plumbing.Hash) error {
+		for id, h := range set {
+			blobs[id] = h
+		}
+		return nil
+	})
+}
+
+func (g *gogitRepo) RemoveNote(ref string, id *Oid, sig *Signature) error {
+	return g.updateNotes(ref, sig, "Notes removed by 'git notes remove'\n", func(blobs map[string]plumbing.Hash) error {
+		if _, ok := blobs[id.String()]; !ok {
+			return errNotFound
+		}
+		delete(blobs, id.String())
+		return nil
+	})
+}
+
+// updateNotes commits the notes on ref as update leaves them, by oid, on top of the current ones.
+func (g *gogitRepo) updateNotes(ref string, sig *Signature, msg string, update func(map[string]plumbing.Hash) error) error {
+	blobs, parent, err := g.noteBlobs(ref)
+	if err == errNotFound {
+		blobs, err = map[string]plumbing.Hash{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := update(blobs); err != nil {
+		return err
+	}
+	var entries []*TreeEntry
+	for n, h := range blobs {
+		entries = append(entries, &TreeEntry{Name: n, Id: hashOid(h), Type: ObjectBlob, Filemode: FilemodeBlob})
+	}
+	tree, err := g.CreateTree(entries)
+	if err != nil {
+		return err
+	}
+	var parents []*Oid
+	if parent != nil {
+		parents = append(parents, parent)
+	}
+	_, err = g.CreateCommit(ref, sig, msg, tree, parents...)
+	return err
+}
+
+func formatEntries(raw *format.Config, level ConfigLevel) []*ConfigEntry {
+	var r []*ConfigEntry
+	for _, s := range raw.Sections {
+		sec := strings.ToLower(s.Name)
+		for _, o := range s.Options {
+			r = append(r, &ConfigEntry{Name: sec + "." + strings.ToLower(o.Key), Value: o.Value, Level: level})
+		}
+		for _, ss := range s.Subsections {
+			for _, o := range ss.Options {
+				r = append(r, &ConfigEntry{Name: sec + "." + ss.Name + "." + strings.ToLower(o.Key), Value: o.Value, Level: level})
+			}
+		}
+	}
+	return r
+}
+
+// configName returns name with the section and key in lower case, the subsection is case sensitive.
+func configName(name string) (section, subsection, key string) {
+	i, j := strings.Index(name, "."), strings.LastIndex(name, ".")
+	if i < 0 {
+		return strings.ToLower(name), "", ""
+	}
+	section, key = strings.ToLower(name[:i]), strings.ToLower(name[j+1:])
+	if i < j {
+		subsection = name[i+1 : j]
+	}
+	return section, subsection, key
+}
+
+func (g *gogitRepo) Config() ([]*ConfigEntry, error) {
+	var r []*ConfigEntry
+	for _, s := range []struct {
+		scope config.Scope
+		level ConfigLevel
+	}{{config.SystemScope, ConfigLevelSystem}, {config.GlobalScope, ConfigLevelGlobal}} {
+		cfg, err := config.LoadConfig(s.scope)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, formatEntries(cfg.Raw, s.level)...)
+	}
+	cfg, err := g.r.Config()
+	if err != nil {
+		return nil, err
+	}
+	return append(r, formatEntries(cfg.Raw, ConfigLevelLocal)...), nil
+}
+
+func (g *gogitRepo) ConfigString(name string) (string, error) {
+	entries, err := g.Config()
+	if err != nil {
+		return "", err
+	}
+	s, ss, k := configName(name)
+	want := s + "." + k
+	if ss != "" {
+		want = s + "." + ss + "." + k
+	}
+	v, found := "", false
+	for _, e := range entries {
+		if e.Name == want {
+			v, found = e.Value, true // the last one wins
+		}
+	}
+	if !found {
+		return "", errNotFound
+	}
+	return v, nil
+}
+
+func (g *gogitRepo) SetConfig(name, value string) error {
+	fname := filepath.Join(g.common, "config")
+	data, err := ioutil.ReadFile(fname)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	cfg := format.New()
+	if err := format.NewDecoder(bytes.NewReader(data)).Decode(cfg); err != nil {
+		return err
+	}
+	s, ss, k := configName(name)
+	if ss != "" {
+		cfg.Section(s).Subsection(ss).SetOption(k, value)
+	} else {
+		cfg.Section(s).SetOption(k, value)
+	}
+	var buf bytes.Buffer
+	if err := format.NewEncoder(&buf).Encode(cfg); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, buf.Bytes(), 0666)
+}
+
+func (g *gogitRepo) ReadConfig(fname string) ([]*ConfigEntry, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg := format.New()
+	if err := format.NewDecoder(f).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+	return formatEntries(cfg, ConfigLevelApp), nil
+}
+
+func (g *gogitRepo) DefaultSignature() (*Signature, error) {
+	name, err := g.ConfigString("user.name")
+	if err != nil {
+		return nil, fmt.Errorf("user.name is not configured")
+	}
+	email, err := g.ConfigString("user.email")
+	if err != nil {
+		return nil, fmt.Errorf("user.email is not configured")
+	}
+	return &Signature{Name: name, Email: email, When: time.Now()}, nil
+}
+
+// isBinary guesses whether data is binary the way git does: by a NUL in the first 8000 bytes.
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
@@ -0,0 +1,668 @@
+//go:build !gogit
+// +build !gogit
+
+package main
+
+import (
+	"sort"
+
+	git "github.com/libgit2/git2go"
+)
+
+// libgit2Repo is the Repo backed by libgit2.
+type libgit2Repo struct {
+	r *git.Repository
+}
+
+// openRepository opens the repository that path is in.
+func openRepository(path string) (Repo, error) {
+	r, err := git.OpenRepositoryExtended(path, 0, "/")
+	if err != nil {
+		return nil, err
+	}
+	return &libgit2Repo{r}, nil
+}
+
+// initRepository creates an empty repository in path, for tests.
+func initRepository(path string) (Repo, error) {
+	r, err := git.InitRepository(path, false)
+	if err != nil {
+		return nil, err
+	}
+	return &libgit2Repo{r}, nil
+}
+
+// gitErr turns libgit2's not found into errNotFound.
+func gitErr(err error) error {
+	if ge, ok := err.(*git.GitError); ok && ge.Code == git.ErrNotFound {
+		return errNotFound
+	}
+	return err
+}
+
+func isIterOver(err error) bool {
+	ge, ok := err.(*git.GitError)
+	return ok && ge.Code == git.ErrIterOver
+}
+
+func toOid(o *git.Oid) *Oid {
+	if o == nil {
+		return nil
+	}
+	r := Oid(*o)
+	return &r
+}
+
+func fromOid(o *Oid) *git.Oid {
+	r := git.Oid(*o)
+	return &r
+}
+
+func toSignature(s *git.Signature) *Signature {
+	return &Signature{Name: s.Name, Email: s.Email, When: s.When}
+}
+
+func fromSignature(s *Signature) *git.Signature {
+	return &git.Signature{Name: s.Name, Email: s.Email, When: s.When}
+}
+
+func toCommit(c *git.Commit) *Commit {
+	r := &Commit{
+		id:        toOid(c.Id()),
+		tree:      toOid(c.TreeId()),
+		author:    toSignature(c.Author()),
+		committer: toSignature(c.Committer()),
+		message:   c.Message(),
+	}
+	for i := uint(0); i < c.ParentCount(); i++ {
+		r.parents = append(r.parents, toOid(c.ParentId(i)))
+	}
+	return r
+}
+
+func toTreeEntry(e *git.TreeEntry) *TreeEntry {
+	return &TreeEntry{Name: e.Name, Id: toOid(e.Id), Type: Filemode(e.Filemode).Type(), Filemode: Filemode(e.Filemode)}
+}
+
+func (l *libgit2Repo) Path() string    { return l.r.Path() }
+func (l *libgit2Repo) Workdir() string { return l.r.Workdir() }
+
+func (l *libgit2Repo) Commit(id *Oid) (*Commit, error) {
+	c, err := l.r.LookupCommit(fromOid(id))
+	if err != nil {
+		return nil, gitErr(err)
+	}
+	return toCommit(c), nil
+}
+
+func (l *libgit2Repo) Blob(id *Oid) ([]byte, error) {
+	b, err := l.r.LookupBlob(fromOid(id))
+	if err != nil {
+		return nil, gitErr(err)
+	}
+	return b.Contents(), nil
+}
+
+func (l *libgit2Repo) Tree(id *Oid) ([]*TreeEntry, error) {
+	t, err := l.r.LookupTree(fromOid(id))
+	if err != nil {
+		return nil, gitErr(err)
+	}
+	var r []*TreeEntry
+	for i, n := uint64(0), t.EntryCount(); i < n; i++ {
+		r = append(r, toTreeEntry(t.EntryByIndex(i)))
+	}
+	return r, nil
+}
+
+func (l *libgit2Repo) TreeEntry(tree *Oid, path string) (*TreeEntry, error) {
+	t, err := l.r.LookupTree(fromOid(tree))
+	if err != nil {
+		return nil, gitErr(err)
+	}
+	e, err := t.EntryByPath(path)
+	if err != nil {
+		return nil, gitErr(err)
+	}
+	return toTreeEntry(e), nil
+}
+
+func (l *libgit2Repo) CreateBlob(data []byte) (*Oid, error) {
+	id, err := l.r.CreateBlobFromBuffer(data)
+	return toOid(id), err
+}
+
+func (l *libgit2Repo) CreateTree(entries []*TreeEntry) (*Oid, error) {
+	tb, err := l.r.TreeBuilder()
+	if err != nil {
+		return nil, err
+	}
+	defer tb.Free()
+	for _, e := range entries {
+		if err := tb.Insert(e.Name, fromOid(e.Id), git.Filemode(e.Filemode)); err != nil {
+			return nil, err
+		}
+	}
+	id, err := tb.Write()
+	return toOid(id), err
+}
+
+func (l *libgit2Repo) CreateCommit(ref string, sig *Signature, msg string, tree *Oid, parents ...*Oid) (*Oid, error) {
+	t, err := l.r.LookupTree(fromOid(tree))
+	if err != nil {
+		return nil, gitErr(err)
+	}
+	var ps []*git.Commit
+	for _, p := range parents {
+		c, err := l.r.LookupCommit(fromOid(p))
+		if err != nil {
+			return nil, gitErr(err)
+		}
+		ps = append(ps, c)
+	}
+	gs := fromSignature(sig)
+	id, err := l.r.CreateCommit(ref, gs, gs, msg, t, ps...)
+	return toOid(id), err
+}
+
+func (l *libgit2Repo) Checkout(tree *Oid, dir string) error {
+	t, err := l.r.LookupTree(fromOid(tree))
+	if err != nil {
+		return gitErr(err)
+	}
+	return l.r.CheckoutTree(t, &git.CheckoutOpts{Strategy: git.CheckoutForce | git.CheckoutRecreateMissing | git.CheckoutDontUpdateIndex, TargetDirectory: dir})
+}
+
+func (l *libgit2Repo) Log(head, hide *Oid) ([]*Commit, error) {
+	w, err := l.r.Walk()
+	if err != nil {
+		return nil, err
+	}
+	defer w.Free()
+	w.Sorting(git.SortTopological | git.SortTime)
+	if err := w.Push(fromOid(head)); err != nil {
+		return nil, gitErr(err)
+	}
+	if hide != nil {
+		if err := w.Hide(fromOid(hide)); err != nil {
+			return nil, gitErr(err)
+		}
+	}
+	var r []*Commit
+	err = w.Iterate(func(c *git.Commit) bool {
+		r = append(r, toCommit(c))
+		return true
+	})
+	return r, err
+}
+
+func (l *libgit2Repo) Index() ([]*IndexEntry, error) {
+	idx, err := l.r.Index()
+	if err != nil {
+		return nil, err
+	}
+	defer idx.Free()
+	// git2go's entries don't have their stage, conflicts are listed apart
+	conflicts := map[string]bool{}
+	var r []*IndexEntry
+	if idx.HasConflicts() {
+		it, err := idx.ConflictIterator()
+		if err != nil {
+			return nil, err
+		}
+		defer it.Free()
+		for {
+			c, err := it.Next()
+			if isIterOver(err) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			for stage, e := range []*git.IndexEntry{c.Ancestor, c.Our, c.Their} {
+				if e != nil {
+					conflicts[e.Path] = true
+					r = append(r, &IndexEntry{Path: e.Path, Id: toOid(e.Id), Filemode: Filemode(e.Mode), Stage: stage + 1})
+				}
+			}
+		}
+	}
+	for i := uint(0); i < idx.EntryCount(); i++ {
+		e, err := idx.EntryByIndex(i)
+		if err != nil {
+			return nil, err
+		}
+		if !conflicts[e.Path] {
+			r = append(r, &IndexEntry{Path: e.Path, Id: toOid(e.Id), Filemode: Filemode(e.Mode)})
+		}
+	}
+	return r, nil
+}
+
+func (l *libgit2Repo) AheadBehind(local, upstream *Oid) (int, int, error) {
+	return l.r.AheadBehind(fromOid(local), fromOid(upstream))
+}
+
+func (l *libgit2Repo) diff(old, new *Oid, opts *DiffOptions) (*git.Diff, error) {
+	ot, err := l.r.LookupTree(fromOid(old))
+	if err != nil {
+		return nil, gitErr(err)
+	}
+	nt, err := l.r.LookupTree(fromOid(new))
+	if err != nil {
+		return nil, gitErr(err)
+	}
+	do, err := git.DefaultDiffOptions()
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil {
+		if opts.IgnoreWhitespace {
+			do.Flags |= git.DiffIgnoreWhitespace
+		}
+		if opts.Context > 0 {
+			do.ContextLines = uint32(opts.Context)
+		}
+		switch opts.Algorithm {
+		case "minimal":
+			do.Flags |= git.DiffMinimal
+		case "patience", "histogram": // libgit2 has no histogram
+			do.Flags |= git.DiffPatience
+		}
+	}
+	diff, err := l.r.DiffTreeToTree(ot, nt, &do)
+	if err != nil || opts == nil || !opts.Renames && !opts.Copies {
+		return diff, err
+	}
+	fo, err := git.DefaultDiffFindOptions()
+	if err != nil {
+		diff.Free()
+		return nil, err
+	}
+	fo.Flags = 0
+	if opts.Renames {
+		fo.Flags |= git.DiffFindRenames
+	}
+	if opts.Copies {
+		fo.Flags |= git.DiffFindCopies
+	}
+	fo.RenameThreshold, fo.CopyThreshold = uint16(opts.RenameThreshold), uint16(opts.CopyThreshold)
+	if err := diff.FindSimilar(&fo); err != nil {
+		diff.Free()
+		return nil, err
+	}
+	return diff, nil
+}
+
+// deltas returns the deltas of diff that opts don't leave out, with their index in it, sorted
+// by the new path, as FindSimilar orders renames by the old one.
+func (l *libgit2Repo) deltas(diff *git.Diff, opts *DiffOptions) ([]*DiffDelta, []int, error) {
+	n, err := diff.NumDeltas()
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		r     []*DiffDelta
+		index []int
+	)
+	for i := 0; i < n; i++ {
+		d, err := diff.GetDelta(i)
+		if err != nil {
+			return nil, nil, err
+		}
+		file := func(f git.DiffFile) DiffFile {
+			return DiffFile{Path: f.Path, Oid: toOid(f.Oid), Size: f.Size, Flags: DiffFlag(f.Flags), Mode: f.Mode}
+		}
+		dd := &DiffDelta{
+			Status:     Delta(d.Status),
+			Flags:      DiffFlag(d.Flags),
+			Similarity: d.Similarity,
+			OldFile:    file(d.OldFile),
+			NewFile:    file(d.NewFile),
+		}
+		if opts.ignores(dd.OldFile.Path) || opts.ignores(dd.NewFile.Path) {
+			continue
+		}
+		// libgit2 keeps files that only change in whitespace, with a patch without hunks
+		if opts != nil && opts.IgnoreWhitespace && dd.Status == DeltaModified && dd.NewFile.Mode != uint16(FilemodeCommit) {
+			a, err := l.Blob(dd.OldFile.Oid)
+			if err != nil {
+				return nil, nil, err
+			}
+			b, err := l.Blob(dd.NewFile.Oid)
+			if err != nil {
+				return nil, nil, err
+			}
+			if onlyWhitespace(a, b) {
+				continue
+			}
+		}
+		r, index = append(r, dd), append(index, i)
+	}
+	order := make([]int, len(r))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return r[order[i]].NewFile.Path < r[order[j]].NewFile.Path })
+	sorted, sortedIndex := make([]*DiffDelta, len(r)), make([]int, len(r))
+	for i, k := range order {
+		sorted[i], sortedIndex[i] = r[k], index[k]
+	}
+	return sorted, sortedIndex, nil
+}
+
+func (l *libgit2Repo) DiffTrees(old, new *Oid, opts *DiffOptions) ([]*DiffDelta, error) {
+	diff, err := l.diff(old, new, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer diff.Free()
+	r, _, err := l.deltas(diff, opts)
+	return r, err
+}
+
+func (l *libgit2Repo) Patches(old, new *Oid, opts *DiffOptions) ([]string, error) {
+	diff, err := l.diff(old, new, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer diff.Free()
+	_, index, err := l.deltas(diff, opts)
+	if err != nil {
+		return nil, err
+	}
+	var r []string
+	for _, i := range index {
+		p, err := diff.Patch(i)
+		if err != nil {
+			return nil, err
+		}
+		s, err := p.String()
+		p.Free()
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, s)
+	}
+	return r, nil
+}
+
+func (l *libgit2Repo) Head() (string, *Oid, error) {
+	head, err := l.r.Head()
+	if err != nil {
+		return "", nil, gitErr(err)
+	}
+	if !head.IsBranch() {
+		return "", toOid(head.Target()), nil
+	}
+	name, err := head.Branch().Name()
+	return name, toOid(head.Target()), err
+}
+
+func (l *libgit2Repo) Ref(name string) (*Oid, error) {
+	ref, err := l.r.References.Lookup(name)
+	if err != nil {
+		return nil, gitErr(err)
+	}
+	if ref, err = ref.Resolve(); err != nil {
+		return nil, gitErr(err)
+	}
+	return toOid(ref.Target()), nil
+}
+
+func (l *libgit2Repo) DeleteRef(name string) error {
+	ref, err := l.r.References.Lookup(name)
+	if err != nil {
+		return gitErr(err)
+	}
+	defer ref.Free()
+	return ref.Delete()
+}
+
+func (l *libgit2Repo) RefNames() ([]string, error) {
+	it, err := l.r.NewReferenceNameIterator()
+	if err != nil {
+		return nil, err
+	}
+	var r []string
+	for {
+		n, err := it.Next()
+		if isIterOver(err) {
+			break
+		}
+		if err != nil {
+			return r, err
+		}
+		r = append(r, n)
+	}
+	return r, nil
+}
+
+func (l *libgit2Repo) Dwim(name string) (*Oid, error) {
+	ref, err := l.r.References.Dwim(name)
+	if err != nil {
+		return nil, gitErr(err)
+	}
+	if ref, err = ref.Resolve(); err != nil {
+		return nil, gitErr(err)
+	}
+	return toOid(ref.Target()), nil
+}
+
+func (l *libgit2Repo) Revparse(spec string) (*Oid, error) {
+	obj, err := l.r.RevparseSingle(spec)
+	if err != nil {
+		return nil, gitErr(err)
+	}
+	c, err := obj.AsCommit()
+	if err != nil {
+		return nil, err
+	}
+	return toOid(c.Id()), nil
+}
+
+func (l *libgit2Repo) toBranch(b *git.Branch, bt git.BranchType) (*Branch, error) {
+	name, err := b.Name()
+	if err != nil {
+		return nil, err
+	}
+	r := &Branch{Name: name, Remote: bt == git.BranchRemote}
+	if ref, err := b.Resolve(); err == nil {
+		r.Target = toOid(ref.Target())
+	}
+	if !r.Remote {
+		if up, err := b.Upstream(); err == nil {
+			r.Upstream = up.Shorthand()
+		}
+	}
+	return r, nil
+}
+
+func (l *libgit2Repo) Branches() ([]*Branch, error) {
+	it, err := l.r.NewBranchIterator(git.BranchAll)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Free()
+	var r []*Branch
+	for {
+		b, bt, err := it.Next()
+		if isIterOver(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		br, err := l.toBranch(b, bt)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, br)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r, nil
+}
+
+func (l *libgit2Repo) Branch(name string, remote bool) (*Branch, error) {
+	bt := git.BranchLocal
+	if remote {
+		bt = git.BranchRemote
+	}
+	b, err := l.r.LookupBranch(name, bt)
+	if err != nil {
+		return nil, gitErr(err)
+	}
+	return l.toBranch(b, bt)
+}
+
+func (l *libgit2Repo) Notes(ref string) ([]*Note, error) {
+	it, err := l.r.NewNoteIterator(ref)
+	if err != nil {
+		return nil, gitErr(err)
+	}
+	defer it.Free()
+	var r []*Note
+	for {
+		noteid, annid, err := it.Next()
+		if isIterOver(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err := l.r.LookupBlob(noteid)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, &Note{Id: toOid(annid), Message: string(b.Contents())})
+	}
+	return r, nil
+}
+
+func (l *libgit2Repo) Note(ref string, id *Oid) (string, error) {
+	n, err := l.r.Notes.Read(ref, fromOid(id))
+	if err != nil {
+		return "", gitErr(err)
+	}
+	defer n.Free()
+	return n.Message(), nil
+}
+
+func (l *libgit2Repo) SetNote(ref string, id *Oid, text string, sig *Signature) error {
+	gs := fromSignature(sig)
+	_, err := l.r.Notes.Create(ref, gs, gs, fromOid(id), text, true)
+	return err
+}
+
+// SetNotes writes the notes tree flat, as libgit2 can only add notes one commit at a time.
+func (l *libgit2Repo) SetNotes(ref string, notes []*Note, sig *Signature) error {
+	blobs := map[string]*Oid{}
+	var parents []*Oid
+	if head, err := l.Ref(ref); err == nil {
+		parents = append(parents, head)
+		it, err := l.r.NewNoteIterator(ref)
+		if err != nil {
+			return gitErr(err)
+		}
+		defer it.Free()
+		for {
+			noteid, annid, err := it.Next()
+			if isIterOver(err) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			blobs[toOid(annid).String()] = toOid(noteid)
+		}
+	} else if err != errNotFound {
+		return err
+	}
+	for _, n := range notes {
+		id, err := l.CreateBlob([]byte(n.Message))
+		if err != nil {
+			return err
+		}
+		blobs[n.Id.String()] = id
+	}
+	var entries []*TreeEntry
+	for name, id := range blobs {
+		entries = append(entries, &TreeEntry{Name: name, Id: id, Type: ObjectBlob, Filemode: FilemodeBlob})
+	}
+	tree, err := l.CreateTree(entries)
+	if err != nil {
+		return err
+	}
+	_, err = l.CreateCommit(ref, sig, "Notes added by 'git notes add'\n", tree, parents...)
+	return err
+}
+
+func (l *libgit2Repo) RemoveNote(ref string, id *Oid, sig *Signature) error {
+	gs := fromSignature(sig)
+	return gitErr(l.r.Notes.Remove(ref, gs, gs, fromOid(id)))
+}
+
+func configEntries(cfg *git.Config) ([]*ConfigEntry, error) {
+	it, err := cfg.NewIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer it.Free()
+	var r []*ConfigEntry
+	for {
+		e, err := it.Next()
+		if isIterOver(err) {
+			break
+		}
+		if err != nil {
+			return r, err
+		}
+		r = append(r, &ConfigEntry{Name: e.Name, Value: e.Value, Level: ConfigLevel(e.Level)})
+	}
+	return r, nil
+}
+
+func (l *libgit2Repo) Config() ([]*ConfigEntry, error) {
+	cfg, err := l.r.Config()
+	if err != nil {
+		return nil, err
+	}
+	return configEntries(cfg)
+}
+
+func (l *libgit2Repo) ConfigString(name string) (string, error) {
+	cfg, err := l.r.Config()
+	if err != nil {
+		return "", err
+	}
+	v, err := cfg.LookupString(name)
+	return v, gitErr(err)
+}
+
+func (l *libgit2Repo) SetConfig(name, value string) error {
+	cfg, err := l.r.Config()
+	if err != nil {
+		return err
+	}
+	return cfg.SetString(name, value)
+}
+
+func (l *libgit2Repo) ReadConfig(fname string) ([]*ConfigEntry, error) {
+	cfg, err := git.NewConfig()
+	if err != nil {
+		return nil, err
+	}
+	defer cfg.Free()
+	if err := cfg.AddFile(fname, git.ConfigLevelApp, false); err != nil {
+		return nil, gitErr(err)
+	}
+	return configEntries(cfg)
+}
+
+func (l *libgit2Repo) DefaultSignature() (*Signature, error) {
+	sig, err := l.r.DefaultSignature()
+	if err != nil {
+		return nil, err
+	}
+	return toSignature(sig), nil
+}
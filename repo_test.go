@@ -0,0 +1,570 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The tests in this file are the conformance suite for the Repo implementations,
+// run them with and without -tags gogit.
+
+var testSig = &Signature{Name: "Test", Email: "test@example.com", When: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+
+// testRepo creates an empty repository with a user configured.
+func testRepo(t *testing.T) (Repo, func()) {
+	dir, err := ioutil.TempDir("", "scrutinize-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := initRepository(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"user.name": testSig.Name, "user.email": testSig.Email} {
+		if err := r.SetConfig(k, v); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return r, func() { os.RemoveAll(dir) }
+}
+
+// testTree writes files, contents by slash separated path, as a tree.
+func testTree(t *testing.T, r Repo, files map[string]string) *Oid {
+	var entries []*TreeEntry
+	dirs := map[string]map[string]string{}
+	for p, data := range files {
+		if i := strings.Index(p, "/"); i >= 0 {
+			if dirs[p[:i]] == nil {
+				dirs[p[:i]] = map[string]string{}
+			}
+			dirs[p[:i]][p[i+1:]] = data
+			continue
+		}
+		id, err := r.CreateBlob([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, &TreeEntry{Name: p, Id: id, Type: ObjectBlob, Filemode: FilemodeBlob})
+	}
+	for name, sub := range dirs {
+		entries = append(entries, &TreeEntry{Name: name, Id: testTree(t, r, sub), Type: ObjectTree, Filemode: FilemodeTree})
+	}
+	id, err := r.CreateTree(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// testCommit commits files on top of parents and points ref at it.
+func testCommit(t *testing.T, r Repo, ref, msg string, files map[string]string, parents ...*Oid) *Oid {
+	sig := *testSig
+	for _, p := range parents {
+		if c, err := r.Commit(p); err == nil && !c.Committer().When.Before(sig.When) {
+			sig.When = c.Committer().When.Add(time.Minute)
+		}
+	}
+	id, err := r.CreateCommit(ref, &sig, msg, testTree(t, r, files), parents...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// testHeadRef returns the ref HEAD of a new repository points to, which depends on init.defaultBranch.
+func testHeadRef(t *testing.T, r Repo) string {
+	data, err := ioutil.ReadFile(filepath.Join(r.Path(), "HEAD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(strings.TrimPrefix(string(data), "ref:"))
+}
+
+func TestRepoWorktree(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git")
+	}
+	r, done := testRepo(t)
+	defer done()
+	c1 := testCommit(t, r, testHeadRef(t, r), "first\n", map[string]string{"a": "1\n"})
+
+	dir, err := ioutil.TempDir("", "scrutinize-worktree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wt := filepath.Join(dir, "wt")
+	cmd := exec.Command("git", "worktree", "add", "-b", "feature", wt)
+	cmd.Dir = r.Workdir()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git worktree add: %v\n%s", err, out)
+	}
+
+	w, err := openRepository(wt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(r.Path(), "worktrees", "wt") + "/"; w.Path() != want {
+		t.Errorf("Path of a worktree: got %q, want %q", w.Path(), want)
+	}
+	if branch, head, err := w.Head(); err != nil || branch != "feature" || !head.Equal(c1) {
+		t.Errorf("Head of a worktree: got %q %v, %v", branch, head, err)
+	}
+	if err := w.SetConfig("branch.feature.scrutinizeReview", "r1"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := r.ConfigString("branch.feature.scrutinizeReview"); err != nil || v != "r1" {
+		t.Errorf("config set in a worktree, in the main one: got %q, %v", v, err)
+	}
+}
+
+func TestRepoObjects(t *testing.T) {
+	r, done := testRepo(t)
+	defer done()
+
+	id, err := r.CreateBlob([]byte("hello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.String() != "ce013625030ba8dba906f756967f9e9ca394464a" {
+		t.Errorf("blob id: got %s", id)
+	}
+	if data, err := r.Blob(id); err != nil || string(data) != "hello\n" {
+		t.Errorf("Blob: got %q, %v", data, err)
+	}
+
+	empty, err := r.CreateTree(nil)
+	if err != nil || empty.String() != emptyTree {
+		t.Errorf("empty tree: got %v, %v", empty, err)
+	}
+
+	tree := testTree(t, r, map[string]string{"b.txt": "b\n", "a": "a\n", "a.d/x": "x\n", "dir/sub/c.go": "package c\n"})
+	entries, err := r.Tree(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	if want := []string{"a", "a.d", "b.txt", "dir"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Tree: got %q, want %q", names, want)
+	}
+	if entries[1].Type != ObjectTree || entries[1].Filemode != FilemodeTree || entries[2].Type != ObjectBlob || entries[2].Filemode != FilemodeBlob {
+		t.Errorf("Tree: wrong types %v %v", entries[1], entries[2])
+	}
+
+	e, err := r.TreeEntry(tree, "dir/sub/c.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := r.Blob(e.Id); e.Name != "c.go" || e.Type != ObjectBlob || string(data) != "package c\n" {
+		t.Errorf("TreeEntry: got %v %q, %v", e, data, err)
+	}
+	if _, err := r.TreeEntry(tree, "dir/nope"); err != errNotFound {
+		t.Errorf("TreeEntry of a missing path: got %v, want errNotFound", err)
+	}
+	if _, err := r.Blob(&Oid{1}); err != errNotFound {
+		t.Errorf("missing Blob: got %v, want errNotFound", err)
+	}
+
+	dir, err := ioutil.TempDir("", "scrutinize-checkout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index, err := r.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Checkout(tree, dir); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "dir", "sub", "c.go")); err != nil || string(data) != "package c\n" {
+		t.Errorf("Checkout: got %q, %v", data, err)
+	}
+	if after, err := r.Index(); err != nil || !reflect.DeepEqual(after, index) {
+		t.Errorf("Index after Checkout: got %v, %v, want %v", after, err, index)
+	}
+}
+
+func TestRepoHistory(t *testing.T) {
+	r, done := testRepo(t)
+	defer done()
+
+	head := testHeadRef(t, r)
+	c1 := testCommit(t, r, head, "first\n", map[string]string{"a": "1\n"})
+	c2 := testCommit(t, r, head, "second\nline\n\nbody\n", map[string]string{"a": "2\n"}, c1)
+	c3 := testCommit(t, r, "refs/heads/topic", "third\n", map[string]string{"a": "3\n"}, c2)
+	c4 := testCommit(t, r, "refs/heads/topic", "fourth\n", map[string]string{"a": "4\n"}, c3)
+	c5 := testCommit(t, r, head, "fifth\n", map[string]string{"a": "5\n"}, c2)
+
+	c, err := r.Commit(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Id().Equal(c2) || c.ParentCount() != 1 || !c.ParentId(0).Equal(c1) || c.Author().Name != "Test" || c.Committer().Email != "test@example.com" {
+		t.Errorf("Commit: got %+v", c)
+	}
+	if c.Message() != "second\nline\n\nbody\n" || c.Summary() != "second line" {
+		t.Errorf("Commit: message %q summary %q", c.Message(), c.Summary())
+	}
+	if tree, err := r.TreeEntry(c.TreeId(), "a"); err != nil || tree.Type != ObjectBlob {
+		t.Errorf("Commit: tree has no a: %v", err)
+	}
+
+	branch, id, err := r.Head()
+	if err != nil || branch != strings.TrimPrefix(head, "refs/heads/") || !id.Equal(c5) {
+		t.Errorf("Head: got %q %v, %v", branch, id, err)
+	}
+	if id, err := r.Ref("refs/heads/topic"); err != nil || !id.Equal(c4) {
+		t.Errorf("Ref: got %v, %v", id, err)
+	}
+	if _, err := r.Ref("refs/heads/nope"); err != errNotFound {
+		t.Errorf("missing Ref: got %v, want errNotFound", err)
+	}
+	if id, err := r.Dwim("topic"); err != nil || !id.Equal(c4) {
+		t.Errorf("Dwim: got %v, %v", id, err)
+	}
+	if id, err := r.Revparse("topic~2"); err != nil || !id.Equal(c2) {
+		t.Errorf("Revparse: got %v, %v", id, err)
+	}
+	names, err := r.RefNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	want := []string{head, "refs/heads/topic"}
+	sort.Strings(want)
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("RefNames: got %q", names)
+	}
+
+	log, err := r.Log(c4, c5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []*Oid
+	for _, c := range log {
+		got = append(got, c.Id())
+	}
+	if want := []*Oid{c4, c3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Log: got %v, want %v", got, want)
+	}
+	if log, err := r.Log(c4, nil); err != nil || len(log) != 4 || !log[3].Id().Equal(c1) {
+		t.Errorf("Log without hide: got %d commits, %v", len(log), err)
+	}
+	if ahead, behind, err := r.AheadBehind(c4, c5); err != nil || ahead != 2 || behind != 1 {
+		t.Errorf("AheadBehind: got %d %d, %v", ahead, behind, err)
+	}
+
+	if err := r.SetConfig("branch.topic.remote", "."); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetConfig("branch.topic.merge", head); err != nil {
+		t.Fatal(err)
+	}
+	b, err := r.Branch("topic", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Name != "topic" || b.Remote || !b.Target.Equal(c4) || b.Upstream != strings.TrimPrefix(head, "refs/heads/") {
+		t.Errorf("Branch: got %+v", b)
+	}
+	if _, err := r.Branch("topic", true); err == nil {
+		t.Errorf("Branch: topic is not a remote branch")
+	}
+	branches, err := r.Branches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(branches) != 2 {
+		t.Errorf("Branches: got %d, want 2", len(branches))
+	}
+}
+
+func TestRepoDiff(t *testing.T) {
+	r, done := testRepo(t)
+	defer done()
+
+	old := testTree(t, r, map[string]string{"a": "one\ntwo\n", "b": "gone\n", "d/e": "same\n"})
+	new := testTree(t, r, map[string]string{"a": "one\n2\n", "c": "new\n", "d/e": "same\n"})
+	deltas, err := r.DiffTrees(old, new, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range deltas {
+		got = append(got, gitDeltaString(d.Status)+" "+d.OldFile.Path+" "+d.NewFile.Path)
+	}
+	if want := []string{"Modified a a", "Deleted b b", "Added c c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffTrees: got %q, want %q", got, want)
+	}
+
+	patches, err := r.Patches(old, new, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patches) != 3 || !strings.Contains(patches[0], "-two\n+2\n") || !strings.Contains(patches[2], "+new\n") {
+		t.Errorf("Patches: got %q", patches)
+	}
+}
+
+func TestRepoDiffRenames(t *testing.T) {
+	r, done := testRepo(t)
+	defer done()
+
+	lines := func(pfx string, changed ...int) string {
+		var s string
+		for i := 1; i <= 20; i++ {
+			s += fmt.Sprintf("%s line number %d\n", pfx, i)
+			for _, c := range changed {
+				if c == i {
+					s += "changed\n"
+				}
+			}
+		}
+		return s
+	}
+	old := testTree(t, r, map[string]string{"a": lines("a"), "b": lines("b"), "c": lines("c")})
+	new := testTree(t, r, map[string]string{"moved": lines("a"), "b": lines("b", 1), "b2": lines("b", 5, 15), "c2": lines("c", 10)})
+
+	for _, tc := range []struct {
+		opts *DiffOptions
+		want []string
+	}{
+		{nil, []string{"Deleted a a", "Modified b b", "Added b2 b2", "Deleted c c", "Added c2 c2", "Added moved moved"}},
+		{&DiffOptions{Renames: true, RenameThreshold: 50}, []string{"Modified b b", "Added b2 b2", "Renamed c c2", "Renamed a moved"}},
+		{&DiffOptions{Renames: true, Copies: true, RenameThreshold: 50, CopyThreshold: 50}, []string{"Modified b b", "Copied b b2", "Renamed c c2", "Renamed a moved"}},
+	} {
+		deltas, err := r.DiffTrees(old, new, tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, d := range deltas {
+			got = append(got, gitDeltaString(d.Status)+" "+d.OldFile.Path+" "+d.NewFile.Path)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("DiffTrees(%+v): got %q, want %q", tc.opts, got, tc.want)
+			continue
+		}
+		patches, err := r.Patches(old, new, tc.opts)
+		if err != nil || len(patches) != len(deltas) {
+			t.Fatalf("Patches(%+v): got %d, %v", tc.opts, len(patches), err)
+		}
+		if tc.opts == nil {
+			continue
+		}
+		if d := deltas[len(deltas)-1]; d.Similarity != 100 {
+			t.Errorf("similarity of an exact rename: got %d", d.Similarity)
+		}
+		if d := deltas[len(deltas)-2]; d.Similarity < 50 || d.Similarity >= 100 {
+			t.Errorf("similarity of a rename with changes: got %d", d.Similarity)
+		}
+		if p := patches[len(deltas)-2]; !strings.Contains(p, "+changed\n") || strings.Contains(p, "-c line number 1\n") {
+			t.Errorf("patch of a rename with changes: got %q", p)
+		}
+	}
+}
+
+func TestRepoDiffOptions(t *testing.T) {
+	r, done := testRepo(t)
+	defer done()
+
+	var lines, changed string
+	for i := 1; i <= 20; i++ {
+		lines += fmt.Sprintf("line number %d\n", i)
+		if i == 10 {
+			changed += "changed\n"
+		} else {
+			changed += fmt.Sprintf("line number %d\n", i)
+		}
+	}
+	old := testTree(t, r, map[string]string{"a.go": lines, "gen/x.pb.go": "x\n", "vendor/lib/l.go": "l\n", "docs/vendor": "v\n", "ws": "a b\nc\n"})
+	new := testTree(t, r, map[string]string{"a.go": changed, "gen/x.pb.go": "y\n", "vendor/lib/l.go": "m\n", "docs/vendor": "w\n", "ws": "a  b\n\tc\n"})
+
+	for _, tc := range []struct {
+		opts *DiffOptions
+		want []string
+	}{
+		{nil, []string{"a.go", "docs/vendor", "gen/x.pb.go", "vendor/lib/l.go", "ws"}},
+		{&DiffOptions{Ignore: []string{"*.pb.go", "vendor/"}}, []string{"a.go", "docs/vendor", "ws"}},
+		{&DiffOptions{Ignore: []string{"/gen/*", "docs/vendor"}}, []string{"a.go", "vendor/lib/l.go", "ws"}},
+		{&DiffOptions{IgnoreWhitespace: true}, []string{"a.go", "docs/vendor", "gen/x.pb.go", "vendor/lib/l.go"}},
+	} {
+		deltas, err := r.DiffTrees(old, new, tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, d := range deltas {
+			got = append(got, d.NewFile.Path)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("DiffTrees(%+v): got %q, want %q", tc.opts, got, tc.want)
+		}
+		if patches, err := r.Patches(old, new, tc.opts); err != nil || len(patches) != len(deltas) {
+			t.Errorf("Patches(%+v): got %d, %v", tc.opts, len(patches), err)
+		}
+	}
+
+	for _, tc := range []struct {
+		opts      *DiffOptions
+		in, notIn string
+	}{
+		{nil, "\n line number 7\n", "\n line number 6\n"},
+		{&DiffOptions{Context: 1}, "\n line number 9\n", "\n line number 8\n"},
+		{&DiffOptions{Context: 5, Algorithm: "patience"}, "\n line number 5\n", "\n line number 4\n"},
+	} {
+		patches, err := r.Patches(old, new, tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p := patches[0]; !strings.Contains(p, "+changed\n") || !strings.Contains(p, tc.in) || strings.Contains(p, tc.notIn) {
+			t.Errorf("patch with %+v: got %q", tc.opts, p)
+		}
+	}
+}
+
+func TestRepoNotes(t *testing.T) {
+	r, done := testRepo(t)
+	defer done()
+
+	const ref = "refs/notes/scrutinize/test"
+	if _, err := r.Notes(ref); err != errNotFound {
+		t.Errorf("Notes of a missing ref: got %v, want errNotFound", err)
+	}
+	a, _ := NewOid("ce013625030ba8dba906f756967f9e9ca394464a")
+	b, _ := NewOid(emptyTree)
+	for _, n := range []struct {
+		id   *Oid
+		text string
+	}{{a, "first\n"}, {b, "review\n"}, {a, "first\nsecond\n"}} {
+		if err := r.SetNote(ref, n.id, n.text, testSig); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if text, err := r.Note(ref, a); err != nil || text != "first\nsecond\n" {
+		t.Errorf("Note: got %q, %v", text, err)
+	}
+	if _, err := r.Note(ref, &Oid{1}); err != errNotFound {
+		t.Errorf("missing Note: got %v, want errNotFound", err)
+	}
+	notes, err := r.Notes(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(notes, func(i, j int) bool { return notes[i].Id.String() < notes[j].Id.String() })
+	if len(notes) != 2 || !notes[0].Id.Equal(b) || notes[0].Message != "review\n" || !notes[1].Id.Equal(a) {
+		t.Errorf("Notes: got %v", notes)
+	}
+	log, err := r.Log(mustRef(t, r, ref), nil)
+	if err != nil || len(log) != 3 {
+		t.Errorf("notes ref history: got %d commits, %v", len(log), err)
+	}
+
+	if err := r.RemoveNote(ref, a, testSig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Note(ref, a); err != errNotFound {
+		t.Errorf("removed Note: got %v, want errNotFound", err)
+	}
+	if notes, err := r.Notes(ref); err != nil || len(notes) != 1 {
+		t.Errorf("Notes after RemoveNote: got %v, %v", notes, err)
+	}
+	if err := r.RemoveNote(ref, a, testSig); err != errNotFound {
+		t.Errorf("RemoveNote of a missing note: got %v, want errNotFound", err)
+	}
+
+	c := &Oid{1}
+	if err := r.SetNotes(ref, []*Note{{Id: a, Message: "again\n"}, {Id: c, Message: "other\n"}}, testSig); err != nil {
+		t.Fatal(err)
+	}
+	if notes, err := r.Notes(ref); err != nil || len(notes) != 3 {
+		t.Errorf("Notes after SetNotes: got %v, %v", notes, err)
+	}
+	if text, err := r.Note(ref, c); err != nil || text != "other\n" {
+		t.Errorf("Note after SetNotes: got %q, %v", text, err)
+	}
+	if log, err := r.Log(mustRef(t, r, ref), nil); err != nil || len(log) != 5 {
+		t.Errorf("SetNotes: got %d commits on the notes ref, %v, want one more", len(log), err)
+	}
+	if err := r.SetNotes("refs/notes/other", []*Note{{Id: c, Message: "new\n"}}, testSig); err != nil {
+		t.Fatal(err)
+	}
+	if text, err := r.Note("refs/notes/other", c); err != nil || text != "new\n" {
+		t.Errorf("SetNotes on a new ref: got %q, %v", text, err)
+	}
+
+	if err := r.DeleteRef(ref); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Ref(ref); err != errNotFound {
+		t.Errorf("Ref after DeleteRef: got %v, want errNotFound", err)
+	}
+	if err := r.DeleteRef(ref); err != errNotFound {
+		t.Errorf("DeleteRef of a missing ref: got %v, want errNotFound", err)
+	}
+}
+
+func mustRef(t *testing.T, r Repo, name string) *Oid {
+	id, err := r.Ref(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestRepoConfig(t *testing.T) {
+	r, done := testRepo(t)
+	defer done()
+
+	if err := r.SetConfig("branch.Feature.scrutinizeReview", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := r.ConfigString("branch.Feature.scrutinizeReview"); err != nil || v != "abc" {
+		t.Errorf("ConfigString: got %q, %v", v, err)
+	}
+	if _, err := r.ConfigString("no.such.key"); err != errNotFound {
+		t.Errorf("ConfigString of a missing key: got %v, want errNotFound", err)
+	}
+	entries, err := r.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, e := range entries {
+		if e.Name == "branch.Feature.scrutinizereview" && e.Value == "abc" && e.Level == ConfigLevelLocal {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Config: no local branch.Feature.scrutinizereview")
+	}
+	if sig, err := r.DefaultSignature(); err != nil || sig.Name != testSig.Name || sig.Email != testSig.Email {
+		t.Errorf("DefaultSignature: got %+v, %v", sig, err)
+	}
+
+	fname := filepath.Join(r.Workdir(), checkConfig)
+	if err := ioutil.WriteFile(fname, []byte("[check \"vet\"]\n\tcommand = go vet ./...\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = r.ReadConfig(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "check.vet.command" || entries[0].Value != "go vet ./..." || entries[0].Level != ConfigLevelApp {
+		t.Errorf("ReadConfig: got %v", entries)
+	}
+}
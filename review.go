@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/textproto"
+	"path"
+	"strings"
+	"sync"
+)
+
+// A Review is what the messages on a notes ref refs/notes/scrutinize/<Id> are about.
+// It is stored as a message with Kind: review in a note on the empty tree on that same ref,
+// so it travels with the notes. Updates append a new version, the last one is current.
+// The description, markdown for a cover letter, is kept apart in messages with Kind: description
+// in the same note, so that its edits have their own history.
+//
+// Branches only point to a review: either because the review lists them in Branches,
+// which matches local branches of that name and those of any remote, or
+// through the local git config branch.<name>.scrutinizeReview.
+//
+// Notes refs without such a message are reviews named after the branch (or commit)
+// they were made on, the way all reviews used to be.
+type Review struct {
+	Id           string
+	Title        string
+	Description  string
+	Base         string   // branch or ref to compare to, defaults to -baseline
+	Head         string   // branch or commit under review
+	Branches     []string // names of branches that point to this review
+	Participants []string
+}
+
+// the oid of the tree with no entries, which exists in every repository (or can be
+// made to with no side effects) and is never a commit.
+const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+func newReviewId() string { return hex.EncodeToString(mustRand(6)) }
+
+func reviewFromMessage(msg *Message) *Review {
+	return &Review{
+		Id:           msg.Header.Get("Id"),
+		Title:        msg.Header.Get("Title"),
+		Base:         msg.Header.Get("Base"),
+		Head:         msg.Header.Get("Head"),
+		Branches:     msg.Header["Branch"],
+		Participants: msg.Header["Participant"],
+	}
+}
+
+func (r *Review) Message() *Message {
+	msg := &Message{Header: textproto.MIMEHeader{}}
+	msg.Header.Set("Kind", "review")
+	msg.Header.Set("Id", r.Id)
+	for k, v := range map[string]string{"Title": r.Title, "Base": r.Base, "Head": r.Head} {
+		if v != "" {
+			msg.Header.Set(k, v)
+		}
+	}
+	for _, v := range r.Branches {
+		msg.Header.Add("Branch", v)
+	}
+	for _, v := range r.Participants {
+		msg.Header.Add("Participant", v)
+	}
+	return msg
+}
+
+// HasBranch reports whether branch, a branch name without its remote, points to r.
+func (r *Review) HasBranch(branch string) bool {
+	for _, b := range r.Branches {
+		if b == branch {
+			return true
+		}
+	}
+	return false
+}
+
+// gitReviewMessages returns the messages stored about the review itself on ref, oldest first.
+func (g *gitContext) gitReviewMessages(ref string) ([]*Message, error) {
+	id, err := NewOid(emptyTree)
+	if err != nil {
+		return nil, err
+	}
+	note, err := g.Note(ref, id)
+	if err == errNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*Message
+	r := bufio.NewReader(strings.NewReader(note))
+	for {
+		msg, err := ReadMessage(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Reading review on %s: %v", ref, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// A cachedReview is what gitReadReview read from a notes ref when it pointed at notes.
+type cachedReview struct {
+	notes *Oid
+	rev   *Review
+}
+
+// readReviews caches gitReadReview by repository and ref, so that resolving a branch
+// to its review doesn't parse the notes of every review again as long as they don't change.
+var readReviews sync.Map
+
+// gitReadReview returns the current version of the review stored on ref, or nil if there is none.
+// The Description is not filled in, see gitReview.
+func (g *gitContext) gitReadReview(ref string) (*Review, error) {
+	notes, _ := g.Ref(ref) // not cached if it doesn't resolve
+	key := g.Path() + " " + ref
+	if v, ok := readReviews.Load(key); ok && notes != nil && v.(*cachedReview).notes.Equal(notes) {
+		return v.(*cachedReview).rev.copy(), nil
+	}
+	msgs, err := g.gitReviewMessages(ref)
+	if err != nil {
+		return nil, err
+	}
+	var rev *Review
+	for _, msg := range msgs {
+		if msg.Header.Get("Kind") == "review" {
+			rev = reviewFromMessage(msg)
+		}
+	}
+	if notes != nil {
+		readReviews.Store(key, &cachedReview{notes, rev.copy()})
+	}
+	return rev, nil
+}
+
+// copy returns a copy of r that can be changed without changing r, nil for a nil r.
+func (r *Review) copy() *Review {
+	if r == nil {
+		return nil
+	}
+	c := *r
+	c.Branches = append([]string(nil), r.Branches...)
+	c.Participants = append([]string(nil), r.Participants...)
+	return &c
+}
+
+// gitDescriptions returns all versions of the description of review, oldest first.
+func (g *gitContext) gitDescriptions(review string) ([]*Message, error) {
+	ref, err := g.gitNotesRef(review)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := g.gitReviewMessages(ref)
+	if err != nil {
+		return nil, err
+	}
+	var r []*Message
+	for _, msg := range msgs {
+		if msg.Header.Get("Kind") == "description" {
+			r = append(r, msg)
+		}
+	}
+	return r, nil
+}
+
+// gitReviewIds lists the ids of all reviews that have notes.
+func (g *gitContext) gitReviewIds() ([]string, error) {
+	names, err := g.gitRefNames()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, n := range names {
+		if strings.HasPrefix(n, *refpfx+"/") {
+			ids = append(ids, strings.TrimPrefix(n, *refpfx+"/"))
+		}
+	}
+	return ids, nil
+}
+
+// An invalidReviewError is a review parameter that can't name a notes ref.
+type invalidReviewError struct{ review, reason string }
+
+func (e *invalidReviewError) Error() string {
+	return fmt.Sprintf("invalid review %q: %s", e.review, e.reason)
+}
+
+// checkReviewId returns an *invalidReviewError if id, under refpfx, isn't a ref name
+// git check-ref-format allows, or would lead out of refpfx.
+func checkReviewId(id string) error {
+	bad := func(reason string) error { return &invalidReviewError{id, reason} }
+	if id == "" || id == "@" {
+		return bad("empty")
+	}
+	if strings.Contains(id, "..") || strings.Contains(id, "@{") {
+		return bad("contains .. or @{")
+	}
+	if strings.IndexFunc(id, func(r rune) bool { return r < 0x20 || r == 0x7f || strings.ContainsRune(" ~^:?*[\\", r) }) >= 0 {
+		return bad("contains a control character, space or one of ~^:?*[\\")
+	}
+	for _, c := range strings.Split(id, "/") {
+		switch {
+		case c == "":
+			return bad("has an empty component")
+		case strings.HasPrefix(c, "."), strings.HasSuffix(c, "."), strings.HasSuffix(c, ".lock"):
+			return bad("has a component that starts or ends with a dot, or ends with .lock")
+		}
+	}
+	return nil
+}
+
+// gitReviewId resolves a review parameter as passed around the UI, API and command line
+// to the id of the review. The parameter can be a review id, a branch pointing to a review,
+// a branch or commit oid that has no review object, or "" for the current checkout.
+func (g *gitContext) gitReviewId(review string) (string, error) {
+	if review == "" {
+		if g.review != "" {
+			review = g.review
+		} else {
+			name, err := g.gitCheckoutName()
+			if err != nil {
+				return "", err
+			}
+			review = name
+		}
+	}
+	if err := checkReviewId(review); err != nil {
+		return "", err
+	}
+
+	branches := []string{review}
+	if b, err := g.Branch(review, false); err == nil {
+		if id, err := g.ConfigString(fmt.Sprintf("branch.%s.scrutinizeReview", review)); err == nil && id != "" {
+			if err := checkReviewId(id); err != nil {
+				return "", err
+			}
+			return id, nil
+		}
+		if b.Upstream != "" {
+			branches = append(branches, b.Upstream)
+		}
+	}
+
+	if _, err := g.Ref(path.Join(*refpfx, review)); err == nil {
+		return review, nil
+	}
+
+	remotes, err := g.gitRemotes()
+	if err != nil {
+		return "", err
+	}
+	for i, b := range branches {
+		branches[i] = trimRemote(b, remotes)
+	}
+	ids, err := g.gitReviewIds()
+	if err != nil {
+		return "", err
+	}
+	for _, id := range ids {
+		r, err := g.gitReadReview(path.Join(*refpfx, id))
+		if err != nil {
+			return "", err
+		}
+		for _, b := range branches {
+			if r != nil && r.HasBranch(b) {
+				return r.Id, nil
+			}
+		}
+	}
+	return review, nil
+}
+
+// gitCheckoutName returns the name of the branch HEAD is on. A detached HEAD,
+// as in a bisect or a CI checkout of a branch or tag, falls back to a branch
+// that points at the same commit, preferring local ones, without the remote
+// as reviews name branches, and finally to the oid of HEAD itself.
+func (g *gitContext) gitCheckoutName() (string, error) {
+	branch, head, err := g.Head()
+	if err != nil {
+		return "", err
+	}
+	if branch != "" {
+		return branch, nil
+	}
+
+	branches, err := g.Branches()
+	if err != nil {
+		return "", err
+	}
+	remotes, err := g.gitRemotes()
+	if err != nil {
+		return "", err
+	}
+	var remote string
+	for _, b := range branches {
+		if b.Target == nil || !b.Target.Equal(head) {
+			continue
+		}
+		if !b.Remote {
+			return b.Name, nil
+		}
+		if remote == "" && !strings.HasSuffix(b.Name, "/HEAD") {
+			remote = trimRemote(b.Name, remotes)
+		}
+	}
+	if remote != "" {
+		return remote, nil
+	}
+	return head.String(), nil
+}
+
+// gitReview returns the review object for review, see gitReviewId.
+// For reviews without one, it makes one up with the branch or commit as the head.
+func (g *gitContext) gitReview(review string) (*Review, error) {
+	id, err := g.gitReviewId(review)
+	if err != nil {
+		return nil, err
+	}
+	r, err := g.gitReadReview(path.Join(*refpfx, id))
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		r = &Review{Id: id, Head: id}
+	}
+	if r.Base == "" {
+		r.Base = *baseline
+	}
+	descr, err := g.gitDescriptions(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(descr) > 0 {
+		r.Description = descr[len(descr)-1].Body
+	}
+	return r, nil
+}
+
+// gitEmptyTree makes sure the empty tree exists so that git notes prune leaves the
+// notes on it alone.
+func (g *gitContext) gitEmptyTree() (*Oid, error) {
+	return g.CreateTree(nil)
+}
+
+// gitSaveReview appends a new version of r to its notes ref, and a new version of
+// its description if that changed.
+func (g *gitContext) gitSaveReview(r *Review) error {
+	id, err := g.gitEmptyTree()
+	if err != nil {
+		return err
+	}
+	if err := g.gitNoteAppend(r.Id, id, r.Message()); err != nil {
+		return err
+	}
+	// as it will read back from the note
+	r.Description = strings.Replace(r.Description, "\r\n", "\n", -1)
+	if r.Description != "" && !strings.HasSuffix(r.Description, "\n") {
+		r.Description += "\n"
+	}
+	descr, err := g.gitDescriptions(r.Id)
+	if err != nil {
+		return err
+	}
+	if len(descr) == 0 && r.Description == "" || len(descr) > 0 && descr[len(descr)-1].Body == r.Description {
+		return nil
+	}
+	msg := &Message{Header: textproto.MIMEHeader{}, Body: r.Description}
+	msg.Header.Set("Kind", "description")
+	return g.gitNoteAppend(r.Id, id, msg)
+}
+
+// gitAttachReview points the local branch at the review with id.
+func (g *gitContext) gitAttachReview(branch, id string) error {
+	return g.SetConfig(fmt.Sprintf("branch.%s.scrutinizeReview", branch), id)
+}
+
+// gitHead returns the commit under review.
+// The current checkout is always reviewed at HEAD, others at the head of their review,
+// which, if it is not a known branch, is looked for among the remote branches.
+func (g *gitContext) gitHead(review string) (*Oid, error) {
+	if review == "" {
+		_, head, err := g.Head()
+		return head, err
+	}
+	r, err := g.gitReview(review)
+	if err != nil {
+		return nil, err
+	}
+	return g.gitReviewHead(r)
+}
+
+// gitReviewHead returns the commit r is of, see gitHead.
+func (g *gitContext) gitReviewHead(r *Review) (*Oid, error) {
+	if id, err := g.Dwim(r.Head); err == nil {
+		return id, nil
+	}
+	if id, err := NewOid(r.Head); err == nil {
+		return id, nil
+	}
+	branches, err := g.Branches()
+	if err != nil {
+		return nil, err
+	}
+	// a renamed local branch takes its config, and so its review, along
+	for _, b := range branches {
+		if id, err := g.ConfigString(fmt.Sprintf("branch.%s.scrutinizeReview", b.Name)); !b.Remote && err == nil && id == r.Id {
+			return b.Target, nil
+		}
+	}
+	remotes, err := g.gitRemotes()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range branches {
+		if b.Remote && trimRemote(b.Name, remotes) == r.Head {
+			return b.Target, nil
+		}
+	}
+	return nil, fmt.Errorf("review %q: head %q is neither a branch nor a commit", r.Id, r.Head)
+}
+
+// gitBase returns the commit review is compared to.
+func (g *gitContext) gitBase(review string) (*Oid, error) {
+	r, err := g.gitReview(review)
+	if err != nil {
+		return nil, err
+	}
+	return g.gitReviewBase(r)
+}
+
+// gitReviewBase returns the commit r is compared to, see gitBase.
+func (g *gitContext) gitReviewBase(r *Review) (*Oid, error) {
+	id, err := g.Dwim(r.Base)
+	if err != nil {
+		if oid, err := NewOid(r.Base); err == nil {
+			return oid, nil
+		}
+	}
+	return id, err
+}
+
+// checkReviewRefs returns an *invalidReviewError if the base or head of r, which defaults
+// to baseline, isn't a commit in the repository.
+func (g *gitContext) checkReviewRefs(r *Review) error {
+	base := *r
+	if base.Base == "" {
+		base.Base = *baseline
+	}
+	for _, c := range []struct {
+		what    string
+		resolve func(*Review) (*Oid, error)
+	}{{"base " + base.Base, g.gitReviewBase}, {"head " + r.Head, g.gitReviewHead}} {
+		id, err := c.resolve(&base)
+		if err == nil {
+			_, err = g.Commit(id)
+		}
+		if err != nil {
+			return &invalidReviewError{r.Id, c.what + " is not a commit"}
+		}
+	}
+	return nil
+}
+
+// gitNotesRef returns the ref the messages of review are stored on.
+func (g *gitContext) gitNotesRef(review string) (string, error) {
+	id, err := g.gitReviewId(review)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(*refpfx, id), nil
+}
+
+// gitNewReview makes a new review of head, a branch or commit, or the current checkout if "".
+// Branches that already have notes keep them: the review takes over their id.
+func (g *gitContext) gitNewReview(title, base, head string) (*Review, error) {
+	if head == "" {
+		name, err := g.gitCheckoutName()
+		if err != nil {
+			return nil, err
+		}
+		head = name
+	}
+	if err := checkReviewId(head); err != nil {
+		return nil, err
+	}
+	r := &Review{Id: newReviewId(), Title: title, Base: base, Head: head}
+
+	if _, err := g.Ref(path.Join(*refpfx, head)); err == nil {
+		if old, err := g.gitReadReview(path.Join(*refpfx, head)); err != nil {
+			return nil, err
+		} else if old != nil {
+			return nil, &invalidReviewError{head, "it already has a review"}
+		}
+		r.Id = head
+	}
+	if err := g.checkReviewRefs(r); err != nil {
+		return nil, err
+	}
+
+	remotes, err := g.gitRemotes()
+	if err != nil {
+		return nil, err
+	}
+	local := false
+	if b, err := g.Branch(head, false); err == nil {
+		local = true
+		r.Branches = []string{head}
+		if b.Upstream != "" && trimRemote(b.Upstream, remotes) != head {
+			r.Branches = append(r.Branches, trimRemote(b.Upstream, remotes))
+		}
+	} else if _, err := g.Branch(head, true); err == nil {
+		r.Branches = []string{trimRemote(head, remotes)}
+	}
+
+	if err := g.gitSaveReview(r); err != nil {
+		return nil, err
+	}
+	if local {
+		// so that the review follows the branch through git branch -m, see gitHead
+		if err := g.gitAttachReview(head, r.Id); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// trimRemote strips the remote, one of remotes, from a remote branch name, "origin/feature"
+// becomes "feature". Other names, like a local "fix/feature", are returned as they are.
+func trimRemote(branch string, remotes []string) string {
+	r := branch
+	for _, remote := range remotes {
+		if s := strings.TrimPrefix(branch, remote+"/"); s != branch && len(s) < len(r) {
+			r = s // the longest remote, which may have a / in its name
+		}
+	}
+	return r
+}
+
+// gitRemotes returns the names of the configured remotes.
+func (g *gitContext) gitRemotes() ([]string, error) {
+	entries, err := g.Config()
+	if err != nil {
+		return nil, err
+	}
+	var r []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name, "remote.") && strings.HasSuffix(e.Name, ".url") {
+			r = append(r, strings.TrimSuffix(strings.TrimPrefix(e.Name, "remote."), ".url"))
+		}
+	}
+	return r, nil
+}
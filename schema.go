@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/textproto"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The version of the message format written in the Scrutinize-Version header.
+// Messages without one are from before there was a schema.
+const messageVersion = "1"
+
+type headerType int
+
+const (
+	hdrText headerType = iota // a line of text
+	hdrTime                   // RFC3339
+	hdrInt                    // a positive decimal
+	hdrHex                    // object and message ids
+	hdrPath                   // relative slash separated path
+	hdrEnum                   // one of the values in the spec
+)
+
+type headerSpec struct {
+	typ    headerType
+	values []string // for hdrEnum
+	multi  bool     // may occur more than once
+	server bool     // only written by the server, clients can't set it
+	read   bool     // only added when reading, never stored
+}
+
+// messageSchema lists the headers a Message can have.
+// Writing is strict, see validateClient and Validate.  Reading is tolerant:
+// unknown headers and values are kept and left for the UI to ignore.
+var messageSchema = map[string]headerSpec{
+	"Scrutinize-Version": {typ: hdrInt, server: true},
+	"Author":             {typ: hdrText, server: true},
+	"Date":               {typ: hdrTime, server: true},
+	"Message-Id":         {typ: hdrHex, server: true},
+	"Signature":          {typ: hdrText, server: true},
+	"Origin":             {typ: hdrText, server: true}, // where an imported message came from, eg. github:1234
+	"Bot":                {typ: hdrText, server: true}, // the tool that reported a finding, see findings.go
+	"Rule":               {typ: hdrText, server: true},
+	"Fingerprint":        {typ: hdrHex, server: true},
+	"Outdated":           {typ: hdrEnum, values: []string{"true"}, server: true},
+	"Check":              {typ: hdrText, server: true}, // the outcome of a check, see checks.go
+	"Result":             {typ: hdrEnum, values: []string{"pass", "fail"}, server: true},
+	"Pending":            {typ: hdrEnum, values: []string{scopeIndex, scopeWorkdir}, server: true}, // made on uncommitted work, see pending.go
+
+	// what the message is about
+	"File": {typ: hdrPath},
+	"Line": {typ: hdrInt},
+
+	// what it says besides the body
+	"Status":     {typ: hdrEnum, values: []string{"open", "resolved"}},
+	"Vote":       {typ: hdrEnum, values: []string{"approve", "reject"}},
+	"Supersedes": {typ: hdrHex},
+	"Retracted":  {typ: hdrEnum, values: []string{"true"}},
+
+	// messages about the review itself, see Review
+	"Kind":        {typ: hdrEnum, values: []string{"review", "description"}, server: true},
+	"Id":          {typ: hdrText, server: true},
+	"Title":       {typ: hdrText, server: true},
+	"Base":        {typ: hdrText, server: true},
+	"Head":        {typ: hdrText, server: true},
+	"Branch":      {typ: hdrText, server: true, multi: true},
+	"Participant": {typ: hdrText, server: true, multi: true},
+
+	// supplied by gitNotes
+	"Commit":           {typ: hdrHex, read: true},
+	"Review":           {typ: hdrText, read: true},
+	"Signature-Status": {typ: hdrEnum, values: []string{sigVerified, sigUnverified, sigInvalid}, read: true},
+	"Edited":           {typ: hdrTime, read: true},
+	"Draft":            {typ: hdrEnum, values: []string{"true"}, read: true}, // by gitDrafts
+}
+
+var hexRe = regexp.MustCompile(`^[0-9a-f]+$`)
+
+func (s headerSpec) check(v string) error {
+	switch s.typ {
+	case hdrText:
+		if canonicalValue(v) != v {
+			return fmt.Errorf("%q contains control characters or surrounding space", v)
+		}
+	case hdrTime:
+		if _, err := time.Parse(time.RFC3339, v); err != nil {
+			return err
+		}
+	case hdrInt:
+		if n, err := strconv.Atoi(v); err != nil || n < 0 || strconv.Itoa(n) != v {
+			return fmt.Errorf("%q is not a number", v)
+		}
+	case hdrHex:
+		if !hexRe.MatchString(v) {
+			return fmt.Errorf("%q is not a hex id", v)
+		}
+	case hdrPath:
+		if v == "" || strings.HasPrefix(v, "/") || path.Clean(v) != v || v == ".." || strings.HasPrefix(v, "../") {
+			return fmt.Errorf("%q is not a clean relative path", v)
+		}
+	case hdrEnum:
+		for _, e := range s.values {
+			if v == e {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", v, strings.Join(s.values, ", "))
+	}
+	return nil
+}
+
+// validHeaderKey reports whether k can be written as a header key.
+func validHeaderKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for _, c := range k {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateClient checks the headers a client wants to set on a new message.
+func validateClient(hdr textproto.MIMEHeader) error {
+	for k := range hdr {
+		if s, ok := messageSchema[k]; ok && (s.server || s.read) {
+			return fmt.Errorf("header %s can not be set", k)
+		}
+	}
+	return validateHeader(hdr)
+}
+
+// validateHeader checks hdr against the schema.
+func validateHeader(hdr textproto.MIMEHeader) error {
+	for k, vv := range hdr {
+		s, ok := messageSchema[k]
+		if !ok {
+			return fmt.Errorf("unknown header %s", k)
+		}
+		if s.read {
+			return fmt.Errorf("header %s is not stored", k)
+		}
+		if len(vv) > 1 && !s.multi {
+			return fmt.Errorf("header %s occurs %d times", k, len(vv))
+		}
+		for _, v := range vv {
+			if err := s.check(v); err != nil {
+				return fmt.Errorf("header %s: %v", k, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks that msg is fit to be stored, see gitNoteAppend.
+func (msg *Message) Validate() error {
+	for _, k := range []string{"Scrutinize-Version", "Author", "Date", "Message-Id"} {
+		if msg.Header.Get(k) == "" {
+			return fmt.Errorf("missing header %s", k)
+		}
+	}
+	return validateHeader(msg.Header)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// A testServer serves the UI like main does, to a client that keeps its cookies and doesn't follow redirects.
+type testServer struct {
+	t      *testing.T
+	srv    *httptest.Server
+	client *http.Client
+	port   string
+	exit   chan bool
+}
+
+// newTestServer serves h, or the UI on repos if h is nil, behind onlyOne.
+func newTestServer(t *testing.T, h http.Handler, repos ...*gitContext) (*testServer, func()) {
+	onlyclient.Lock()
+	onlyclient.Value = ""
+	onlyclient.Unlock()
+	oldTmpl, oldWeb := *tmplroot, *webroot
+	*tmplroot, *webroot = "t", "s"
+
+	ts := &testServer{t: t, srv: httptest.NewUnstartedServer(nil), exit: make(chan bool)}
+	_, ts.port, _ = net.SplitHostPort(ts.srv.Listener.Addr().String())
+	if h == nil {
+		h = newRouter(repos, ts.exit)
+	}
+	ts.srv.Config.Handler = logHandler(onlyOne(h, ts.port), false)
+	ts.srv.Start()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.client = &http.Client{
+		Jar:           jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return ts, func() {
+		ts.srv.Close()
+		*tmplroot, *webroot = oldTmpl, oldWeb
+	}
+}
+
+func (ts *testServer) cookie(name string) string {
+	u, _ := url.Parse(ts.srv.URL)
+	for _, c := range ts.client.Jar.Cookies(u) {
+		if c.Name == name {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// do requests path, posting form, if not nil, with the xsrf header the UI's javascript sets.
+func (ts *testServer) do(method, path string, form url.Values) (int, string) {
+	req, err := http.NewRequest(method, ts.srv.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if tok := ts.cookie("XSRF-TOKEN"); tok != "" && method != "GET" {
+		req.Header.Set("X-XSRF-TOKEN", tok)
+	}
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestOnlyOne(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	ts, done := newTestServer(t, ok)
+	defer done()
+
+	if status, _ := ts.do("GET", "/", nil); status != http.StatusOK {
+		t.Fatalf("first request: got %d", status)
+	}
+	session, xsrf := ts.cookie("SESSION-"+ts.port), ts.cookie("XSRF-TOKEN")
+	if session == "" || xsrf == "" {
+		t.Fatalf("no session or xsrf cookie: %q %q", session, xsrf)
+	}
+	if status, body := ts.do("POST", "/", url.Values{}); status != http.StatusOK || body != "ok" {
+		t.Errorf("POST with cookies and header: got %d %q", status, body)
+	}
+
+	// somebody else, without the session cookie
+	other := &http.Client{}
+	resp, err := other.Get(ts.srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("request without session cookie: got %d", resp.StatusCode)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		xsrfCookie string
+		xsrfHeader string
+		want       string
+	}{
+		{"no xsrf cookie", "", xsrf, "Missing xsrf cookie"},
+		{"forged xsrf cookie", "forged", "forged", "Invalid xsrf cookie"},
+		{"no xsrf header", xsrf, "", "Invalid or missing xsrf header"},
+		{"wrong xsrf header", xsrf, "forged", "Invalid or missing xsrf header"},
+	} {
+		req, _ := http.NewRequest("POST", ts.srv.URL+"/", nil)
+		req.AddCookie(&http.Cookie{Name: "SESSION-" + ts.port, Value: session})
+		if tc.xsrfCookie != "" {
+			req.AddCookie(&http.Cookie{Name: "XSRF-TOKEN", Value: tc.xsrfCookie})
+		}
+		if tc.xsrfHeader != "" {
+			req.Header.Set("X-XSRF-TOKEN", tc.xsrfHeader)
+		}
+		resp, err := other.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(string(body), tc.want) {
+			t.Errorf("%s: got %d %q, want 401 %q", tc.name, resp.StatusCode, body, tc.want)
+		}
+	}
+}
+
+func TestServePages(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+	ts, stop := newTestServer(t, nil, f.gitContext)
+	defer stop()
+
+	rev, err := f.gitNewReview("A topic", "", "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.comment(rev.Id, f.c1, "Alice <alice@example.com>", "why 2?", "File", "a", "Line", "2")
+	a, err := f.gitBlobId("topic", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/", http.StatusMovedPermanently, ""},
+		{"/commits", http.StatusNotFound, ""},
+		{"/r/test/reviews", http.StatusOK, "A topic"},
+		{"/r/test/commits", http.StatusOK, "Replace b with dir/c"},
+		{"/r/test/commits?review=topic", http.StatusOK, "why 2?"},
+		{"/r/test/commits?review=topic", http.StatusOK, `<span class="replies-counter">1 comment</span>`},
+		{"/r/test/tree/?review=topic", http.StatusOK, "dir/"},
+		{"/r/test/tree/dir?review=topic", http.StatusOK, ">c<"},
+		{"/r/test/blob/" + a.String() + "?dir=&name=a&review=topic", http.StatusOK, "three"},
+		{"/r/test/diffs?review=topic", http.StatusOK, "dir/c"},
+		{"/r/test/settings", http.StatusOK, "user.email"},
+		{"/r/test/file?review=topic&path=dir/c", http.StatusFound, ""},
+		{"/r/test/file?review=topic&path=b", http.StatusNotFound, ""},
+		{"/r/test/export?review=topic&format=json", http.StatusOK, f.c2.String()},
+		{"/r/test/export?review=topic&format=doc", http.StatusBadRequest, "unknown format"},
+		{"/r/test/api/v1/reviews", http.StatusOK, rev.Id},
+		{"/r/test/api/v1/reviews/" + rev.Id, http.StatusOK, "A topic"},
+		{"/scrutinize.css", http.StatusOK, ""},
+		{"/nope.html", http.StatusNotFound, ""},
+	} {
+		status, body := ts.do("GET", tc.path, nil)
+		if status != tc.status || !strings.Contains(body, tc.want) {
+			t.Errorf("GET %s: got %d, want %d with %q in\n%s", tc.path, status, tc.status, tc.want, body)
+		}
+	}
+
+	if status, body := ts.do("GET", "/quit", nil); status != http.StatusOK || body != "Bye..." {
+		t.Errorf("GET /quit: got %d %q", status, body)
+	}
+	select {
+	case <-ts.exit:
+	default:
+		t.Errorf("GET /quit didn't close exit")
+	}
+}
+
+func TestServeAPI(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+	ts, stop := newTestServer(t, nil, f.gitContext)
+	defer stop()
+	ts.do("GET", "/r/test/reviews", nil) // sets the cookies
+
+	status, body := ts.do("POST", "/r/test/api/v1/reviews", url.Values{"title": {"A topic"}, "head": {"topic"}})
+	var rev Review
+	if err := json.Unmarshal([]byte(body), &rev); status != http.StatusOK || err != nil || rev.Id == "" {
+		t.Fatalf("POST /r/test/api/v1/reviews: got %d %q", status, body)
+	}
+	status, body = ts.do("POST", "/r/test/api/v1/reviews/"+rev.Id, url.Values{"description": {"More of a"}})
+	if status != http.StatusOK || !strings.Contains(body, "More of a") {
+		t.Errorf("POST /r/test/api/v1/reviews/%s: got %d %q", rev.Id, status, body)
+	}
+	for _, tc := range []struct {
+		path string
+		form url.Values
+	}{
+		{"/r/test/api/v1/reviews", url.Values{"title": {"Again"}, "head": {rev.Id}}},
+		{"/r/test/api/v1/reviews", url.Values{"title": {"Nowhere"}, "head": {"nope"}}},
+		{"/r/test/api/v1/reviews", url.Values{"title": {"Bad base"}, "head": {"master"}, "base": {"nope"}}},
+		{"/r/test/api/v1/reviews/" + rev.Id, url.Values{"base": {"nope"}}},
+	} {
+		if status, body := ts.do("POST", tc.path, tc.form); status != http.StatusBadRequest {
+			t.Errorf("POST %s %v: got %d %q, want 400", tc.path, tc.form, status, body)
+		}
+	}
+
+	alice := f.comment(rev.Id, f.c1, "Alice <alice@example.com>", "why 2?")
+	notes := "/r/test/api/v1/commits/" + f.c1.String() + "/notes"
+	for _, tc := range []struct {
+		path   string
+		form   url.Values
+		status int
+	}{
+		{notes, url.Values{"review": {rev.Id}, "text": {"because"}, "file": {"a"}, "line": {"2"}}, http.StatusNoContent},
+		{notes, url.Values{"review": {rev.Id}, "text": {"LGTM"}, "vote": {"approve"}, "status": {""}}, http.StatusNoContent},
+		{notes, url.Values{"review": {rev.Id}, "text": {"maybe"}, "vote": {"maybe"}}, http.StatusBadRequest},
+		{notes, url.Values{"review": {rev.Id}, "text": {"I am a bot"}, "bot": {"vet"}}, http.StatusBadRequest},
+		{notes, url.Values{"review": {rev.Id}, "text": {"why not"}, "supersedes": {alice.Header.Get("Message-Id")}}, http.StatusForbidden},
+		{notes, url.Values{"review": {rev.Id}, "text": {"?"}, "supersedes": {"0123abcd"}}, http.StatusNotFound},
+		{"/r/test/api/v1/commits/xyz/notes", url.Values{"review": {rev.Id}, "text": {"?"}}, http.StatusBadRequest},
+		{notes, url.Values{"review": {"../../heads/master"}, "text": {"sneaky"}}, http.StatusBadRequest},
+		{"/r/test/api/v1/drafts/publish", url.Values{"review": {"../../heads/master"}, "text": {"sneaky"}}, http.StatusBadRequest},
+		{"/r/test/api/v1/pending", url.Values{"review": {"/heads//master"}, "text": {"sneaky"}}, http.StatusBadRequest},
+	} {
+		if status, body := ts.do("POST", tc.path, tc.form); status != tc.status {
+			t.Errorf("POST %s %v: got %d %q, want %d", tc.path, tc.form, status, body, tc.status)
+		}
+	}
+
+	if master, err := f.Ref("refs/heads/master"); err != nil || !master.Equal(f.base) {
+		t.Errorf("master after POSTs with invalid reviews: got %v, %v, want %v", master, err, f.base)
+	}
+	if status, body := ts.do("GET", "/r/test/commits?review=../../heads/master", nil); status != http.StatusBadRequest {
+		t.Errorf("GET /r/test/commits with an invalid review: got %d %q", status, body)
+	}
+
+	msgs, err := f.gitNotes(rev.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msgs[f.c1.String()]; len(got) != 3 || got[1].Header.Get("Line") != "2" || got[2].Header.Get("Vote") != "approve" {
+		t.Errorf("notes after POSTs: got %v", got)
+	}
+
+	// without the xsrf header nothing gets written
+	req, _ := http.NewRequest("POST", ts.srv.URL+notes, strings.NewReader(url.Values{"review": {rev.Id}, "text": {"sneaky"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("POST without xsrf header: got %d", resp.StatusCode)
+	}
+}
+
+func TestServeRepos(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+	other, done := newFixture(t)
+	defer done()
+	other.Name = "other"
+	other.commit("master", "Elsewhere", map[string]string{"x": "ex\n"})
+	ts, stop := newTestServer(t, nil, f.gitContext, other.gitContext)
+	defer stop()
+
+	rev, err := f.gitNewReview("A topic", "", "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/", http.StatusOK, `href="/r/other/commits"`},
+		{"/r/test/commits", http.StatusOK, "Replace b with dir/c"},
+		{"/r/other/reviews", http.StatusOK, `href="/r/other/settings"`},
+		{"/r/other/tree/", http.StatusOK, ">x<"},
+		{"/r/test/api/v1/reviews", http.StatusOK, rev.Id},
+		{"/r/nope/commits", http.StatusNotFound, ""},
+	} {
+		status, body := ts.do("GET", tc.path, nil)
+		if status != tc.status || !strings.Contains(body, tc.want) {
+			t.Errorf("GET %s: got %d, want %d with %q in\n%s", tc.path, status, tc.status, tc.want, body)
+		}
+	}
+	if _, body := ts.do("GET", "/r/other/api/v1/reviews", nil); strings.Contains(body, rev.Id) {
+		t.Errorf("the review in test shows up in other: %s", body)
+	}
+}
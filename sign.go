@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Messages are signed the way git signs commits, with the key in user.signingkey
+// using gpg or, if gpg.format is ssh, ssh-keygen.  The signature is over the encoding
+// of the message by WriteTo without the Signature header, and with Commit and Review
+// headers for the commit the note is on and the review it is in, so that a signed message
+// can't be copied to another commit or review.  It is stored in the Signature header
+// as the format followed by the base64 of the armored signature.
+//
+// On reading, messages get a Signature-Status header: verified if the signature is good
+// and made by the Author, invalid if it is bad, and unverified otherwise, including
+// when there is no signature at all.
+const (
+	sigVerified   = "verified"
+	sigUnverified = "unverified"
+	sigInvalid    = "invalid"
+)
+
+// SSH signatures are made in their own namespace, so that they can't pass for
+// signatures of anything else.  Entries in gpg.ssh.allowedSignersFile that restrict
+// namespaces must include it.
+const sshNamespace = "scrutinize"
+
+type signer struct {
+	format         string // openpgp or ssh
+	program        string
+	key            string // user.signingkey, empty if we're not signing
+	allowedSigners string // gpg.ssh.allowedSignersFile
+	keyring        string // what the keys and trust were when the signer was made, see keyringState
+}
+
+// signerErrs has the names of the repositories whose gitSigner error has been logged.
+var signerErrs sync.Map
+
+func (g *gitContext) configString(name, def string) string {
+	if v, err := g.ConfigString(name); err == nil && v != "" {
+		return v
+	}
+	return def
+}
+
+// gitSigner returns the signer as configured in git.
+func (g *gitContext) gitSigner() (*signer, error) {
+	s := &signer{
+		format:         g.configString("gpg.format", "openpgp"),
+		key:            g.configString("user.signingkey", ""),
+		allowedSigners: g.configString("gpg.ssh.allowedSignersFile", ""),
+	}
+	switch s.format {
+	case "openpgp":
+		s.program = g.configString("gpg.openpgp.program", g.configString("gpg.program", "gpg"))
+	case "ssh":
+		s.program = g.configString("gpg.ssh.program", "ssh-keygen")
+	default:
+		return nil, fmt.Errorf("unsupported gpg.format %q", s.format)
+	}
+	s.keyring = keyringState(s.allowedSigners)
+	return s, nil
+}
+
+// keyringState returns the size and modification time of the files verification depends on,
+// the allowed signers and gpg's keyrings and trust database, so that the verifications
+// cached under it don't outlive a revoked key or changed trust.
+func keyringState(allowedSigners string) string {
+	home := os.Getenv("GNUPGHOME")
+	if home == "" {
+		if dir, err := os.UserHomeDir(); err == nil {
+			home = filepath.Join(dir, ".gnupg")
+		}
+	}
+	var b strings.Builder
+	for _, f := range []string{allowedSigners, filepath.Join(home, "pubring.kbx"), filepath.Join(home, "pubring.gpg"), filepath.Join(home, "trustdb.gpg")} {
+		if fi, err := os.Stat(f); err == nil {
+			fmt.Fprintf(&b, "%s %d %d\n", f, fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	return b.String()
+}
+
+// signedContent returns what the signature of msg, in a note on commit in review, is over.
+func signedContent(msg *Message, commit *Oid, review string) []byte {
+	m := Message{Header: textproto.MIMEHeader{}, Body: msg.Body}
+	for k, v := range msg.Header {
+		if k != "Signature" {
+			m.Header[k] = v
+		}
+	}
+	m.Header.Set("Commit", commit.String())
+	m.Header.Set("Review", review)
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	m.WriteTo(w)
+	w.Flush()
+	return buf.Bytes()
+}
+
+// sign sets the Signature header of msg, to go in a note on commit in review.
+func (s *signer) sign(msg *Message, commit *Oid, review string) error {
+	msg.Header.Del("Signature")
+	data := signedContent(msg, commit, review)
+
+	var armored []byte
+	switch s.format {
+	case "openpgp":
+		cmd := exec.Command(s.program, "--status-fd=2", "-bsau", s.key)
+		cmd.Stdin = bytes.NewReader(data)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("%s failed to sign: %v\n%s", s.program, err, stderr.Bytes())
+		}
+		armored = out
+
+	case "ssh":
+		dir, err := ioutil.TempDir("", "scrutinize-sign")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		fname := dir + "/msg"
+		if err := ioutil.WriteFile(fname, data, 0600); err != nil {
+			return err
+		}
+		args := []string{"-Y", "sign", "-n", sshNamespace}
+		key := strings.TrimPrefix(s.key, "key::")
+		if key != s.key || strings.HasPrefix(key, "ssh-") {
+			// a literal public key, the private one is in the agent
+			if err := ioutil.WriteFile(dir+"/key.pub", []byte(key), 0600); err != nil {
+				return err
+			}
+			args = append(args, "-U", "-f", dir+"/key.pub")
+		} else {
+			args = append(args, "-f", key)
+		}
+		if out, err := exec.Command(s.program, append(args, fname)...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s failed to sign: %v\n%s", s.program, err, out)
+		}
+		if armored, err = ioutil.ReadFile(fname + ".sig"); err != nil {
+			return err
+		}
+	}
+
+	msg.Header.Set("Signature", s.format+" "+base64.StdEncoding.EncodeToString(armored))
+	return nil
+}
+
+// verified caches the results of check, by what they depend on, including the keyring.
+// It starts over when it has maxVerified of them, which takes care of the stale ones as well.
+var verified = struct {
+	sync.Mutex
+	m map[[sha1.Size]byte]string
+}{m: map[[sha1.Size]byte]string{}}
+
+const maxVerified = 10000
+
+// verify returns the Signature-Status of msg, in a note on commit in review.
+func (s *signer) verify(msg *Message, commit *Oid, review string) string {
+	format, sig := "", msg.Header.Get("Signature")
+	if i := strings.IndexByte(sig, ' '); i > 0 {
+		format, sig = sig[:i], sig[i+1:]
+	}
+	if sig == "" {
+		return sigUnverified
+	}
+	armored, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return sigInvalid
+	}
+	data := signedContent(msg, commit, review)
+	author := msg.Header.Get("Author")
+	if a, err := mail.ParseAddress(author); err == nil {
+		author = a.Address
+	}
+
+	h := sha1.New()
+	for _, v := range [][]byte{[]byte(format), armored, data, []byte(author), []byte(s.allowedSigners), []byte(s.keyring)} {
+		h.Write(v)
+		h.Write([]byte{0})
+	}
+	var key [sha1.Size]byte
+	copy(key[:], h.Sum(nil))
+	verified.Lock()
+	st, ok := verified.m[key]
+	verified.Unlock()
+	if ok {
+		return st
+	}
+
+	st = s.check(format, armored, data, author)
+	verified.Lock()
+	if len(verified.m) >= maxVerified {
+		verified.m = map[[sha1.Size]byte]string{}
+	}
+	verified.m[key] = st
+	verified.Unlock()
+	return st
+}
+
+func (s *signer) check(format string, armored, data []byte, author string) string {
+	dir, err := ioutil.TempDir("", "scrutinize-verify")
+	if err != nil {
+		return sigUnverified
+	}
+	defer os.RemoveAll(dir)
+	sigfile := dir + "/msg.sig"
+	if err := ioutil.WriteFile(sigfile, armored, 0600); err != nil {
+		return sigUnverified
+	}
+
+	switch format {
+	case "openpgp":
+		program := s.program
+		if s.format != "openpgp" {
+			program = "gpg"
+		}
+		cmd := exec.Command(program, "--status-fd=1", "--keyid-format=long", "--verify", sigfile, "-")
+		cmd.Stdin = bytes.NewReader(data)
+		out, _ := cmd.Output() // exit status is non-zero for anything but a good signature, the status lines tell us more
+		return gpgStatus(out, author)
+
+	case "ssh":
+		program := s.program
+		if s.format != "ssh" {
+			program = "ssh-keygen"
+		}
+		if s.allowedSigners != "" {
+			cmd := exec.Command(program, "-Y", "verify", "-f", s.allowedSigners, "-I", author, "-n", sshNamespace, "-s", sigfile)
+			cmd.Stdin = bytes.NewReader(data)
+			if cmd.Run() == nil {
+				return sigVerified
+			}
+		}
+		cmd := exec.Command(program, "-Y", "check-novalidate", "-n", sshNamespace, "-s", sigfile)
+		cmd.Stdin = bytes.NewReader(data)
+		if cmd.Run() == nil {
+			return sigUnverified // a good signature, but not by a key we know to be the author's
+		}
+		return sigInvalid
+	}
+	return sigUnverified
+}
+
+// gpgStatus interprets the output of gpg --status-fd.  A signature is verified if it is good
+// and valid, by a key gpg trusts fully or ultimately, with the author in its uid: anyone can
+// make a key with any uid, so without the trust a good signature says nothing about who made it.
+func gpgStatus(out []byte, author string) string {
+	var good, valid, trusted bool
+	for _, l := range strings.Split(string(out), "\n") {
+		f := strings.Fields(strings.TrimPrefix(l, "[GNUPG:] "))
+		if len(f) == 0 {
+			continue
+		}
+		switch f[0] {
+		case "BADSIG":
+			return sigInvalid
+		case "GOODSIG":
+			good = len(f) > 2 && strings.Contains(strings.Join(f[2:], " "), "<"+author+">")
+		case "VALIDSIG":
+			valid = true
+		case "TRUST_FULLY", "TRUST_ULTIMATE":
+			trusted = true
+		case "EXPKEYSIG", "REVKEYSIG":
+			return sigUnverified
+		}
+	}
+	if good && valid && trusted {
+		return sigVerified
+	}
+	return sigUnverified
+}
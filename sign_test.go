@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testSSHKey makes an ssh key in dir, and an allowed signers file with it for email.
+func testSSHKey(t *testing.T, dir, email string) (key string, pub []byte, allowed string) {
+	t.Helper()
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("no ssh-keygen")
+	}
+	key = filepath.Join(dir, "id")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "", "-f", key).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen: %v\n%s", err, out)
+	}
+	pub, err := ioutil.ReadFile(key + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed = filepath.Join(dir, "allowed_signers")
+	if err := ioutil.WriteFile(allowed, []byte(email+" "+string(pub)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return key, pub, allowed
+}
+
+func TestSSHSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scrutinize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, pub, allowed := testSSHKey(t, dir, "alice@example.com")
+
+	s := &signer{format: "ssh", program: "ssh-keygen", key: key, allowedSigners: allowed, keyring: keyringState(allowed)}
+	msg := &Message{Header: textproto.MIMEHeader{}, Body: "LGTM\n"}
+	msg.Header.Set("Author", "Alice <alice@example.com>")
+	msg.Header.Set("Vote", "approve")
+	commit, other := &Oid{1}, &Oid{2}
+	if err := s.sign(msg, commit, "r1"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(msg.Header.Get("Signature"), "ssh ") {
+		t.Fatalf("Signature: %q", msg.Header.Get("Signature"))
+	}
+
+	if st := s.verify(msg, commit, "r1"); st != sigVerified {
+		t.Errorf("signed message is %s", st)
+	}
+	if st := (&signer{format: "ssh", program: "ssh-keygen"}).verify(msg, commit, "r1"); st != sigUnverified {
+		t.Errorf("signed message without allowed signers is %s", st)
+	}
+	if st := s.verify(msg, other, "r1"); st != sigInvalid {
+		t.Errorf("signed message moved to another commit is %s", st)
+	}
+	if st := s.verify(msg, commit, "r2"); st != sigInvalid {
+		t.Errorf("signed message moved to another review is %s", st)
+	}
+
+	// the key is no longer alice's, which the cached verification mustn't hide
+	if err := ioutil.WriteFile(allowed, []byte("mallory@example.com "+string(pub)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.keyring = keyringState(allowed)
+	if st := s.verify(msg, commit, "r1"); st != sigUnverified {
+		t.Errorf("signed message after the allowed signers changed is %s", st)
+	}
+
+	msg.Header.Set("Vote", "reject")
+	if st := s.verify(msg, commit, "r1"); st != sigInvalid {
+		t.Errorf("tampered message is %s", st)
+	}
+
+	msg.Header.Del("Signature")
+	if st := s.verify(msg, commit, "r1"); st != sigUnverified {
+		t.Errorf("unsigned message is %s", st)
+	}
+}
+
+func TestGpgStatus(t *testing.T) {
+	for _, tc := range []struct {
+		out, want string
+	}{
+		{"[GNUPG:] NEWSIG\n[GNUPG:] GOODSIG 0123456789ABCDEF Alice <alice@example.com>\n[GNUPG:] VALIDSIG x\n[GNUPG:] TRUST_FULLY 0 pgp\n", sigVerified},
+		{"[GNUPG:] GOODSIG 0123456789ABCDEF Alice <alice@example.com>\n[GNUPG:] VALIDSIG x\n[GNUPG:] TRUST_ULTIMATE 0 pgp\n", sigVerified},
+		{"[GNUPG:] GOODSIG 0123456789ABCDEF Alice <alice@example.com>\n[GNUPG:] VALIDSIG x\n[GNUPG:] TRUST_UNDEFINED 0 pgp\n", sigUnverified},
+		{"[GNUPG:] GOODSIG 0123456789ABCDEF Alice <alice@example.com>\n[GNUPG:] VALIDSIG x\n", sigUnverified},
+		{"[GNUPG:] GOODSIG 0123456789ABCDEF Mallory <mallory@example.com>\n", sigUnverified},
+		{"[GNUPG:] BADSIG 0123456789ABCDEF Alice <alice@example.com>\n", sigInvalid},
+		{"[GNUPG:] ERRSIG 0123456789ABCDEF 1 10 00 1700000000 9\n[GNUPG:] NO_PUBKEY 0123456789ABCDEF\n", sigUnverified},
+	} {
+		if got := gpgStatus([]byte(tc.out), "alice@example.com"); got != tc.want {
+			t.Errorf("%q: got %s, expected %s", tc.out, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// submoduleConfig is the file in the root of the working directory that lists the submodules.
+const submoduleConfig = ".gitmodules"
+
+// A SubmoduleChange is a submodule that the diff of a review moves to another commit.
+// If the submodule is checked out, Repo serves it, and Commits and Deltas are what
+// changes in it, unless Err says why they couldn't be read, eg. because the commits
+// haven't been fetched. The change is reviewed in Repo, in the review with the id of
+// the one in the parent, see gitSubmoduleReview.
+type SubmoduleChange struct {
+	Path     string
+	Old, New *Oid // the zero oid if the submodule is added or removed
+	Repo     *gitContext
+	Review   string // the id of the review of the change in Repo, "" if there is none yet
+	Commits  []*Commit
+	Deltas   []*DiffDelta
+	Err      string
+}
+
+func isSubmodule(d *DiffDelta) bool {
+	return Filemode(d.OldFile.Mode) == FilemodeCommit || Filemode(d.NewFile.Mode) == FilemodeCommit
+}
+
+// openSubmodules opens the submodules of g that are checked out, and theirs, as contexts
+// named <g.Name>/<path>, and returns them, each after the ones in it.
+func (g *gitContext) openSubmodules() ([]*gitContext, error) {
+	if g.Workdir() == "" {
+		return nil, nil
+	}
+	fname := filepath.Join(g.Workdir(), submoduleConfig)
+	if _, err := os.Stat(fname); os.IsNotExist(err) {
+		return nil, nil
+	}
+	entries, err := g.ReadConfig(fname)
+	if err != nil {
+		return nil, err
+	}
+	g.submodules = map[string]*gitContext{}
+	var r []*gitContext
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name, "submodule.") || !strings.HasSuffix(e.Name, ".path") {
+			continue
+		}
+		p := path.Clean(e.Value)
+		dir := filepath.Join(g.Workdir(), filepath.FromSlash(p))
+		if !isRepoDir(dir) {
+			continue // not checked out
+		}
+		repo, err := openRepository(dir)
+		if err != nil {
+			return nil, fmt.Errorf("submodule %s: %v", p, err)
+		}
+		sub := &gitContext{Repo: repo, Name: g.Name + "/" + unsafeNameRe.ReplaceAllString(p, "-")}
+		subs, err := sub.openSubmodules()
+		if err != nil {
+			return nil, err
+		}
+		g.submodules[p] = sub
+		r = append(append(r, subs...), sub)
+	}
+	return r, nil
+}
+
+// gitSubmodule returns the change to a submodule in d, from the diff of review,
+// or nil if d is not a submodule.
+func (g *gitContext) gitSubmodule(review string, d *DiffDelta) (*SubmoduleChange, error) {
+	if !isSubmodule(d) {
+		return nil, nil
+	}
+	sc := &SubmoduleChange{Path: d.NewFile.Path, Old: d.OldFile.Oid, New: d.NewFile.Oid, Repo: g.submodules[d.NewFile.Path]}
+	if Filemode(d.OldFile.Mode) != FilemodeCommit {
+		sc.Old = &Oid{}
+	}
+	if Filemode(d.NewFile.Mode) != FilemodeCommit {
+		sc.New = &Oid{}
+	}
+	if sc.Repo == nil || sc.Old.IsZero() || sc.New.IsZero() {
+		return sc, nil
+	}
+
+	id, err := g.gitReviewId(review)
+	if err != nil {
+		return nil, err
+	}
+	if rev, err := sc.Repo.gitReadReview(path.Join(*refpfx, id)); err != nil {
+		return nil, err
+	} else if rev != nil {
+		sc.Review = id
+	}
+
+	sc.Commits, err = sc.Repo.Log(sc.New, sc.Old)
+	if err == nil {
+		sc.Deltas, err = sc.Repo.gitCommitDiffs(sc.Old, sc.New, nil)
+	}
+	if err != nil {
+		sc.Err = err.Error()
+	}
+	return sc, nil
+}
+
+// gitSubmoduleReview makes, or moves to the current change, the review of what review
+// changes in the submodule at p. It is stored in the notes of the submodule, with the id
+// of review, and has the old commit of the submodule as its base and the new one as its head.
+func (g *gitContext) gitSubmoduleReview(review, p string) (*Review, error) {
+	parent, err := g.gitReview(review)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := g.gitCompleteDiffOptions()
+	if err != nil {
+		return nil, err
+	}
+	deltas, err := g.gitDiffs(parent.Id, opts)
+	if err != nil {
+		return nil, err
+	}
+	var sc *SubmoduleChange
+	for _, d := range deltas {
+		if d.NewFile.Path == p {
+			if sc, err = g.gitSubmodule(parent.Id, d); err != nil {
+				return nil, err
+			}
+		}
+	}
+	switch {
+	case sc == nil:
+		return nil, &invalidReviewError{parent.Id, fmt.Sprintf("it doesn't change submodule %s", p)}
+	case sc.Repo == nil:
+		return nil, &invalidReviewError{parent.Id, fmt.Sprintf("submodule %s isn't checked out", p)}
+	case sc.Old.IsZero() || sc.New.IsZero():
+		return nil, &invalidReviewError{parent.Id, fmt.Sprintf("it adds or removes submodule %s", p)}
+	}
+
+	rev, err := sc.Repo.gitReadReview(path.Join(*refpfx, parent.Id))
+	if err != nil {
+		return nil, err
+	}
+	if rev == nil {
+		title := parent.Title
+		if title == "" {
+			title = parent.Id
+		}
+		rev = &Review{Id: parent.Id, Title: fmt.Sprintf("%s: %s", p, title)}
+	}
+	rev.Base, rev.Head = sc.Old.String(), sc.New.String()
+	if err := sc.Repo.gitSaveReview(rev); err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
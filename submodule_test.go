@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testGitmodules = "[submodule \"lib\"]\n\tpath = lib\n\turl = ../lib\n"
+
+// newSubmoduleFixture makes a fixture with lib, a repository of its own checked out in it,
+// as a submodule that master has at l1 and topic moves to l2.
+func newSubmoduleFixture(t *testing.T) (f *fixture, lib *gitContext, l1, l2 *Oid, done func()) {
+	f, done = newFixture(t)
+	r, err := initRepository(filepath.Join(f.Workdir(), "lib"))
+	if err != nil {
+		done()
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"user.name": testSig.Name, "user.email": testSig.Email} {
+		if err := r.SetConfig(k, v); err != nil {
+			done()
+			t.Fatal(err)
+		}
+	}
+	l1 = testCommit(t, r, "refs/heads/master", "L1\n", map[string]string{"x": "one\n"})
+	l2 = testCommit(t, r, "refs/heads/master", "L2\n", map[string]string{"x": "two\n", "y": "why\n"}, l1)
+	if err := ioutil.WriteFile(filepath.Join(f.Workdir(), submoduleConfig), []byte(testGitmodules), 0666); err != nil {
+		done()
+		t.Fatal(err)
+	}
+
+	gitlinkCommit := func(branch, msg string, parents []*Oid, sub *Oid) *Oid {
+		gm, err := f.CreateBlob([]byte(testGitmodules))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, err := f.CreateTree([]*TreeEntry{
+			{Name: submoduleConfig, Id: gm, Type: ObjectBlob, Filemode: FilemodeBlob},
+			{Name: "lib", Id: sub, Type: ObjectCommit, Filemode: FilemodeCommit},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := *testSig
+		sig.When = f.tick()
+		id, err := f.CreateCommit("refs/heads/"+branch, &sig, msg+"\n", tree, parents...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	base := gitlinkCommit("master", "Add lib", nil, l1)
+	f.branch("topic", "master")
+	gitlinkCommit("topic", "Bump lib", []*Oid{base}, l2)
+
+	subs, err := f.openSubmodules()
+	if err != nil || len(subs) != 1 || subs[0].Name != "test/lib" {
+		done()
+		t.Fatalf("openSubmodules: got %v, %v", subs, err)
+	}
+	return f, subs[0], l1, l2, done
+}
+
+func TestSubmodule(t *testing.T) {
+	f, lib, l1, l2, done := newSubmoduleFixture(t)
+	defer done()
+
+	deltas, err := f.gitDiffs("topic", nil)
+	if err != nil || len(deltas) != 1 {
+		t.Fatalf("gitDiffs: got %v, %v", deltas, err)
+	}
+	sc, err := f.gitSubmodule("topic", deltas[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc == nil || sc.Path != "lib" || sc.Repo != lib || !sc.Old.Equal(l1) || !sc.New.Equal(l2) || sc.Err != "" || sc.Review != "" {
+		t.Fatalf("gitSubmodule: got %+v", sc)
+	}
+	if len(sc.Commits) != 1 || sc.Commits[0].Summary() != "L2" {
+		t.Errorf("gitSubmodule: commits %v", sc.Commits)
+	}
+	var files []string
+	for _, d := range sc.Deltas {
+		files = append(files, gitDeltaString(d.Status)+" "+d.NewFile.Path)
+	}
+	if got := strings.Join(files, ", "); got != "Modified x, Added y" {
+		t.Errorf("gitSubmodule: files %s", got)
+	}
+
+	rev, err := f.gitSubmoduleReview("topic", "lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev.Id != "topic" || rev.Title != "lib: topic" || rev.Base != l1.String() || rev.Head != l2.String() {
+		t.Errorf("gitSubmoduleReview: got %+v", rev)
+	}
+	if log, err := lib.gitLog(rev.Id); err != nil || len(log) != 1 || !log[0].Id().Equal(l2) {
+		t.Errorf("gitLog of the review in lib: got %v, %v", log, err)
+	}
+	msg := &Message{Header: textproto.MIMEHeader{}, Body: "why y?"}
+	msg.Header.Set("File", "y")
+	msg.Header.Set("Line", "1")
+	if err := lib.gitNoteAppend(rev.Id, l2, msg); err != nil {
+		t.Fatal(err)
+	}
+	if notes, err := lib.gitNotes(rev.Id); err != nil || len(notes[l2.String()]) != 1 {
+		t.Errorf("gitNotes in lib: got %v, %v", notes, err)
+	}
+	if notes, err := f.gitNotes("topic"); err != nil || notes != nil {
+		t.Errorf("gitNotes in the parent: got %v, %v", notes, err)
+	}
+	if sc, err := f.gitSubmodule("topic", deltas[0]); err != nil || sc.Review != "topic" {
+		t.Errorf("gitSubmodule after gitSubmoduleReview: got %+v, %v", sc, err)
+	}
+
+	if _, err := f.gitSubmoduleReview("topic", "nope"); err == nil {
+		t.Errorf("gitSubmoduleReview of a path that isn't a submodule succeeded")
+	}
+}
+
+func TestServeSubmodule(t *testing.T) {
+	f, lib, _, _, done := newSubmoduleFixture(t)
+	defer done()
+	ts, stop := newTestServer(t, nil, f.gitContext, lib)
+	defer stop()
+
+	if status, body := ts.do("GET", "/r/test/diffs?review=topic", nil); status != http.StatusOK || !strings.Contains(body, "Submodule lib") || !strings.Contains(body, "Review in test/lib") {
+		t.Fatalf("GET /r/test/diffs: got %d\n%s", status, body)
+	}
+	if status, body := ts.do("POST", "/r/test/api/v1/submodules", url.Values{"review": {"topic"}, "path": {"lib"}}); status != http.StatusOK || !strings.Contains(body, "lib: topic") {
+		t.Errorf("POST /r/test/api/v1/submodules: got %d %q", status, body)
+	}
+	if status, body := ts.do("POST", "/r/test/api/v1/submodules", url.Values{"review": {"topic"}, "path": {"a"}}); status != http.StatusBadRequest {
+		t.Errorf("POST /r/test/api/v1/submodules of a file: got %d %q", status, body)
+	}
+	if status, body := ts.do("GET", "/r/test/lib/commits?review=topic", nil); status != http.StatusOK || !strings.Contains(body, "L2") {
+		t.Errorf("GET /r/test/lib/commits: got %d\n%s", status, body)
+	}
+	if status, body := ts.do("GET", "/r/test/diffs?review=topic", nil); status != http.StatusOK || !strings.Contains(body, `href="/r/test/lib/file?review=topic&path=y"`) {
+		t.Errorf("GET /r/test/diffs after the review in lib: got %d\n%s", status, body)
+	}
+}
@@ -3,10 +3,9 @@ package main
 import (
 	"fmt"
 	"html/template"
+	"path"
 	"strings"
 	"time"
-
-	git "github.com/libgit2/git2go"
 )
 
 // This is the table of functions we want to have available in the html templates.
@@ -34,20 +33,83 @@ var tmplFuncs = template.FuncMap{
 	"split":             func(sep, s string) []string { return strings.Split(s, sep) },    // note: reversed args
 	"trimprefix":        func(pfx, s string) string { return strings.TrimPrefix(s, pfx) }, // note: reversed args
 	"titlecase":         strings.Title,
-	"git":               func() *git.Repository { return repository },
-	"gitbranchall":      func(name string) (*git.Branch, error) { return repository.LookupBranch(name, git.BranchAll) },
-	"gitbranchlocal":    func(name string) (*git.Branch, error) { return repository.LookupBranch(name, git.BranchLocal) },
-	"gitbranchremote":   func(name string) (*git.Branch, error) { return repository.LookupBranch(name, git.BranchRemote) },
-	"gitlog":            gitLog,
-	"gitrefs":           gitRefNames,
-	"gitnotes":          gitNotes,
-	"gitconfig":         gitConfig,
-	"gitdiffs":          gitDiffs,
-	"gitpatches":        gitPatches,
+	"param":             param,
+	"lineno":            func(i int) int { return i + 1 }, // no math in templates
+	"comments":          countComments,
+	"filepath":          func(dir, name string) string { return strings.TrimPrefix(path.Join("/", dir, name), "/") },
 	"gitdeltastring":    gitDeltaString,
 	"gitdiffflagstring": gitDiffFlagString,
-	"gittree":           gitTree,
-	"gitblob":           gitBlob,
-	"lineno":            func(i int) int { return i + 1 }, // no math in templates
-	"gitnotesforfile":   gitNotesForFile,
+	"markdown":          (*gitContext)(nil).renderMarkdown,
+	"reporoot":          (*gitContext).root,
+	"repobranch": func(g *gitContext) string {
+		branch, _, _ := g.Head()
+		return branch
+	},
+}
+
+// countComments returns the number of messages in lists that are comments, not check results.
+func countComments(lists ...[]*Message) int {
+	n := 0
+	for _, msgs := range lists {
+		for _, msg := range msgs {
+			if msg.Header.Get("Check") == "" {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// repoFuncs returns tmplFuncs with the functions that read g's repository,
+// root returning the path g's pages are under, and repos returning all repositories served.
+func (g *gitContext) repoFuncs(repos []*gitContext) template.FuncMap {
+	fm := template.FuncMap{
+		"root":             g.root,
+		"repos":            func() []*gitContext { return repos },
+		"markdown":         g.renderMarkdown,
+		"git":              func() Repo { return g.Repo },
+		"gitbranches":      func() ([]*Branch, error) { return g.Branches() },
+		"gitauthor":        g.gitAuthor,
+		"gitreview":        g.gitReview,
+		"gitdescriptions":  g.gitDescriptions,
+		"githead":          g.gitHead,
+		"gitlog":           g.gitLog,
+		"gitrefs":          g.gitRefNames,
+		"gitnotes":         g.gitNotes,
+		"gitdrafts":        g.gitDrafts,
+		"gitconfig":        g.gitConfig,
+		"gitdiffs":         g.gitDiffs,
+		"gitdiffoptions":   g.gitPageDiffOptions,
+		"gitpatches":       g.gitPatches,
+		"gitreviewpatches": g.gitReviewPatches,
+		"gittree":          g.gitTree,
+		"gitblob":          g.gitBlob,
+		"gitnotesforfile":  g.gitNotesForFile,
+		"gitreviews":       g.gitReviews,
+		"gitchecks":        g.gitChecks,
+		"gitsubmodule":     g.gitSubmodule,
+		"gitpending":       g.gitPending,
+		"gitprogress":      g.gitProgress,
+		"githistory":       g.gitFileHistory,
+	}
+	for k, v := range tmplFuncs {
+		if _, ok := fm[k]; !ok {
+			fm[k] = v
+		}
+	}
+	return fm
+}
+
+// param returns the value of a mux var or the first value of a form field,
+// or "" if the page was requested without it.
+func param(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []string:
+		if len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Files a review changes can be marked as viewed, on <ref>-viewed/<review id>, which isn't
+// pushed, so the marks are those of the current user. The mark is a note on the blob of
+// the file at the head of the review, listing the paths it was viewed at, so that it is
+// gone as soon as a new iteration changes the file.
+
+func viewedRef(id string) string { return path.Join(*refpfx+"-viewed", id) }
+
+// Progress is how far the current user has come viewing the files a review changes.
+type Progress struct {
+	Viewed      map[string]bool // by path, for each file the review changes
+	Done, Total int
+}
+
+// Percent is Done of Total, 100 if there is nothing to view.
+func (p *Progress) Percent() int {
+	if p.Total == 0 {
+		return 100
+	}
+	return 100 * p.Done / p.Total
+}
+
+// viewedBlob returns the blob the viewed mark for d is on, the old one if d removes the file.
+func viewedBlob(d *DiffDelta) *Oid {
+	if d.NewFile.Oid == nil || d.NewFile.Oid.IsZero() {
+		return d.OldFile.Oid
+	}
+	return d.NewFile.Oid
+}
+
+// viewedPaths reads the paths in a viewed note.
+func viewedPaths(note string) map[string]bool {
+	r := map[string]bool{}
+	for _, p := range strings.Split(note, "\n") {
+		if p != "" {
+			r[p] = true
+		}
+	}
+	return r
+}
+
+// gitProgress returns which of the files review changes the current user has viewed as they are now.
+func (g *gitContext) gitProgress(review string) (*Progress, error) {
+	id, err := g.gitReviewId(review)
+	if err != nil {
+		return nil, err
+	}
+	deltas, err := g.gitDiffs(review, nil)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := g.Notes(viewedRef(id))
+	if err != nil && err != errNotFound {
+		return nil, err
+	}
+	marks := map[string]map[string]bool{}
+	for _, note := range notes {
+		marks[note.Id.String()] = viewedPaths(note.Message)
+	}
+	p := &Progress{Viewed: map[string]bool{}, Total: len(deltas)}
+	for _, d := range deltas {
+		viewed := marks[viewedBlob(d).String()][d.NewFile.Path]
+		p.Viewed[d.NewFile.Path] = viewed
+		if viewed {
+			p.Done++
+		}
+	}
+	return p, nil
+}
+
+// gitSetViewed marks the file at p in review as viewed by the current user, as it is at the
+// head of the review, or removes the mark.
+func (g *gitContext) gitSetViewed(review, p string, viewed bool) error {
+	id, err := g.gitReviewId(review)
+	if err != nil {
+		return err
+	}
+	deltas, err := g.gitDiffs(review, nil)
+	if err != nil {
+		return err
+	}
+	var blob *Oid
+	for _, d := range deltas {
+		if d.NewFile.Path == p {
+			blob = viewedBlob(d)
+		}
+	}
+	if blob == nil {
+		return &invalidReviewError{id, fmt.Sprintf("it doesn't change %s", p)}
+	}
+
+	note, err := g.Note(viewedRef(id), blob)
+	if err != nil && err != errNotFound {
+		return err
+	}
+	paths := viewedPaths(note)
+	if paths[p] == viewed {
+		return nil
+	}
+	if viewed {
+		paths[p] = true
+	} else {
+		delete(paths, p)
+	}
+	sig, err := g.DefaultSignature()
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return g.RemoveNote(viewedRef(id), blob, sig)
+	}
+	var lines []string
+	for p := range paths {
+		lines = append(lines, p+"\n")
+	}
+	sort.Strings(lines)
+	return g.SetNote(viewedRef(id), blob, strings.Join(lines, ""), sig)
+}
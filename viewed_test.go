@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGitProgress(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+
+	progress := func(want int, viewed ...string) {
+		t.Helper()
+		p, err := f.gitProgress("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Total != 3 || p.Done != want || len(p.Viewed) != 3 {
+			t.Errorf("gitProgress: got %d/%d %v, want %d/3", p.Done, p.Total, p.Viewed, want)
+		}
+		for _, path := range viewed {
+			if !p.Viewed[path] {
+				t.Errorf("gitProgress: %s not viewed", path)
+			}
+		}
+	}
+	progress(0)
+	for _, path := range []string{"a", "b", "a"} { // b is removed, marking twice is fine
+		if err := f.gitSetViewed("", path, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	progress(2, "a", "b")
+	if err := f.gitSetViewed("", "nope", true); err == nil {
+		t.Errorf("gitSetViewed of a file the review doesn't change succeeded")
+	}
+
+	f.commit("topic", "Change a again", map[string]string{"a": "one\n2\n3\n"})
+	progress(1, "b")
+	if err := f.gitSetViewed("", "b", false); err != nil {
+		t.Fatal(err)
+	}
+	progress(0)
+	if p, _ := f.gitProgress(""); p.Percent() != 0 {
+		t.Errorf("Percent: got %d, want 0", p.Percent())
+	}
+}
+
+func TestServeViewed(t *testing.T) {
+	f, done := newTopicFixture(t)
+	defer done()
+	ts, stop := newTestServer(t, nil, f.gitContext)
+	defer stop()
+
+	if status, body := ts.do("GET", "/r/test/diffs", nil); status != http.StatusOK || !strings.Contains(body, "0/3 files reviewed") {
+		t.Fatalf("GET /r/test/diffs: got %d\n%s", status, body)
+	}
+	form := url.Values{"review": {""}, "path": {"dir/c"}, "viewed": {"true"}}
+	if status, body := ts.do("POST", "/r/test/api/v1/viewed", form); status != http.StatusNoContent {
+		t.Fatalf("POST /r/test/api/v1/viewed: got %d %q", status, body)
+	}
+	form = url.Values{"review": {""}, "path": {"nope"}, "viewed": {"true"}}
+	if status, body := ts.do("POST", "/r/test/api/v1/viewed", form); status != http.StatusBadRequest {
+		t.Errorf("POST /r/test/api/v1/viewed of a file the review doesn't change: got %d %q", status, body)
+	}
+	if status, body := ts.do("GET", "/r/test/tree/dir", nil); status != http.StatusOK || !strings.Contains(body, "1/3 files reviewed") || !strings.Contains(body, `title="viewed"`) {
+		t.Errorf("GET /r/test/tree/dir: got %d\n%s", status, body)
+	}
+	if status, body := ts.do("GET", "/r/test/diffs", nil); status != http.StatusOK || !strings.Contains(body, "checked") {
+		t.Errorf("GET /r/test/diffs after viewing: got %d\n%s", status, body)
+	}
+}